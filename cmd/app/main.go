@@ -1,10 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/accesslog"
 	"github.com/rkachach/hss/internal/api"
+	"github.com/rkachach/hss/internal/audit"
+	"github.com/rkachach/hss/internal/auth"
+	"github.com/rkachach/hss/internal/console"
 	"github.com/rkachach/hss/internal/dataStore"
+	"github.com/rkachach/hss/internal/tracing"
 )
 
 // TODO find where to get information about dataStores
@@ -12,16 +25,171 @@ import (
 var store dataStore.DataStore = dataStore.OsFileSystem{}
 
 func main() {
+	configFile := flag.String("config", "config/config.json", "configuration `file`, JSON or YAML")
+	printConfig := flag.Bool("print-config", false, "print the configuration with the environment overrides applied, secrets redacted, and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] [rotate-keys | audit-verify [file] | admin-token | gc [--dry-run] | scrub | fsck [--repair]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *printConfig {
+		cfg, err := config.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		redacted, err := config.Redacted(&cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		output, _ := json.MarshalIndent(redacted, "", "    ")
+		fmt.Println(string(output))
+		return
+	}
 
 	// Config initialization
-	err := config.ReadConfig("config/config.json")
+	err := config.ReadConfig(*configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 	config.InitLogger()
+	config.LogConfig()
 
-	store.Init(config.AppConfig.StoreConfig.Root)
+	err = store.Init(config.AppConfig.StoreConfig.Root)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Init API servers
-	api.InitAPIRouter()
+	if flag.NArg() > 0 {
+		runCommand(flag.Arg(0), flag.Args()[1:])
+		return
+	}
+
+	// Keep the commands changing the store from running behind the server's back
+	err = dataStore.AcquireStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = auth.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = audit.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = accesslog.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = tracing.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	console.RegisterJobs()
+	go reloadOnSignal()
+
+	// Init API servers, serving until SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	err = api.InitAPIRouter(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = dataStore.OsFileSystem{}.Shutdown()
+	if err != nil {
+		config.Log.Error("Error flushing the store", "error", err)
+	}
+	config.Log.Info("Server stopped")
+}
+
+// reloadOnSignal reloads the configuration on each SIGHUP
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		_, err := config.Reload()
+		if err != nil {
+			config.Log.Error("Error reloading configuration", "error", err)
+		}
+	}
+}
+
+// runCommand runs an administration command instead of the servers
+func runCommand(command string, args []string) {
+	switch command {
+	case "rotate-keys":
+		// Re-wrap the file data keys with the configured master key, the keys they are
+		// currently wrapped with must be listed in previous_key_files
+		report, err := dataStore.OsFileSystem{}.RotateKeys()
+		fmt.Println(report)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(report.Failed) > 0 {
+			os.Exit(1)
+		}
+	case "audit-verify":
+		// Check the hash chain of the audit log, the configured one unless given
+		file := config.AppConfig.Audit.File
+		if len(args) > 0 {
+			file = args[0]
+		}
+		key, err := audit.ReadKey(config.AppConfig.Audit.HMACKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report, err := audit.Verify(file, key)
+		fmt.Println(report)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "admin-token":
+		// Generate a console admin token, its hash goes in the console admins of the config
+		token, hash, err := auth.NewAdminToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("token: %v\ntoken_hash: %v\n", token, hash)
+	case "gc":
+		// Collect the abandoned uploads, "gc --dry-run" only lists them
+		dryRun := len(args) > 0 && args[0] == "--dry-run"
+		report, err := dataStore.OsFileSystem{}.GC(context.Background(), dataStore.GCOptions{DryRun: dryRun, GracePeriod: 24 * time.Hour})
+		fmt.Println(report)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "scrub":
+		// Check the size and checksum of every file of the store
+		report, err := dataStore.OsFileSystem{}.Scrub(context.Background())
+		fmt.Println(report)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(report.Problems) > 0 {
+			os.Exit(1)
+		}
+	case "fsck":
+		// Check the metadata of the store against its data, "fsck --repair" rebuilds the
+		// metadata and quarantines what can't be repaired, failing if the server holds the
+		// store. Without it the server may be running, its uploads are then reported as open.
+		// The report is printed as JSON.
+		repair := len(args) > 0 && args[0] == "--repair"
+		report, err := dataStore.OsFileSystem{}.Fsck(context.Background(), dataStore.FsckOptions{Repair: repair})
+		fmt.Println(report)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if report.Unrepaired > 0 {
+			os.Exit(1)
+		}
+	default:
+		log.Fatalf("Unknown command %q", command)
+	}
 }
@@ -1,60 +1,270 @@
 package config
 
 import (
-	"fmt"
-	"encoding/json"
-	"os"
 	"log"
-	"io"
 )
 
+// AppConfig is the configuration read at startup, the settings which can be reloaded are
+// read from Current()
 var AppConfig AppConfigRecord
 var Logger *log.Logger
 
 type LoggingConfig struct {
 	LogFile         string   `json:"log_file"`
 	SpecificHeaders []string `json:"specific_headers"`
+	// Minimum level of the records logged: "debug", "info" (default), "warn" or "error"
+	Level string `json:"level"`
+	// Format of the records: "logfmt" (default) or "json"
+	Format string `json:"format"`
+	LogRotation
+}
+
+// LogRotation rotates a log file when it grows over MaxSizeMB or gets older than
+// RotateInterval (a duration like "24h"), keeping MaxBackups rotated files. Zero values
+// disable each limit.
+type LogRotation struct {
+	MaxSizeMB      int64  `json:"max_size_mb"`
+	RotateInterval string `json:"rotate_interval"`
+	MaxBackups     int    `json:"max_backups"`
+}
+
+// AccessLogConfig sets up the access log, one line per request served on the server port
+type AccessLogConfig struct {
+	Enabled bool `json:"enabled"`
+	// "common", "combined" (default) or "json"
+	Format string `json:"format"`
+	// File the lines are appended to, stdout if empty or "-"
+	File string `json:"file"`
+	LogRotation
+}
+
+// QuotaConfig limits the total bytes and number of files stored under Path, recursively.
+// A zero limit means unlimited.
+type QuotaConfig struct {
+	Path     string `json:"path"`
+	MaxBytes int64  `json:"max_bytes"`
+	MaxFiles int    `json:"max_files"`
 }
 
 type DataStoreConfig struct {
-	Root string   `json:"root"`
+	Root       string           `json:"root"`
+	Quotas     []QuotaConfig    `json:"quotas"`
+	Encryption EncryptionConfig `json:"encryption"`
+}
+
+// EncryptionConfig sets up encryption at rest. Master keys are 32 bytes, base64 encoded in
+// the config or in a key file (which may also hold the raw 32 bytes).
+type EncryptionConfig struct {
+	// Encrypt new files, existing files are read whatever the setting
+	Enabled       bool   `json:"enabled"`
+	MasterKey     string `json:"master_key"`
+	MasterKeyFile string `json:"master_key_file"`
+	// Files of master keys being rotated out, still used to read the files wrapped with them
+	PreviousKeyFiles []string `json:"previous_key_files"`
+}
+
+// ArchiveConfig limits archives uploaded for server side extraction, zero values use defaults
+type ArchiveConfig struct {
+	MaxArchiveBytes int64 `json:"max_archive_bytes"`
+	MaxEntries      int   `json:"max_entries"`
+	MaxEntryBytes   int64 `json:"max_entry_bytes"`
+	MaxTotalBytes   int64 `json:"max_total_bytes"`
+}
+
+// RateLimitConfig limits what each client can do on the server port. Limits apply per
+// operation class ("list", "read" and "write") to both the authenticated principal and the
+// client IP, a class without limits is unlimited.
+type RateLimitConfig struct {
+	Enabled      bool                 `json:"enabled"`
+	PerPrincipal map[string]RateLimit `json:"per_principal"`
+	PerIP        map[string]RateLimit `json:"per_ip"`
+	// Maximum number of uploads running at once for a principal or client IP, zero means unlimited
+	MaxConcurrentUploads int `json:"max_concurrent_uploads"`
+	// Take the client IP from the last X-Forwarded-For address, only when behind a single
+	// trusted proxy appending it
+	TrustForwardedFor bool `json:"trust_forwarded_for"`
+}
+
+// RateLimit is a token bucket, zero values mean unlimited
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// Requests allowed at once above the rate, the rate rounded up if zero
+	Burst int `json:"burst"`
+	// Bytes transferred per second, in request and response bodies
+	BytesPerSecond int64 `json:"bytes_per_second"`
+}
+
+// AuditConfig sets up the hash chained log of mutating operations
+type AuditConfig struct {
+	Enabled bool   `json:"enabled"`
+	File    string `json:"file"`
+	// File of the HMAC key of the chain, at least 32 bytes. Without it the chain is plain
+	// SHA-256, which anyone able to write the log can recompute.
+	HMACKeyFile string `json:"hmac_key_file"`
+}
+
+// TracingConfig sets up the tracing of requests, down to the DataStore operations
+type TracingConfig struct {
+	Enabled bool `json:"enabled"`
+	// Where spans are exported as OTLP/JSON lines: "stdout" (default) or "file"
+	Exporter string `json:"exporter"`
+	File     string `json:"file"`
+	// Fraction of the new traces exported, 1 if not set. Traces propagated from a traceparent
+	// header follow its sampled flag.
+	SampleRatio *float64 `json:"sample_ratio"`
+}
+
+// HealthConfig sets the thresholds of the readiness checks, zero values disable each of them
+type HealthConfig struct {
+	// Free space required on the filesystem of the store root
+	MinFreeMB      int64   `json:"min_free_mb"`
+	MinFreePercent float64 `json:"min_free_percent"`
+}
+
+// ConsoleConfig protects the admin API of the console port. /healthz, /readyz and /metrics
+// stay open to probes and scrapers.
+type ConsoleConfig struct {
+	// Require admin credentials on the console port, required with auth enabled. Otherwise
+	// the admin API is only served to the local host.
+	AuthEnabled bool          `json:"auth_enabled"`
+	Admins      []AdminConfig `json:"admins"`
+}
+
+// AdminConfig is an admin of the console, authenticated with a bearer token or as the
+// password of HTTP basic authentication. Only the SHA-256 hash of the token is configured,
+// as "sha256:<hex>" (i.e: generated by the admin-token command).
+type AdminConfig struct {
+	Name      string `json:"name"`
+	TokenHash string `json:"token_hash"`
+}
+
+type AuthConfig struct {
+	// Require clients to authenticate on the server port
+	Enabled bool `json:"enabled"`
+	// Serve requests without credentials as the anonymous principal
+	AllowAnonymous bool `json:"allow_anonymous"`
+	// JSON file holding the API keys, managed through the console port, and the SigV4 access keys
+	CredentialsFile string `json:"credentials_file"`
+	SigV4           SigV4Config `json:"sigv4"`
+	JWT             JWTConfig   `json:"jwt"`
+	// Access control policies, every authenticated principal has full access if none is defined
+	Policies []PolicyConfig `json:"policies"`
+	Presign  PresignConfig  `json:"presign"`
+}
+
+// PresignConfig sets how presigned URLs are signed
+type PresignConfig struct {
+	// HMAC key of the URLs, a random one is generated on startup if empty so URLs don't
+	// survive restarts
+	Secret string `json:"secret"`
+	// Maximum validity of a URL, 7 days if zero
+	MaxExpirySeconds int `json:"max_expiry_seconds"`
+}
+
+// PolicyConfig allows or denies actions (read, write, delete, list, admin) on path prefixes to
+// principals and groups. Deny policies take precedence over allow ones.
+type PolicyConfig struct {
+	Name   string `json:"name"`
+	Effect string `json:"effect"`
+	// Principal names and group names the policy applies to, "*" matches every principal
+	Principals []string `json:"principals"`
+	Groups     []string `json:"groups"`
+	Actions    []string `json:"actions"`
+	Prefixes   []string `json:"prefixes"`
+}
+
+// SigV4Config enables AWS Signature Version 4 authentication with the access keys of the credentials file
+type SigV4Config struct {
+	Enabled bool `json:"enabled"`
+	// Region requests must be signed for, any region if empty
+	Region string `json:"region"`
+	// Service requests must be signed for, "s3" if empty
+	Service string `json:"service"`
+}
+
+// JWTConfig enables bearer JWT authentication, as issued by an OIDC identity provider
+type JWTConfig struct {
+	Enabled bool `json:"enabled"`
+	// Expected iss and aud claims, not checked if empty
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// Signing keys, from a local JWKS file or fetched from a JWKS URL
+	JWKSFile string `json:"jwks_file"`
+	JWKSURL  string `json:"jwks_url"`
+	// Claims holding the principal name and groups, "sub" and "groups" if empty
+	PrincipalClaim string `json:"principal_claim"`
+	GroupsClaim    string `json:"groups_claim"`
+}
+
+// HTTPConfig sets the limits of the server and console listeners. Timeouts are durations
+// (i.e: "30s"), "0s" disables them.
+type HTTPConfig struct {
+	// Time to read the request headers, 10s if empty
+	ReadHeaderTimeout string `json:"read_header_timeout"`
+	// Time to read a whole request, body included, which bounds the duration of uploads. None
+	// if empty.
+	ReadTimeout string `json:"read_timeout"`
+	// Time to write the response, which bounds the duration of downloads. None if empty.
+	WriteTimeout string `json:"write_timeout"`
+	// Time a keep-alive connection waits for its next request, 2m if empty
+	IdleTimeout string `json:"idle_timeout"`
+	// Maximum size of the request headers, 1MB if zero
+	MaxHeaderBytes int `json:"max_header_bytes"`
+	// Time given to the requests in progress to finish on shutdown, 30s if empty
+	ShutdownTimeout string `json:"shutdown_timeout"`
+}
+
+// TLSConfig sets up TLS on a listener. The certificate is reloaded when its files change.
+type TLSConfig struct {
+	Enabled  bool   `json:"enabled"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Minimum TLS version: "1.2" (default) or "1.3"
+	MinVersion string `json:"min_version"`
+	// CA bundle client certificates are verified against, client certificates aren't
+	// requested if empty. On the server port the certificate subject becomes the principal.
+	ClientCAFile string `json:"client_ca_file"`
+	// Accept connections without a client certificate when a client CA is set
+	ClientCertOptional bool `json:"client_cert_optional"`
 }
 
 type AppConfigRecord struct {
 	ServerPort   int	      `json:"server_port"`
 	ConsolePort  int	      `json:"console_port"`
+	ServerTLS    TLSConfig        `json:"server_tls"`
+	ConsoleTLS   TLSConfig        `json:"console_tls"`
+	HTTP         HTTPConfig       `json:"http"`
 	Logging      LoggingConfig    `json:"logging"`
+	AccessLog    AccessLogConfig  `json:"access_log"`
 	StoreConfig  DataStoreConfig  `json:"object_store"`
+	Archive      ArchiveConfig    `json:"archive"`
+	Auth         AuthConfig       `json:"auth"`
+	RateLimits   RateLimitConfig  `json:"rate_limits"`
+	Audit        AuditConfig      `json:"audit"`
+	Tracing      TracingConfig    `json:"tracing"`
+	Health       HealthConfig     `json:"health"`
+	Console      ConsoleConfig    `json:"console"`
 }
 
 func ReadConfig(filename string) error {
-	fmt.Printf("Loading config from %s\n", filename)
-	file, err := os.Open(filename)
+	cfg, err := LoadConfig(filename)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&AppConfig)
-	if err != nil {
-		return err
-	}
-
-	fmt.Printf("Config: %v\n", AppConfig)
-
+	AppConfig = cfg
+	configFile = filename
+	current.Store(nil)
 	return nil
 }
 
-func InitLogger() {
-	// Open a file for logging
-	logFile, err := os.OpenFile(AppConfig.Logging.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+// LogConfig logs the configuration read, with the secrets redacted. It's called once the
+// logger is set up from it.
+func LogConfig() {
+	redacted, err := Redacted(&AppConfig)
 	if err != nil {
-		log.Fatal(err)
+		Log.Error("Error redacting config", "error", err)
+		return
 	}
-
-	// Create a multi-writer to write logs to both stdout and the file
-	multiWriter := io.MultiWriter(os.Stdout, logFile)
-	// Create a logger to write logs to the multi-writer
-	Logger = log.New(multiWriter, "", log.Ldate|log.Ltime)
+	Log.Info("Loaded config", "file", configFile)
+	Log.Debug("Config", "config", redacted)
 }
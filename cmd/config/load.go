@@ -0,0 +1,195 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configurations are read from a JSON or YAML file, with the same field names, then every
+// setting can be overridden by an environment variable named after its path in the file:
+// HSS_SERVER_PORT, HSS_OBJECT_STORE_ROOT, HSS_LOGGING_LEVEL... Lists of strings are given
+// comma separated.
+
+// EnvPrefix starts the names of the environment variables overriding settings
+const EnvPrefix = "HSS"
+
+// LoadConfig reads the configuration file, applies the environment overrides and validates
+// the result
+func LoadConfig(filename string) (AppConfigRecord, error) {
+	var cfg AppConfigRecord
+	err := decodeConfigFile(filename, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+	err = applyEnvironment(reflect.ValueOf(&cfg).Elem(), EnvPrefix)
+	if err != nil {
+		return cfg, err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return cfg, fmt.Errorf("invalid configuration %v:\n%w", filename, err)
+	}
+	return cfg, nil
+}
+
+// decodeConfigFile decodes the file in the format of its extension, failing on unknown fields
+func decodeConfigFile(filename string, cfg *AppConfigRecord) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+	case ".yaml", ".yml":
+		// YAML is converted to JSON, to be decoded with the same field names and checks
+		var document map[string]any
+		err = yaml.Unmarshal(data, &document)
+		if err != nil {
+			return fmt.Errorf("parsing %v: %w", filename, err)
+		}
+		data, err = json.Marshal(document)
+		if err != nil {
+			return fmt.Errorf("parsing %v: %w", filename, err)
+		}
+	default:
+		return fmt.Errorf("unsupported configuration format %q, .json, .yaml or .yml expected", filepath.Ext(filename))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(cfg)
+	if err != nil {
+		return fmt.Errorf("parsing %v: %w", filename, err)
+	}
+	return nil
+}
+
+// applyEnvironment sets the fields of the struct value from the environment variables named
+// prefix followed by their JSON names, in upper case. Embedded structs share the prefix of
+// their parent.
+func applyEnvironment(value reflect.Value, prefix string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Anonymous {
+			err := applyEnvironment(value.Field(i), prefix)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		variable := prefix + "_" + strings.ToUpper(name)
+		if field.Type.Kind() == reflect.Struct {
+			err := applyEnvironment(value.Field(i), variable)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		raw, ok := os.LookupEnv(variable)
+		if !ok {
+			continue
+		}
+		err := setFromString(value.Field(i), raw)
+		if err != nil {
+			return fmt.Errorf("%v: %w", variable, err)
+		}
+	}
+	return nil
+}
+
+func setFromString(value reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		value.SetBool(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		value.SetInt(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		value.SetFloat(parsed)
+	case reflect.Pointer:
+		// Optional settings, nil when not set
+		parsed := reflect.New(value.Type().Elem())
+		err := setFromString(parsed.Elem(), raw)
+		if err != nil {
+			return err
+		}
+		value.Set(parsed)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return errors.New("can only be set in the configuration file")
+		}
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return errors.New("can only be set in the configuration file")
+	}
+	return nil
+}
+
+// secretFields are the settings redacted from printed configurations
+var secretFields = map[string]bool{"master_key": true, "secret": true, "token_hash": true}
+
+// Redacted returns cfg as a JSON document with the secrets replaced
+func Redacted(cfg *AppConfigRecord) (map[string]any, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]any
+	err = json.Unmarshal(data, &document)
+	if err != nil {
+		return nil, err
+	}
+	redact(document)
+	return document, nil
+}
+
+// redact replaces the non empty values of the secret fields found anywhere in value
+func redact(value any) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, field := range value {
+			if secretFields[key] && field != nil && field != "" {
+				value[key] = "<redacted>"
+			} else {
+				redact(field)
+			}
+		}
+	case []any:
+		for _, item := range value {
+			redact(item)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const yamlConfig = `
+server_port: 9000
+console_port: 9080
+logging:
+  log_file: app.log
+  level: debug
+  max_size_mb: 10
+  specific_headers: [X-Request-Id]
+object_store:
+  root: /tmp/store
+  quotas:
+    - path: /a
+      max_bytes: 100
+  encryption:
+    master_key: c2VjcmV0
+`
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(writeFile(t, "config.yaml", yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerPort != 9000 || cfg.Logging.Level != "debug" || cfg.Logging.MaxSizeMB != 10 ||
+		!reflect.DeepEqual(cfg.Logging.SpecificHeaders, []string{"X-Request-Id"}) || cfg.StoreConfig.Quotas[0].MaxBytes != 100 {
+		t.Error("YAML configuration not loaded ", cfg)
+	}
+	jsonCfg, err := LoadConfig(writeFile(t, "config.json", `{"server_port": 9000, "console_port": 9080,
+		"logging": {"log_file": "app.log", "level": "debug", "max_size_mb": 10, "specific_headers": ["X-Request-Id"]},
+		"object_store": {"root": "/tmp/store", "quotas": [{"path": "/a", "max_bytes": 100}], "encryption": {"master_key": "c2VjcmV0"}}}`))
+	if err != nil || !reflect.DeepEqual(cfg, jsonCfg) {
+		t.Error("JSON and YAML configurations differ ", jsonCfg, err)
+	}
+
+	// Environment overrides
+	t.Setenv("HSS_SERVER_PORT", "9100")
+	t.Setenv("HSS_OBJECT_STORE_ROOT", "/srv/store")
+	t.Setenv("HSS_LOGGING_MAX_BACKUPS", "3")
+	t.Setenv("HSS_LOGGING_SPECIFIC_HEADERS", "A, B")
+	t.Setenv("HSS_TRACING_ENABLED", "true")
+	t.Setenv("HSS_TRACING_SAMPLE_RATIO", "0")
+	cfg, err = LoadConfig(writeFile(t, "config.yml", yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerPort != 9100 || cfg.StoreConfig.Root != "/srv/store" || cfg.Logging.MaxBackups != 3 ||
+		!reflect.DeepEqual(cfg.Logging.SpecificHeaders, []string{"A", "B"}) || !cfg.Tracing.Enabled ||
+		cfg.Tracing.SampleRatio == nil || *cfg.Tracing.SampleRatio != 0 {
+		t.Error("Environment overrides not applied ", cfg)
+	}
+	t.Setenv("HSS_SERVER_PORT", "many")
+	_, err = LoadConfig(writeFile(t, "config.yml", yamlConfig))
+	if err == nil || !strings.Contains(err.Error(), "HSS_SERVER_PORT") {
+		t.Error("Invalid override accepted ", err)
+	}
+
+	redacted, err := Redacted(&cfg)
+	if err != nil || redacted["object_store"].(map[string]any)["encryption"].(map[string]any)["master_key"] != "<redacted>" {
+		t.Error("Secret not redacted ", redacted, err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	_, err := LoadConfig(writeFile(t, "config.yaml", yamlConfig+"unknown_setting: 1\n"))
+	if err == nil || !strings.Contains(err.Error(), "unknown_setting") {
+		t.Error("Unknown field accepted ", err)
+	}
+	_, err = LoadConfig(writeFile(t, "config.toml", ""))
+	if err == nil {
+		t.Error("Unsupported format accepted")
+	}
+
+	_, err = LoadConfig(writeFile(t, "config.json", `{"server_port": 70000, "logging": {"level": "verbose", "rotate_interval": "daily"},
+		"tracing": {"sample_ratio": 2}, "rate_limits": {"per_ip": {"upload": {"requests_per_second": -1}}}, "auth": {"enabled": true}}`))
+	if err == nil {
+		t.Fatal("Invalid configuration accepted")
+	}
+	for _, expected := range []string{"server_port:", "console_port:", "logging.log_file:", "logging.level:", "logging.rotate_interval:",
+		"object_store.root:", "tracing.sample_ratio:", "rate_limits.per_ip:", "rate_limits.per_ip.upload.requests_per_second:",
+		"console.auth_enabled:"} {
+		if !strings.Contains(err.Error(), "\n"+expected) {
+			t.Errorf("Missing %v error in %v", expected, err)
+		}
+	}
+
+	// The repository configuration is valid
+	_, err = LoadConfig("../../config/config.json")
+	if err != nil {
+		t.Error(err)
+	}
+}
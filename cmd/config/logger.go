@@ -0,0 +1,261 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log is the structured logger, Logger writes unleveled records through it at info level
+var Log = slog.Default()
+
+var logLevel = new(slog.LevelVar)
+
+// logOutput is the log file, replaced when its path changes on a reload
+var logOutput = &switchWriter{}
+
+// SetLogLevel changes the level of the records logged, from "debug", "info", "warn" or "error"
+func SetLogLevel(level string) error {
+	parsed, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(parsed)
+	return nil
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	if level == "" {
+		level = "info"
+	}
+	var parsed slog.Level
+	err := parsed.UnmarshalText([]byte(level))
+	if err != nil {
+		return parsed, fmt.Errorf("invalid log level %q", level)
+	}
+	return parsed, nil
+}
+
+// switchWriter writes to a writer which can be replaced while in use
+type switchWriter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func (w *switchWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.writer == nil {
+		return len(p), nil
+	}
+	return w.writer.Write(p)
+}
+
+// set replaces the writer, closing the previous one
+func (w *switchWriter) set(writer io.Writer) {
+	w.mutex.Lock()
+	previous := w.writer
+	w.writer = writer
+	w.mutex.Unlock()
+	if closer, ok := previous.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+type logContextKey struct{}
+
+// ContextWithLog returns a copy of ctx carrying logger, for the records of a request to share
+// its attributes (the request ID...)
+func ContextWithLog(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, logContextKey{}, logger)
+}
+
+// LogFromContext returns the logger carried by ctx, Log if none
+func LogFromContext(ctx context.Context) *slog.Logger {
+	logger, ok := ctx.Value(logContextKey{}).(*slog.Logger)
+	if !ok {
+		return Log
+	}
+	return logger
+}
+
+// newLogHandler returns the handler of the configured format writing to w
+func newLogHandler(cfg LoggingConfig, w io.Writer) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch cfg.Format {
+	case "json":
+		return slog.NewJSONHandler(w, options), nil
+	case "", "logfmt", "text":
+		return slog.NewTextHandler(w, options), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", cfg.Format)
+}
+
+// rotatingFile is a log file rotated when it grows over maxSize bytes or gets older than
+// interval. Rotated files are renamed with the time of the rotation as suffix and only the
+// latest maxBackups are kept, zero values disable each of the limits.
+type rotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+const rotatedSuffixFormat = "20060102T150405.000"
+
+// OpenRotatingFile opens the log file at path for appending, rotated as set by rotation
+func OpenRotatingFile(path string, rotation LogRotation) (io.Writer, error) {
+	return openRotatingFile(path, rotation)
+}
+
+func openRotatingFile(path string, rotation LogRotation) (*rotatingFile, error) {
+	var interval time.Duration
+	if rotation.RotateInterval != "" {
+		var err error
+		interval, err = time.ParseDuration(rotation.RotateInterval)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("invalid log rotate interval %q", rotation.RotateInterval)
+		}
+	}
+	file := &rotatingFile{
+		path:       path,
+		maxSize:    rotation.MaxSizeMB << 20,
+		interval:   interval,
+		maxBackups: rotation.MaxBackups,
+	}
+	err := file.open()
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = stat.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.size > 0 && f.shouldRotate(int64(len(p))) {
+		err := f.rotate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error rotating log file %v: %v\n", f.path, err)
+		}
+	}
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file, a later write opens it again
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *rotatingFile) shouldRotate(writeSize int64) bool {
+	if f.maxSize > 0 && f.size+writeSize > f.maxSize {
+		return true
+	}
+	return f.interval > 0 && time.Since(f.opened) >= f.interval
+}
+
+func (f *rotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	err := os.Rename(f.path, f.path+"."+time.Now().Format(rotatedSuffixFormat))
+	if err != nil {
+		return err
+	}
+	f.pruneBackups()
+	return f.open()
+}
+
+// pruneBackups removes the oldest rotated files over maxBackups
+func (f *rotatingFile) pruneBackups() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, backup := range backups {
+		_, err := time.Parse(rotatedSuffixFormat, strings.TrimPrefix(backup, f.path+"."))
+		if err == nil {
+			rotated = append(rotated, backup)
+		}
+	}
+	// The suffix sorts chronologically
+	sort.Strings(rotated)
+	for len(rotated) > f.maxBackups {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
+
+func InitLogger() {
+	cfg := AppConfig.Logging
+	err := SetLogLevel(cfg.Level)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Open a file for logging, rotated as configured
+	logFile, err := OpenRotatingFile(cfg.LogFile, cfg.LogRotation)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logOutput.set(logFile)
+
+	// Write logs to both stdout and the file
+	handler, err := newLogHandler(cfg, io.MultiWriter(os.Stdout, logOutput))
+	if err != nil {
+		log.Fatal(err)
+	}
+	Log = slog.New(handler)
+	Logger = slog.NewLogLogger(handler, slog.LevelInfo)
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "app.log")
+	file, err := openRotatingFile(logFile, LogRotation{MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.maxSize = 100
+
+	line := []byte(strings.Repeat("x", 39) + "\n")
+	for i := 0; i < 20; i++ {
+		_, err := file.Write(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Rotated files are named after the time of the rotation
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	stat, err := os.Stat(logFile)
+	if err != nil || stat.Size() > 100 {
+		t.Fatal("Log file not rotated ", stat.Size(), err)
+	}
+	backups, _ := filepath.Glob(logFile + ".*")
+	if len(backups) != 2 {
+		t.Fatal("Wrong number of backups kept ", backups)
+	}
+	for _, backup := range backups {
+		data, _ := os.ReadFile(backup)
+		if len(data) != 80 {
+			t.Error("Wrong backup size ", backup, len(data))
+		}
+	}
+
+	// Rotation by age
+	file.maxSize = 0
+	file.interval = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	file.Write(line)
+	stat, _ = os.Stat(logFile)
+	if stat.Size() != int64(len(line)) {
+		t.Error("Log file not rotated by age ", stat.Size())
+	}
+
+	_, err = openRotatingFile(logFile, LogRotation{RotateInterval: "daily"})
+	if err == nil {
+		t.Error("Invalid interval accepted")
+	}
+}
+
+func TestLogLevelsAndContext(t *testing.T) {
+	defer SetLogLevel("info")
+
+	var output bytes.Buffer
+	handler, err := newLogHandler(LoggingConfig{Format: "json"}, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(handler)
+
+	err = SetLogLevel("warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	if output.Len() != 0 {
+		t.Fatal("Record below the level logged ", output.String())
+	}
+
+	ctx := ContextWithLog(context.Background(), logger.With("request_id", "abc"))
+	LogFromContext(ctx).Warn("shown", "path", "/a")
+	var record map[string]any
+	err = json.Unmarshal(output.Bytes(), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "shown" || record["level"] != "WARN" || record["request_id"] != "abc" || record["path"] != "/a" {
+		t.Error("Wrong record ", record)
+	}
+	if LogFromContext(context.Background()) != Log {
+		t.Error("Default logger not returned")
+	}
+
+	if SetLogLevel("verbose") == nil {
+		t.Error("Invalid level accepted")
+	}
+	_, err = newLogHandler(LoggingConfig{Format: "xml"}, &output)
+	if err == nil {
+		t.Error("Invalid format accepted")
+	}
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// The configuration can be reloaded while serving, on SIGHUP or from the console. The new
+// configuration is validated first, then the settings which can change at runtime are
+// swapped at once in the configuration returned by Current. The others (ports, root...) keep
+// their value until the next restart.
+
+// ReloadReport lists the settings changed by a reload
+type ReloadReport struct {
+	// Settings applied
+	Applied []string `json:"applied"`
+	// Settings ignored until the server is restarted
+	RestartRequired []string `json:"restart_required"`
+}
+
+var (
+	current     atomic.Pointer[AppConfigRecord]
+	configFile  string
+	reloadMutex sync.Mutex
+	validators  []func(*AppConfigRecord) error
+)
+
+// Current returns the configuration in effect, AppConfig until a reload. It must not be
+// modified, the configuration is replaced as a whole on reloads.
+func Current() *AppConfigRecord {
+	cfg := current.Load()
+	if cfg == nil {
+		return &AppConfig
+	}
+	return cfg
+}
+
+// RegisterValidator adds a check of the configurations reloaded, a reload failing any of
+// them isn't applied
+func RegisterValidator(validate func(cfg *AppConfigRecord) error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	validators = append(validators, validate)
+}
+
+// setting is a part of the configuration compared on reloads. Settings without apply need
+// a restart.
+type setting struct {
+	name  string
+	value func(cfg *AppConfigRecord) any
+	apply func(to *AppConfigRecord, from *AppConfigRecord)
+}
+
+var settings = []setting{
+	{name: "server_port", value: func(cfg *AppConfigRecord) any { return cfg.ServerPort }},
+	{name: "console_port", value: func(cfg *AppConfigRecord) any { return cfg.ConsolePort }},
+	{name: "server_tls", value: func(cfg *AppConfigRecord) any { return cfg.ServerTLS }},
+	{name: "console_tls", value: func(cfg *AppConfigRecord) any { return cfg.ConsoleTLS }},
+	{name: "http", value: func(cfg *AppConfigRecord) any { return cfg.HTTP }},
+	{name: "logging.format", value: func(cfg *AppConfigRecord) any { return cfg.Logging.Format }},
+	{
+		name: "logging",
+		value: func(cfg *AppConfigRecord) any {
+			logging := cfg.Logging
+			logging.Format = ""
+			return logging
+		},
+		apply: func(to *AppConfigRecord, from *AppConfigRecord) {
+			format := to.Logging.Format
+			to.Logging = from.Logging
+			to.Logging.Format = format
+		},
+	},
+	{name: "access_log", value: func(cfg *AppConfigRecord) any { return cfg.AccessLog }},
+	{name: "object_store.root", value: func(cfg *AppConfigRecord) any { return cfg.StoreConfig.Root }},
+	{name: "object_store.encryption", value: func(cfg *AppConfigRecord) any { return cfg.StoreConfig.Encryption }},
+	{
+		name:  "object_store.quotas",
+		value: func(cfg *AppConfigRecord) any { return cfg.StoreConfig.Quotas },
+		apply: func(to *AppConfigRecord, from *AppConfigRecord) { to.StoreConfig.Quotas = from.StoreConfig.Quotas },
+	},
+	{
+		name:  "archive",
+		value: func(cfg *AppConfigRecord) any { return cfg.Archive },
+		apply: func(to *AppConfigRecord, from *AppConfigRecord) { to.Archive = from.Archive },
+	},
+	{
+		name: "auth",
+		value: func(cfg *AppConfigRecord) any {
+			auth := cfg.Auth
+			auth.Policies = nil
+			return auth
+		},
+	},
+	{
+		name:  "auth.policies",
+		value: func(cfg *AppConfigRecord) any { return cfg.Auth.Policies },
+		apply: func(to *AppConfigRecord, from *AppConfigRecord) { to.Auth.Policies = from.Auth.Policies },
+	},
+	{
+		name:  "rate_limits",
+		value: func(cfg *AppConfigRecord) any { return cfg.RateLimits },
+		apply: func(to *AppConfigRecord, from *AppConfigRecord) { to.RateLimits = from.RateLimits },
+	},
+	{name: "audit", value: func(cfg *AppConfigRecord) any { return cfg.Audit }},
+	{name: "tracing", value: func(cfg *AppConfigRecord) any { return cfg.Tracing }},
+	{
+		name:  "health",
+		value: func(cfg *AppConfigRecord) any { return cfg.Health },
+		apply: func(to *AppConfigRecord, from *AppConfigRecord) { to.Health = from.Health },
+	},
+	{
+		name:  "console",
+		value: func(cfg *AppConfigRecord) any { return cfg.Console },
+		apply: func(to *AppConfigRecord, from *AppConfigRecord) { to.Console = from.Console },
+	},
+}
+
+// Reload reads again the configuration file and applies the settings which can change
+// without a restart. Nothing is applied if the new configuration is invalid.
+func Reload() (ReloadReport, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	report := ReloadReport{Applied: []string{}, RestartRequired: []string{}}
+	if configFile == "" {
+		return report, errors.New("no configuration file loaded")
+	}
+	next, err := LoadConfig(configFile)
+	if err != nil {
+		return report, err
+	}
+
+	previous := Current()
+	reloaded := *previous
+	for _, s := range settings {
+		if reflect.DeepEqual(s.value(previous), s.value(&next)) {
+			continue
+		}
+		if s.apply == nil {
+			report.RestartRequired = append(report.RestartRequired, s.name)
+			continue
+		}
+		s.apply(&reloaded, &next)
+		report.Applied = append(report.Applied, s.name)
+	}
+
+	for _, validate := range validators {
+		err = validate(&reloaded)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// The new log file is opened before anything changes, it may fail
+	var logFile *rotatingFile
+	if reloaded.Logging.LogFile != previous.Logging.LogFile || reloaded.Logging.LogRotation != previous.Logging.LogRotation {
+		logFile, err = openRotatingFile(reloaded.Logging.LogFile, reloaded.Logging.LogRotation)
+		if err != nil {
+			return report, fmt.Errorf("opening log file %v: %w", reloaded.Logging.LogFile, err)
+		}
+	}
+
+	current.Store(&reloaded)
+	SetLogLevel(reloaded.Logging.Level)
+	if logFile != nil {
+		logOutput.set(logFile)
+	}
+	Log.Info("Configuration reloaded", "file", configFile, "applied", report.Applied, "restart_required", report.RestartRequired)
+	return report, nil
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, path string, cfg AppConfigRecord) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	initial := AppConfigRecord{ServerPort: 9000, ConsolePort: 9080, StoreConfig: DataStoreConfig{Root: dir}, Logging: LoggingConfig{LogFile: filepath.Join(dir, "first.log")}}
+	writeConfigFile(t, configPath, initial)
+	err := ReadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	InitLogger()
+	defer SetLogLevel("info")
+	defer func() { AppConfig = AppConfigRecord{}; current.Store(nil) }()
+
+	updated := initial
+	updated.ServerPort = 9001
+	updated.Logging.Level = "debug"
+	updated.Logging.LogFile = filepath.Join(dir, "second.log")
+	updated.StoreConfig.Quotas = []QuotaConfig{{Path: "/a", MaxBytes: 10}}
+	writeConfigFile(t, configPath, updated)
+	report, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Applied, []string{"logging", "object_store.quotas"}) || !reflect.DeepEqual(report.RestartRequired, []string{"server_port"}) {
+		t.Error("Unexpected reload report ", report)
+	}
+	if Current().ServerPort != 9000 || len(Current().StoreConfig.Quotas) != 1 || Current().Logging.Level != "debug" {
+		t.Error("Reloaded settings not applied as expected ", *Current())
+	}
+	Log.Debug("after reload")
+	logged, _ := os.ReadFile(updated.Logging.LogFile)
+	if !strings.Contains(string(logged), "after reload") {
+		t.Error("Log file not switched ", string(logged))
+	}
+
+	// Invalid configurations are not applied
+	invalid := updated
+	invalid.Logging.Level = "verbose"
+	invalid.StoreConfig.Quotas = nil
+	writeConfigFile(t, configPath, invalid)
+	_, err = Reload()
+	if err == nil || len(Current().StoreConfig.Quotas) != 1 {
+		t.Error("Invalid configuration applied ", err)
+	}
+	RegisterValidator(func(cfg *AppConfigRecord) error {
+		if len(cfg.StoreConfig.Quotas) == 0 {
+			return errors.New("quotas required")
+		}
+		return nil
+	})
+	defer func() { validators = validators[:len(validators)-1] }()
+	invalid.Logging.Level = "debug"
+	writeConfigFile(t, configPath, invalid)
+	_, err = Reload()
+	if err == nil || len(Current().StoreConfig.Quotas) != 1 {
+		t.Error("Configuration failing a validator applied ", err)
+	}
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Validate checks the settings, the error lists every invalid one with its path in the
+// configuration file
+func (cfg *AppConfigRecord) Validate() error {
+	var errs []error
+	invalid := func(field string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%v: %v", field, fmt.Sprintf(format, args...)))
+	}
+	nonNegative := func(field string, value float64) {
+		if value < 0 {
+			invalid(field, "must not be negative")
+		}
+	}
+	oneOf := func(field string, value string, allowed ...string) {
+		for _, candidate := range allowed {
+			if value == candidate {
+				return
+			}
+		}
+		invalid(field, "invalid value %q, expected one of %q", value, allowed)
+	}
+
+	if cfg.ServerPort < 1 || cfg.ServerPort > 65535 {
+		invalid("server_port", "must be a port between 1 and 65535")
+	}
+	if cfg.ConsolePort < 1 || cfg.ConsolePort > 65535 {
+		invalid("console_port", "must be a port between 1 and 65535")
+	}
+	if cfg.ServerPort == cfg.ConsolePort && cfg.ServerPort != 0 {
+		invalid("console_port", "must differ from server_port")
+	}
+	validateTLS := func(field string, tls TLSConfig) {
+		if tls.Enabled && (tls.CertFile == "" || tls.KeyFile == "") {
+			invalid(field, "cert_file and key_file are required when enabled")
+		}
+		oneOf(field+".min_version", tls.MinVersion, "", "1.2", "1.3")
+	}
+	validateTLS("server_tls", cfg.ServerTLS)
+	validateTLS("console_tls", cfg.ConsoleTLS)
+
+	validateDuration := func(field string, value string) {
+		if _, err := ParseDuration(value); err != nil {
+			invalid(field, "invalid duration %q", value)
+		}
+	}
+	validateDuration("http.read_header_timeout", cfg.HTTP.ReadHeaderTimeout)
+	validateDuration("http.read_timeout", cfg.HTTP.ReadTimeout)
+	validateDuration("http.write_timeout", cfg.HTTP.WriteTimeout)
+	validateDuration("http.idle_timeout", cfg.HTTP.IdleTimeout)
+	validateDuration("http.shutdown_timeout", cfg.HTTP.ShutdownTimeout)
+	nonNegative("http.max_header_bytes", float64(cfg.HTTP.MaxHeaderBytes))
+
+	validateRotation := func(field string, rotation LogRotation) {
+		nonNegative(field+".max_size_mb", float64(rotation.MaxSizeMB))
+		nonNegative(field+".max_backups", float64(rotation.MaxBackups))
+		validateDuration(field+".rotate_interval", rotation.RotateInterval)
+	}
+	if cfg.Logging.LogFile == "" {
+		invalid("logging.log_file", "is required")
+	}
+	if _, err := parseLogLevel(cfg.Logging.Level); err != nil {
+		invalid("logging.level", "invalid value %q, expected one of [\"debug\" \"info\" \"warn\" \"error\"]", cfg.Logging.Level)
+	}
+	oneOf("logging.format", cfg.Logging.Format, "", "logfmt", "text", "json")
+	validateRotation("logging", cfg.Logging.LogRotation)
+	oneOf("access_log.format", cfg.AccessLog.Format, "", "common", "combined", "json")
+	validateRotation("access_log", cfg.AccessLog.LogRotation)
+
+	if cfg.StoreConfig.Root == "" {
+		invalid("object_store.root", "is required")
+	}
+	for i, quota := range cfg.StoreConfig.Quotas {
+		field := fmt.Sprintf("object_store.quotas[%d]", i)
+		if quota.Path == "" {
+			invalid(field+".path", "is required")
+		}
+		nonNegative(field+".max_bytes", float64(quota.MaxBytes))
+		nonNegative(field+".max_files", float64(quota.MaxFiles))
+	}
+	encryption := cfg.StoreConfig.Encryption
+	if encryption.Enabled && encryption.MasterKey == "" && encryption.MasterKeyFile == "" {
+		invalid("object_store.encryption", "master_key or master_key_file is required when enabled")
+	}
+
+	nonNegative("archive.max_archive_bytes", float64(cfg.Archive.MaxArchiveBytes))
+	nonNegative("archive.max_entries", float64(cfg.Archive.MaxEntries))
+	nonNegative("archive.max_entry_bytes", float64(cfg.Archive.MaxEntryBytes))
+	nonNegative("archive.max_total_bytes", float64(cfg.Archive.MaxTotalBytes))
+
+	if cfg.Auth.Enabled && cfg.Auth.CredentialsFile == "" {
+		invalid("auth.credentials_file", "is required when auth is enabled")
+	}
+	if cfg.Auth.Enabled && !cfg.Console.AuthEnabled {
+		invalid("console.auth_enabled", "is required when auth is enabled, the console manages the credentials")
+	}
+	if cfg.Auth.JWT.Enabled && cfg.Auth.JWT.JWKSFile == "" && cfg.Auth.JWT.JWKSURL == "" {
+		invalid("auth.jwt", "jwks_file or jwks_url is required when enabled")
+	}
+	nonNegative("auth.presign.max_expiry_seconds", float64(cfg.Auth.Presign.MaxExpirySeconds))
+
+	validateLimits := func(field string, limits map[string]RateLimit) {
+		classes := make([]string, 0, len(limits))
+		for class := range limits {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			oneOf(field, class, "list", "read", "write")
+			nonNegative(field+"."+class+".requests_per_second", limits[class].RequestsPerSecond)
+			nonNegative(field+"."+class+".burst", float64(limits[class].Burst))
+			nonNegative(field+"."+class+".bytes_per_second", float64(limits[class].BytesPerSecond))
+		}
+	}
+	validateLimits("rate_limits.per_principal", cfg.RateLimits.PerPrincipal)
+	validateLimits("rate_limits.per_ip", cfg.RateLimits.PerIP)
+	nonNegative("rate_limits.max_concurrent_uploads", float64(cfg.RateLimits.MaxConcurrentUploads))
+
+	if cfg.Audit.Enabled && cfg.Audit.File == "" {
+		invalid("audit.file", "is required when audit is enabled")
+	}
+	oneOf("tracing.exporter", cfg.Tracing.Exporter, "", "stdout", "file")
+	if cfg.Tracing.Enabled && cfg.Tracing.Exporter == "file" && cfg.Tracing.File == "" {
+		invalid("tracing.file", "is required with the file exporter")
+	}
+	if ratio := cfg.Tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		invalid("tracing.sample_ratio", "must be between 0 and 1")
+	}
+	nonNegative("health.min_free_mb", float64(cfg.Health.MinFreeMB))
+	if cfg.Health.MinFreePercent < 0 || cfg.Health.MinFreePercent > 100 {
+		invalid("health.min_free_percent", "must be between 0 and 100")
+	}
+
+	return errors.Join(errs...)
+}
+
+// ParseDuration parses an optional duration setting, zero if empty
+func ParseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err == nil && duration < 0 {
+		err = fmt.Errorf("negative duration %q", value)
+	}
+	return duration, err
+}
@@ -0,0 +1,166 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// The access log has a line per request served, written once the response is sent. The
+// common and combined formats are those of the Apache and NGINX logs, followed by the
+// operation, the bytes received and the duration in microseconds:
+//
+//	host - principal [time] "request line" status bytes_sent ["referer" "user agent"] operation bytes_received duration_us
+
+const (
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+	FormatJSON     = "json"
+)
+
+// Entry describes a request served and its response
+type Entry struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Principal     string    `json:"principal,omitempty"`
+	Operation     string    `json:"operation"`
+	Method        string    `json:"method"`
+	URI           string    `json:"uri"`
+	Proto         string    `json:"proto"`
+	Status        int       `json:"status"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Duration      float64   `json:"duration_seconds"`
+	Referer       string    `json:"referer,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+}
+
+// Log writes access log lines in a format
+type Log struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	format string
+}
+
+var accessLog *Log
+
+// Init opens the configured access log
+func Init() error {
+	cfg := config.AppConfig.AccessLog
+	if !cfg.Enabled {
+		return nil
+	}
+	format := cfg.Format
+	if format == "" {
+		format = FormatCombined
+	}
+	var writer io.Writer = os.Stdout
+	if cfg.File != "" && cfg.File != "-" {
+		var err error
+		writer, err = config.OpenRotatingFile(cfg.File, cfg.LogRotation)
+		if err != nil {
+			return fmt.Errorf("opening access log %v: %w", cfg.File, err)
+		}
+	}
+	var err error
+	accessLog, err = New(writer, format)
+	return err
+}
+
+// Enabled tells whether requests are being logged
+func Enabled() bool {
+	return accessLog != nil
+}
+
+// Write logs entry in the access log, if enabled
+func Write(entry Entry) error {
+	if accessLog == nil {
+		return nil
+	}
+	return accessLog.Write(entry)
+}
+
+// New returns an access log writing lines in format to writer
+func New(writer io.Writer, format string) (*Log, error) {
+	switch format {
+	case FormatCommon, FormatCombined, FormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid access log format %q", format)
+	}
+	return &Log{writer: writer, format: format}, nil
+}
+
+// Write writes the line of entry
+func (log *Log) Write(entry Entry) error {
+	line, err := Format(entry, log.format)
+	if err != nil {
+		return err
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	_, err = log.writer.Write(line)
+	return err
+}
+
+// Format returns the line of entry in format, newline included
+func Format(entry Entry, format string) ([]byte, error) {
+	if format == FormatJSON {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	}
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s - %s [%s] %s %d %s",
+		field(entry.RemoteAddr),
+		field(entry.Principal),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(entry.Method+" "+entry.URI+" "+entry.Proto),
+		entry.Status,
+		bytesField(entry.BytesSent))
+	if format == FormatCombined {
+		fmt.Fprintf(&line, " %s %s", quotedField(entry.Referer), quotedField(entry.UserAgent))
+	}
+	fmt.Fprintf(&line, " %s %s %d\n",
+		field(entry.Operation),
+		bytesField(entry.BytesReceived),
+		int64(entry.Duration*1e6))
+	return []byte(line.String()), nil
+}
+
+// field returns value as a field of the common format, which can't hold spaces
+func field(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Map(func(c rune) rune {
+		if c <= ' ' || c == '"' || c > '~' {
+			return '_'
+		}
+		return c
+	}, value)
+}
+
+func quotedField(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	return strconv.Quote(value)
+}
+
+func bytesField(bytes int64) string {
+	if bytes == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(bytes, 10)
+}
@@ -0,0 +1,63 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var entry = Entry{
+	Time:          time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC),
+	RequestID:     "abc",
+	RemoteAddr:    "10.0.0.1",
+	Principal:     "alice",
+	Operation:     "CreateFile",
+	Method:        "POST",
+	URI:           "/dir/file?type=file",
+	Proto:         "HTTP/1.1",
+	Status:        200,
+	BytesReceived: 1024,
+	Duration:      0.0125,
+	UserAgent:     `curl "7"`,
+}
+
+func TestFormats(t *testing.T) {
+	for format, expected := range map[string]string{
+		FormatCommon:   `10.0.0.1 - alice [01/Mar/2024:10:20:30 +0000] "POST /dir/file?type=file HTTP/1.1" 200 - CreateFile 1024 12500` + "\n",
+		FormatCombined: `10.0.0.1 - alice [01/Mar/2024:10:20:30 +0000] "POST /dir/file?type=file HTTP/1.1" 200 - "-" "curl \"7\"" CreateFile 1024 12500` + "\n",
+	} {
+		line, err := Format(entry, format)
+		if err != nil || string(line) != expected {
+			t.Errorf("Wrong %v line %q: %v", format, line, err)
+		}
+	}
+
+	anonymous := entry
+	anonymous.Principal = ""
+	anonymous.RemoteAddr = "bad host"
+	line, _ := Format(anonymous, FormatCommon)
+	if !bytes.HasPrefix(line, []byte("bad_host - - [")) {
+		t.Errorf("Wrong fields %q", line)
+	}
+
+	var buffer bytes.Buffer
+	log, err := New(&buffer, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = log.Write(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Entry
+	err = json.Unmarshal(buffer.Bytes(), &decoded)
+	if err != nil || decoded != entry {
+		t.Errorf("Wrong JSON line %q: %v", buffer.String(), err)
+	}
+
+	_, err = New(&buffer, "apache")
+	if err == nil {
+		t.Error("Invalid format accepted")
+	}
+}
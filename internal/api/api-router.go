@@ -1,18 +1,22 @@
 package api
 
 import (
+	"context"
 	"net/http"
 	"github.com/gorilla/mux"
-	"log"
 	"fmt"
+	"github.com/rkachach/hss/internal/auth"
 	"github.com/rkachach/hss/internal/hss"
 	"github.com/rkachach/hss/cmd/config"
 	"github.com/rkachach/hss/internal/console"
+	"github.com/rkachach/hss/internal/metrics"
 )
 
 const SlashSeparator string = "/"
 
-func InitAPIRouter() {
+// InitAPIRouter serves the API and the management console until ctx is done, then shuts
+// both down gracefully
+func InitAPIRouter(ctx context.Context) error {
 
 	router := mux.NewRouter().SkipClean(true).UseEncodedPath()
 	apiRouter := router.PathPrefix(SlashSeparator).Subrouter()
@@ -26,14 +30,20 @@ func InitAPIRouter() {
 		////////////////////////////////////////
 
 		// Directory operations
+		router.Methods(http.MethodPost).HandlerFunc(hss.Wrapper("ExtractArchive", hss.ExtractArchive)).Queries("type", "directory", "operation", "extract")
 		router.Methods(http.MethodPost).HandlerFunc(hss.Wrapper("CreateDirectory", hss.CreateDirectory)).Queries("type", "directory")
 		router.Methods(http.MethodGet).HandlerFunc(hss.Wrapper("ListDirectory", hss.ListDirectory)).Queries("type", "directory", "operation", "list")
+		router.Methods(http.MethodGet).HandlerFunc(hss.Wrapper("DownloadDirectory", hss.DownloadDirectory)).Queries("type", "directory", "format", "{format}")
 		router.Methods(http.MethodGet).HandlerFunc(hss.Wrapper("GetDirectory", hss.GetDirectory)).Queries("type", "directory")
 		router.Methods(http.MethodHead).HandlerFunc(hss.Wrapper("HeadDirectory", hss.HeadDirectory)).Queries("type", "directory")
 		router.Methods(http.MethodDelete).HandlerFunc(hss.Wrapper("DeleteDirectory", hss.DeleteDirectory)).Queries("type", "directory")
 
 		// File operations
+		router.Methods(http.MethodPost).HandlerFunc(hss.Wrapper("PresignFile", hss.PresignFile)).Queries("type", "file", "operation", "presign")
+		router.Methods(http.MethodGet).HandlerFunc(presigned(hss.Wrapper("GetFile", hss.GetFile))).Queries("type", "file", auth.PresignSignatureParam, "{signature}")
+		router.Methods(http.MethodPut).HandlerFunc(presigned(hss.Wrapper("CreateFile", hss.CreateFile))).Queries("type", "file", auth.PresignSignatureParam, "{signature}")
 		router.Methods(http.MethodPost).HandlerFunc(hss.Wrapper("CreateFile", hss.CreateFile)).Queries("type", "file")
+		router.Methods(http.MethodPut).HandlerFunc(hss.Wrapper("CreateFile", hss.CreateFile)).Queries("type", "file")
 		router.Methods(http.MethodGet).HandlerFunc(hss.Wrapper("GetFile", hss.GetFile)).Queries("type", "file")
 		router.Methods(http.MethodHead).HandlerFunc(hss.Wrapper("HeadFile", hss.HeadFile)).Queries("type", "file")
 		router.Methods(http.MethodDelete).HandlerFunc(hss.Wrapper("DeleteFile", hss.DeleteFile)).Queries("type", "file")
@@ -46,7 +56,7 @@ func InitAPIRouter() {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*") // Set the allowed origin, or replace * with your specific domain
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Content-Disposition")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Content-Disposition, X-API-Key")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
@@ -62,14 +72,43 @@ func InitAPIRouter() {
 	/////////////////////////////////////////////////
 	consoleRouter := http.NewServeMux()
 	consoleRouter.HandleFunc("/config", console.ConsoleHandler)
+	consoleRouter.HandleFunc("/config/reload", console.ReloadHandler)
+	consoleRouter.HandleFunc("/auth/keys", console.APIKeysHandler)
+	consoleRouter.HandleFunc("/auth/keys/", console.APIKeysHandler)
+	consoleRouter.HandleFunc("/policy/simulate", console.PolicySimulateHandler)
+	consoleRouter.HandleFunc("/status", console.StatusHandler)
+	consoleRouter.HandleFunc("/uploads", console.UploadsHandler)
+	consoleRouter.HandleFunc("/uploads/", console.UploadsHandler)
+	consoleRouter.HandleFunc("/usage", console.UsageHandler)
+	consoleRouter.HandleFunc("/jobs", console.JobsHandler)
+	consoleRouter.HandleFunc("/jobs/", console.JobsHandler)
+	consoleRouter.HandleFunc("/metrics", metrics.Handler)
+	consoleRouter.HandleFunc("/healthz", console.HealthzHandler)
+	consoleRouter.HandleFunc("/readyz", console.ReadyzHandler)
 
-	// listen on the console port
-	go func() {
-		addr := fmt.Sprintf(":%v", config.AppConfig.ConsolePort)
-		log.Fatal(http.ListenAndServe(addr, consoleRouter))
-	}()
+	httpConfig := config.AppConfig.HTTP
+	consoleServer, err := newServer(fmt.Sprintf(":%v", config.AppConfig.ConsolePort), config.AppConfig.ConsoleTLS, httpConfig,
+		auth.AdminMiddleware(consoleRouter))
+	if err != nil {
+		return err
+	}
+	server, err := newServer(fmt.Sprintf(":%v", config.AppConfig.ServerPort), config.AppConfig.ServerTLS, httpConfig,
+		corsMiddleware(withPresignedURLs(router, auth.Middleware(router))))
+	if err != nil {
+		return err
+	}
+
+	// listen on the console and main server ports
+	errs := make(chan error, 2)
+	go func() { errs <- serve(consoleServer) }()
+	go func() { errs <- serve(server) }()
+	select {
+	case err = <-errs:
+		// A listener failed, the process exits
+		return err
+	case <-ctx.Done():
+	}
 
-	// listen on the main server port
-	addr := fmt.Sprintf(":%v", config.AppConfig.ServerPort)
-	log.Fatal(http.ListenAndServe(addr, corsMiddleware(router)))
+	shutdown(server, consoleServer, httpConfig)
+	return nil
 }
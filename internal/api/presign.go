@@ -0,0 +1,64 @@
+package api
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/auth"
+)
+
+// presigned validates the presigned URL of a request before dispatching it to f, on behalf
+// of the principal that issued the URL
+func presigned(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filePath, err := url.QueryUnescape(mux.Vars(r)["path"])
+		if err != nil {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		grant, err := auth.VerifyPresigned(r, filePath)
+		if err != nil {
+			config.LogFromContext(r.Context()).Info("Presigned URL rejected", "method", r.Method, "path", filePath, "error", err)
+			http.Error(w, fmt.Sprintf("Forbidden: %v", err), http.StatusForbidden)
+			return
+		}
+
+		if grant.ContentType != "" {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType != grant.ContentType {
+				http.Error(w, fmt.Sprintf("Forbidden: content type must be %v", grant.ContentType), http.StatusForbidden)
+				return
+			}
+		}
+		if grant.MaxSize > 0 {
+			if r.ContentLength > grant.MaxSize {
+				http.Error(w, fmt.Sprintf("Upload larger than %v bytes", grant.MaxSize), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, grant.MaxSize)
+		}
+
+		f(w, r.WithContext(auth.WithPrincipal(r.Context(), grant.Principal)))
+	}
+}
+
+// withPresignedURLs sends presigned file requests straight to router, their URL is their
+// credential, and every other request through authenticated
+func withPresignedURLs(router http.Handler, authenticated http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.IsPresigned(r) {
+			authenticated.ServeHTTP(w, r)
+			return
+		}
+		query := r.URL.Query()
+		if (r.Method != http.MethodGet && r.Method != http.MethodPut) || query.Get("type") != "file" || query.Has("operation") {
+			http.Error(w, "Forbidden: presigned URLs only allow downloading or uploading a file", http.StatusForbidden)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/console"
+	"github.com/rkachach/hss/internal/uploads"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultShutdownTimeout   = 30 * time.Second
+	// Time given to the uploads aborted on shutdown to clean up their partial files
+	abortGracePeriod = 5 * time.Second
+)
+
+// durationSetting returns the configured duration, defaultValue if empty
+func durationSetting(value string, defaultValue time.Duration) time.Duration {
+	if value == "" {
+		return defaultValue
+	}
+	// Durations were validated with the configuration
+	duration, _ := config.ParseDuration(value)
+	return duration
+}
+
+// newServer returns the server of handler on addr, with the configured limits and over TLS
+// when enabled in tlsConfig
+func newServer(addr string, tlsConfig config.TLSConfig, httpConfig config.HTTPConfig, handler http.Handler) (*http.Server, error) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: durationSetting(httpConfig.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       durationSetting(httpConfig.ReadTimeout, 0),
+		WriteTimeout:      durationSetting(httpConfig.WriteTimeout, 0),
+		IdleTimeout:       durationSetting(httpConfig.IdleTimeout, defaultIdleTimeout),
+		MaxHeaderBytes:    httpConfig.MaxHeaderBytes,
+		ErrorLog:          config.Logger,
+	}
+	if !tlsConfig.Enabled {
+		return server, nil
+	}
+	var err error
+	server.TLSConfig, err = newTLSConfig(tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("setting up TLS on %v: %w", addr, err)
+	}
+	return server, nil
+}
+
+// serve serves until the server is shut down, which isn't an error
+func serve(server *http.Server) error {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// shutdown stops the server port accepting requests and waits for those in progress, up to
+// the shutdown timeout. Uploads still running then are aborted and given abortGracePeriod to
+// clean up their partial files. The console port stays up meanwhile, reporting the server isn't ready.
+func shutdown(server *http.Server, consoleServer *http.Server, httpConfig config.HTTPConfig) {
+	console.SetShuttingDown()
+	timeout := durationSetting(httpConfig.ShutdownTimeout, defaultShutdownTimeout)
+	config.Log.Info("Shutting down, waiting for the requests in progress", "timeout", timeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		// Closing the connections unblocks the uploads waiting for their body
+		aborted := uploads.AbortAll()
+		config.Log.Warn("Requests still in progress after the shutdown timeout", "aborted_uploads", aborted)
+		server.Close()
+		deadline := time.Now().Add(abortGracePeriod)
+		for len(uploads.List()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), abortGracePeriod)
+	defer cancel()
+	err = consoleServer.Shutdown(ctx)
+	if err != nil {
+		consoleServer.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/console"
+	"github.com/rkachach/hss/internal/uploads"
+)
+
+// startServer serves handler on a free local port and returns its server and URL
+func startServer(t *testing.T, httpConfig config.HTTPConfig, handler http.Handler) (*http.Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	server, err := newServer(addr, config.TLSConfig{}, httpConfig, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(server)
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return server, "http://" + addr
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	httpConfig := config.HTTPConfig{ReadHeaderTimeout: "1s", ShutdownTimeout: "300ms"}
+	uploadAborted := make(chan bool, 1)
+	server, url := startServer(t, httpConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		session := uploads.Start("CreateFile", "/file", "alice", r.RemoteAddr)
+		defer session.Finish()
+		_, err := io.Copy(io.Discard, session.Body(r.Body))
+		uploadAborted <- err != nil && session.Aborted()
+		w.WriteHeader(http.StatusConflict)
+	}))
+	consoleServer, _ := startServer(t, httpConfig, http.NotFoundHandler())
+	if server.ReadHeaderTimeout != time.Second || server.IdleTimeout != defaultIdleTimeout || server.ReadTimeout != 0 {
+		t.Error("Unexpected server timeouts ", server.ReadHeaderTimeout, server.IdleTimeout, server.ReadTimeout)
+	}
+
+	// An upload never finishing and a request finishing within the shutdown timeout
+	body, writer := io.Pipe()
+	defer writer.Close()
+	go http.Post(url+"/upload", "application/octet-stream", body)
+	writer.Write([]byte("first part"))
+	slowStatus := make(chan int, 1)
+	go func() {
+		response, err := http.Get(url + "/slow")
+		if err != nil {
+			slowStatus <- 0
+			return
+		}
+		response.Body.Close()
+		slowStatus <- response.StatusCode
+	}()
+	for len(uploads.List()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	shutdown(server, consoleServer, httpConfig)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 3*time.Second {
+		t.Error("Unexpected shutdown duration ", elapsed)
+	}
+	if status := <-slowStatus; status != http.StatusOK {
+		t.Error("Request in progress not drained ", status)
+	}
+	select {
+	case aborted := <-uploadAborted:
+		if !aborted {
+			t.Error("Upload not aborted")
+		}
+	case <-time.After(time.Second):
+		t.Error("Upload still running")
+	}
+	recorder := httptest.NewRecorder()
+	console.ReadyzHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Error("Readiness not reported down ", recorder.Code)
+	}
+	if _, err := http.Get(url + "/slow"); err == nil {
+		t.Error("Request accepted after shutdown")
+	}
+}
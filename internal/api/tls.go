@@ -0,0 +1,132 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// How often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves the certificate of a listener, loading it again when its files change
+type certReloader struct {
+	mutex       sync.Mutex
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+	modTime     time.Time
+	checked     time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := reloader.load()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// filesModTime returns the latest modification time of the certificate and key files
+func (reloader *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (reloader *certReloader) load() error {
+	modTime, err := reloader.filesModTime()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	reloader.certificate = &certificate
+	reloader.modTime = modTime
+	reloader.checked = time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate. A certificate that fails to load, i.e.
+// while its files are being replaced, is logged and the previous one kept.
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	if time.Since(reloader.checked) < certCheckInterval {
+		return reloader.certificate, nil
+	}
+	reloader.checked = time.Now()
+	modTime, err := reloader.filesModTime()
+	if err == nil && modTime.Equal(reloader.modTime) {
+		return reloader.certificate, nil
+	}
+	if err == nil {
+		err = reloader.load()
+	}
+	if err != nil {
+		config.Log.Error("Error reloading certificate", "file", reloader.certFile, "error", err)
+	} else {
+		config.Log.Info("Reloaded certificate", "file", reloader.certFile)
+	}
+	return reloader.certificate, nil
+}
+
+// newTLSConfig builds the TLS configuration of a listener
+func newTLSConfig(tlsConfig config.TLSConfig) (*tls.Config, error) {
+	if tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
+		return nil, errors.New("cert_file and key_file are required")
+	}
+	minVersion, ok := tlsVersions[tlsConfig.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported min_version %q", tlsConfig.MinVersion)
+	}
+	reloader, err := newCertReloader(tlsConfig.CertFile, tlsConfig.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	serverTLS := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if tlsConfig.ClientCAFile != "" {
+		caBundle, err := os.ReadFile(tlsConfig.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificate found in %v", tlsConfig.ClientCAFile)
+		}
+		serverTLS.ClientCAs = clientCAs
+		serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+		if tlsConfig.ClientCertOptional {
+			serverTLS.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return serverTLS, nil
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/auth"
+)
+
+var testDir string
+
+// issueCert creates a certificate for subject signed by parent (self-signed if nil) and
+// writes it with its key as PEM files named after name
+func issueCert(t *testing.T, name string, subject pkix.Name, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(testDir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(filepath.Join(testDir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	certificate, _ := x509.ParseCertificate(der)
+	return certificate, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, caKey := issueCert(t, "ca", pkix.Name{CommonName: "test CA"}, nil, nil)
+	issueCert(t, "server", pkix.Name{CommonName: "server"}, ca, caKey)
+	client, clientKey := issueCert(t, "client", pkix.Name{CommonName: "ci-runner", OrganizationalUnit: []string{"ci"}}, ca, caKey)
+
+	serverTLS, err := newTLSConfig(config.TLSConfig{
+		Enabled:      true,
+		CertFile:     filepath.Join(testDir, "server.pem"),
+		KeyFile:      filepath.Join(testDir, "server-key.pem"),
+		MinVersion:   "1.3",
+		ClientCAFile: filepath.Join(testDir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal("Error setting up TLS ", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := auth.ClientCertAuthenticator{}.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, principal.Name+"/"+principal.Groups[0])
+	}), ErrorLog: config.Logger}
+	go server.Serve(tls.NewListener(listener, serverTLS))
+	defer server.Close()
+	serverURL := "https://" + listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientTLS := &tls.Config{RootCAs: roots}
+	_, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}).Get(serverURL)
+	if err == nil {
+		t.Error("Connection without a client certificate accepted")
+	}
+
+	clientTLS.Certificates = []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}}
+	response, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}).Get(serverURL)
+	if err != nil {
+		t.Fatal("Connection with a client certificate rejected ", err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if string(body) != "ci-runner/ci" || response.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("Wrong principal or TLS version: %q %x", body, response.TLS.Version)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	ca, caKey := issueCert(t, "ca", pkix.Name{CommonName: "test CA"}, nil, nil)
+	issueCert(t, "reload", pkix.Name{CommonName: "first"}, ca, caKey)
+	reloader, err := newCertReloader(filepath.Join(testDir, "reload.pem"), filepath.Join(testDir, "reload-key.pem"))
+	if err != nil {
+		t.Fatal("Error loading certificate ", err)
+	}
+
+	// Make sure the new files get a later modification time
+	issueCert(t, "reload", pkix.Name{CommonName: "second"}, ca, caKey)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(testDir, "reload.pem"), later, later)
+
+	commonName := func() string {
+		certificate, _ := reloader.GetCertificate(nil)
+		leaf, _ := x509.ParseCertificate(certificate.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	if commonName() != "first" {
+		t.Error("Certificate reloaded before the check interval")
+	}
+	reloader.checked = time.Time{}
+	if name := commonName(); name != "second" {
+		t.Errorf("Certificate not reloaded, got %v", name)
+	}
+}
+
+func TestMain(m *testing.M) {
+	var err error
+	testDir, err = os.MkdirTemp("", "hss-api-test-")
+	if err != nil {
+		panic(err)
+	}
+	config.AppConfig.Logging.LogFile = filepath.Join(testDir, "test.log")
+	config.InitLogger()
+
+	exitCode := m.Run()
+	os.RemoveAll(testDir)
+
+	os.Exit(exitCode)
+}
@@ -0,0 +1,134 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/dataStore"
+)
+
+var store dataStore.OsFileSystem = dataStore.OsFileSystem{}
+
+func writeStoreFile(t *testing.T, filePath string, data []byte, metadata map[string]string) {
+	_, err := store.StartFileUpload(filePath, metadata)
+	if err != nil {
+		t.Fatal("Error creating file ", err)
+	}
+	_, err = store.WriteFilePart(filePath, data, 0)
+	if err != nil {
+		t.Fatal("Error writing file ", err)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatZip, FormatTarGz} {
+		store.CreateDirectory("src", nil)
+		store.CreateDirectory("src/sub", nil)
+		writeStoreFile(t, "src/a", []byte("hello"), map[string]string{"owner": "ci"})
+		writeStoreFile(t, "src/sub/b", []byte("world!"), nil)
+
+		var buffer bytes.Buffer
+		err := WriteDirectory(&buffer, format, store, "src", true)
+		if err != nil {
+			t.Fatalf("%v: error writing archive %v", format, err)
+		}
+
+		store.CreateDirectory("dst", nil)
+		report, err := Extract(&buffer, format, store, "dst", ExtractLimits{})
+		if err != nil {
+			t.Fatalf("%v: error extracting archive %v", format, err)
+		}
+		if report.Created != 3 || report.Failed != 0 || report.Bytes != 11 {
+			t.Errorf("%v: wrong report %+v", format, report)
+		}
+
+		data, err := store.ReadFile("dst/sub/b")
+		if err != nil || string(data) != "world!" {
+			t.Errorf("%v: wrong extracted content %q %v", format, data, err)
+		}
+		fileInfo, err := store.ReadFileInfo("dst/a")
+		if err != nil || fileInfo.Metadata["owner"] != "ci" || fileInfo.MD5sum == "" {
+			t.Errorf("%v: wrong extracted info %+v %v", format, fileInfo, err)
+		}
+		for _, entry := range []string{"__info__.json", "__a__.json"} {
+			if bytes.Contains(buffer.Bytes(), []byte(entry)) {
+				t.Errorf("%v: archive includes metadata file %v", format, entry)
+			}
+		}
+
+		store.DeleteDirectory("src", dataStore.DeleteDirectoryOptions{Recursive: true})
+		store.DeleteDirectory("dst", dataStore.DeleteDirectoryOptions{Recursive: true})
+	}
+}
+
+func TestExtractRefusesEscapes(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	entries := []*tar.Header{
+		{Name: "../escape", Typeflag: tar.TypeReg, Size: 1, Mode: 0644},
+		{Name: "/abs", Typeflag: tar.TypeReg, Size: 1, Mode: 0644},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc", Mode: 0777},
+		{Name: "__ok__.json", Typeflag: tar.TypeReg, Size: 1, Mode: 0644},
+		{Name: "ok", Typeflag: tar.TypeReg, Size: 1, Mode: 0644},
+	}
+	for _, header := range entries {
+		writer.WriteHeader(header)
+		if header.Size > 0 {
+			writer.Write([]byte("x"))
+		}
+	}
+	writer.Close()
+
+	store.CreateDirectory("jail", nil)
+	defer store.DeleteDirectory("jail", dataStore.DeleteDirectoryOptions{Recursive: true})
+	report, err := Extract(&buffer, FormatTar, store, "jail", ExtractLimits{})
+	if err != nil {
+		t.Fatal("Error extracting archive ", err)
+	}
+	if report.Created != 1 || report.Failed != 3 || report.Skipped != 1 {
+		t.Errorf("Wrong report %+v", report)
+	}
+	root := config.AppConfig.StoreConfig.Root
+	for _, escaped := range []string{filepath.Join(root, "escape"), filepath.Join(root, "jail", "link")} {
+		if _, err := os.Lstat(escaped); err == nil {
+			t.Errorf("Entry escaped the extraction directory: %v", escaped)
+		}
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	for _, name := range []string{"a", "b", "c"} {
+		writer.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: 4, Mode: 0644})
+		writer.Write([]byte("data"))
+	}
+	writer.Close()
+
+	store.CreateDirectory("limits", nil)
+	defer store.DeleteDirectory("limits", dataStore.DeleteDirectoryOptions{Recursive: true})
+	report, err := Extract(bytes.NewReader(buffer.Bytes()), FormatTar, store, "limits", ExtractLimits{MaxEntries: 2})
+	if err != ErrTooManyEntries || report.Created != 2 {
+		t.Errorf("Expected entries limit to stop extraction: %v %+v", err, report)
+	}
+}
+
+func TestMain(m *testing.M) {
+	root, err := os.MkdirTemp("", "hss-archive-test-")
+	if err != nil {
+		panic(err)
+	}
+	config.AppConfig.Logging.LogFile = filepath.Join(root, "test.log")
+	config.InitLogger()
+	config.AppConfig.StoreConfig.Root = filepath.Join(root, "store")
+	store.Init(config.AppConfig.StoreConfig.Root)
+
+	exitCode := m.Run()
+	os.RemoveAll(root)
+
+	os.Exit(exitCode)
+}
@@ -0,0 +1,219 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/rkachach/hss/internal/dataStore"
+)
+
+const (
+	FormatZip   = "zip"
+	FormatTar   = "tar"
+	FormatTarGz = "tar.gz"
+
+	// PAX records holding user metadata are named HSS.metadata.<field>
+	paxMetadataPrefix = "HSS.metadata."
+	// Zip extra field ID ("HS") holding user metadata as JSON
+	zipMetadataExtraID = 0x5348
+)
+
+// ContentType returns the MIME type of an archive format
+func ContentType(format string) string {
+	switch format {
+	case FormatZip:
+		return "application/zip"
+	case FormatTarGz:
+		return "application/gzip"
+	default:
+		return "application/x-tar"
+	}
+}
+
+func IsSupportedFormat(format string) bool {
+	return format == FormatZip || format == FormatTar || format == FormatTarGz
+}
+
+// entryWriter abstracts the archive format being produced
+type entryWriter interface {
+	addDirectory(name string, modTime time.Time) error
+	addFile(name string, fileInfo dataStore.FileInfo, content dataStore.FileReader) error
+	Close() error
+}
+
+// WriteDirectory streams an archive of the dirPath subtree to w, reading every file from
+// store as it goes so no temporary file is needed. Metadata sidecars are never included,
+// user metadata is embedded in the entries headers when withMetadata is set.
+func WriteDirectory(w io.Writer, format string, store dataStore.DataStore, dirPath string, withMetadata bool) error {
+	var writer entryWriter
+	switch format {
+	case FormatZip:
+		writer = &zipEntryWriter{zip: zip.NewWriter(w), withMetadata: withMetadata}
+	case FormatTar:
+		writer = &tarEntryWriter{tar: tar.NewWriter(w), withMetadata: withMetadata}
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		writer = &tarEntryWriter{tar: tar.NewWriter(gz), gzip: gz, withMetadata: withMetadata}
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+
+	err := writeTree(writer, store, dirPath, "")
+	closeErr := writer.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func writeTree(writer entryWriter, store dataStore.DataStore, dirPath string, archivePath string) error {
+	entries, err := store.ListDirectory(dirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entryPath := path.Join(dirPath, entry.Name)
+		entryArchivePath := path.Join(archivePath, entry.Name)
+
+		if entry.Type == "directory" {
+			dirInfo, err := store.GetDirectoryInfo(entryPath)
+			if err != nil {
+				return err
+			}
+			err = writer.addDirectory(entryArchivePath+"/", dirInfo.LastModified)
+			if err != nil {
+				return err
+			}
+			err = writeTree(writer, store, entryPath, entryArchivePath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Files without info (i.e: added out of the API) are archived without metadata
+		fileInfo, err := store.ReadFileInfo(entryPath)
+		if err != nil {
+			fileInfo = dataStore.FileInfo{LastModified: time.Now().UTC()}
+		}
+		content, err := store.OpenFile(entryPath)
+		if err != nil {
+			return err
+		}
+		err = writer.addFile(entryArchivePath, fileInfo, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type tarEntryWriter struct {
+	tar          *tar.Writer
+	gzip         *gzip.Writer
+	withMetadata bool
+}
+
+func (writer *tarEntryWriter) addDirectory(name string, modTime time.Time) error {
+	return writer.tar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+		ModTime:  modTime,
+	})
+}
+
+func (writer *tarEntryWriter) addFile(name string, fileInfo dataStore.FileInfo, content dataStore.FileReader) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     content.Size(),
+		ModTime:  fileInfo.LastModified,
+	}
+	if writer.withMetadata && len(fileInfo.Metadata) > 0 {
+		header.Format = tar.FormatPAX
+		header.PAXRecords = map[string]string{}
+		for field, value := range fileInfo.Metadata {
+			header.PAXRecords[paxMetadataPrefix+field] = value
+		}
+	}
+
+	err := writer.tar.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer.tar, content)
+	return err
+}
+
+func (writer *tarEntryWriter) Close() error {
+	err := writer.tar.Close()
+	if writer.gzip != nil {
+		gzipErr := writer.gzip.Close()
+		if err == nil {
+			err = gzipErr
+		}
+	}
+	return err
+}
+
+type zipEntryWriter struct {
+	zip          *zip.Writer
+	withMetadata bool
+}
+
+func (writer *zipEntryWriter) addDirectory(name string, modTime time.Time) error {
+	_, err := writer.zip.CreateHeader(&zip.FileHeader{Name: name, Modified: modTime})
+	return err
+}
+
+func (writer *zipEntryWriter) addFile(name string, fileInfo dataStore.FileInfo, content dataStore.FileReader) error {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: fileInfo.LastModified,
+	}
+	if writer.withMetadata && len(fileInfo.Metadata) > 0 {
+		extra, err := zipMetadataExtra(fileInfo.Metadata)
+		if err != nil {
+			return err
+		}
+		header.Extra = extra
+	}
+
+	entry, err := writer.zip.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, content)
+	return err
+}
+
+func (writer *zipEntryWriter) Close() error {
+	return writer.zip.Close()
+}
+
+// zipMetadataExtra encodes user metadata as a zip extra field: ID, size and JSON payload
+func zipMetadataExtra(metadata map[string]string) ([]byte, error) {
+	payload, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > 0xffff {
+		return nil, fmt.Errorf("metadata too large for a zip extra field (%d bytes)", len(payload))
+	}
+	extra := make([]byte, 4, 4+len(payload))
+	binary.LittleEndian.PutUint16(extra[0:2], zipMetadataExtraID)
+	binary.LittleEndian.PutUint16(extra[2:4], uint16(len(payload)))
+	return append(extra, payload...), nil
+}
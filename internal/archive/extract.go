@@ -0,0 +1,403 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rkachach/hss/internal/dataStore"
+)
+
+const (
+	EntryCreated = "created"
+	EntrySkipped = "skipped"
+	EntryFailed  = "failed"
+
+	// Size of the parts written to the store while extracting a file
+	extractPartSize = 1 << 20
+)
+
+var (
+	ErrTooManyEntries  = errors.New("archive has too many entries")
+	ErrArchiveTooLarge = errors.New("archive content exceeds the allowed size")
+)
+
+type ExtractLimits struct {
+	MaxArchiveBytes int64
+	MaxEntries      int
+	MaxEntryBytes   int64
+	MaxTotalBytes   int64
+}
+
+var DefaultExtractLimits = ExtractLimits{
+	MaxArchiveBytes: 4 << 30,
+	MaxEntries:      10000,
+	MaxEntryBytes:   1 << 30,
+	MaxTotalBytes:   4 << 30,
+}
+
+// WithDefaults returns the limits with unset values taken from DefaultExtractLimits
+func (limits ExtractLimits) WithDefaults() ExtractLimits {
+	if limits.MaxArchiveBytes <= 0 {
+		limits.MaxArchiveBytes = DefaultExtractLimits.MaxArchiveBytes
+	}
+	if limits.MaxEntries <= 0 {
+		limits.MaxEntries = DefaultExtractLimits.MaxEntries
+	}
+	if limits.MaxEntryBytes <= 0 {
+		limits.MaxEntryBytes = DefaultExtractLimits.MaxEntryBytes
+	}
+	if limits.MaxTotalBytes <= 0 {
+		limits.MaxTotalBytes = DefaultExtractLimits.MaxTotalBytes
+	}
+	return limits
+}
+
+type EntryResult struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ExtractReport struct {
+	Path    string        `json:"path"`
+	Created int           `json:"created"`
+	Skipped int           `json:"skipped"`
+	Failed  int           `json:"failed"`
+	Bytes   int64         `json:"bytes"`
+	Entries []EntryResult `json:"entries"`
+}
+
+func (report *ExtractReport) add(result EntryResult) {
+	switch result.Status {
+	case EntryCreated:
+		report.Created++
+		report.Bytes += result.Size
+	case EntrySkipped:
+		report.Skipped++
+	default:
+		report.Failed++
+	}
+	report.Entries = append(report.Entries, result)
+}
+
+// archiveEntry is the format independent view of an archive member
+type archiveEntry struct {
+	name     string
+	isDir    bool
+	isFile   bool
+	size     int64
+	metadata map[string]string
+	open     func() (io.ReadCloser, error)
+}
+
+// Extract unpacks the archive read from r into dirPath through store, creating the info of
+// every file and directory. Entries escaping dirPath, links and special files are refused,
+// and extraction stops once a limit is hit. The report lists the result of every entry
+// processed, it's returned along with the error if extraction had to stop.
+func Extract(r io.Reader, format string, store dataStore.DataStore, dirPath string, limits ExtractLimits) (ExtractReport, error) {
+	limits = limits.WithDefaults()
+	extractor := &extractor{
+		store:   store,
+		root:    path.Clean("/" + dirPath),
+		limits:  limits,
+		ensured: map[string]bool{},
+		report:  ExtractReport{Path: path.Clean("/" + dirPath), Entries: []EntryResult{}},
+	}
+
+	var err error
+	switch format {
+	case FormatTar:
+		err = extractor.extractTar(r)
+	case FormatTarGz:
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(r)
+		if err == nil {
+			err = extractor.extractTar(gz)
+			gz.Close()
+		}
+	case FormatZip:
+		err = extractor.extractZip(r)
+	default:
+		err = fmt.Errorf("unsupported archive format %q", format)
+	}
+	return extractor.report, err
+}
+
+type extractor struct {
+	store      dataStore.DataStore
+	root       string
+	limits     ExtractLimits
+	entries    int
+	totalBytes int64
+	ensured    map[string]bool
+	report     ExtractReport
+}
+
+func (extractor *extractor) extractTar(r io.Reader) error {
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entry := archiveEntry{
+			name:   header.Name,
+			isDir:  header.Typeflag == tar.TypeDir,
+			isFile: header.Typeflag == tar.TypeReg,
+			size:   header.Size,
+			open:   func() (io.ReadCloser, error) { return io.NopCloser(reader), nil },
+		}
+		for record, value := range header.PAXRecords {
+			if field, ok := strings.CutPrefix(record, paxMetadataPrefix); ok {
+				if entry.metadata == nil {
+					entry.metadata = map[string]string{}
+				}
+				entry.metadata[field] = value
+			}
+		}
+
+		err = extractor.extractEntry(entry)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (extractor *extractor) extractZip(r io.Reader) error {
+	// The zip central directory is at the end of the archive, it has to be spooled
+	spool, err := os.CreateTemp("", "hss-extract-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, io.LimitReader(r, extractor.limits.MaxArchiveBytes+1))
+	if err != nil {
+		return err
+	}
+	if size > extractor.limits.MaxArchiveBytes {
+		return ErrArchiveTooLarge
+	}
+
+	reader, err := zip.NewReader(spool, size)
+	if err != nil {
+		return err
+	}
+	for _, file := range reader.File {
+		mode := file.Mode()
+		entry := archiveEntry{
+			name:     file.Name,
+			isDir:    mode.IsDir(),
+			isFile:   mode.IsRegular(),
+			size:     int64(file.UncompressedSize64),
+			metadata: zipMetadata(file.Extra),
+			open:     file.Open,
+		}
+		err = extractor.extractEntry(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipMetadata decodes the user metadata extra field written by WriteDirectory, if present
+func zipMetadata(extra []byte) map[string]string {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:2])
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+size {
+			return nil
+		}
+		if id == zipMetadataExtraID {
+			var metadata map[string]string
+			if json.Unmarshal(extra[4:4+size], &metadata) != nil {
+				return nil
+			}
+			return metadata
+		}
+		extra = extra[4+size:]
+	}
+	return nil
+}
+
+// sanitizeEntryName validates an archive member name and returns it as a clean relative path
+func (extractor *extractor) sanitizeEntryName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("invalid name")
+	}
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", fmt.Errorf("absolute paths are not allowed")
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return "", fmt.Errorf("path traversal is not allowed")
+		}
+		if element != "" && extractor.store.IsMetadataFile(element) {
+			return "", fmt.Errorf("reserved name %q", element)
+		}
+	}
+	return path.Clean(name), nil
+}
+
+func (extractor *extractor) extractEntry(entry archiveEntry) error {
+	extractor.entries++
+	if extractor.entries > extractor.limits.MaxEntries {
+		return ErrTooManyEntries
+	}
+
+	result := EntryResult{Path: entry.name, Type: "file", Size: entry.size}
+	if entry.isDir {
+		result.Type = "directory"
+		result.Size = 0
+	}
+
+	name, err := extractor.sanitizeEntryName(entry.name)
+	if err != nil {
+		result.Status, result.Error = EntryFailed, err.Error()
+		extractor.report.add(result)
+		return nil
+	}
+	if name == "." {
+		if entry.isDir {
+			// The extraction root itself, as in "./"
+			return nil
+		}
+		result.Status, result.Error = EntryFailed, "empty name"
+		extractor.report.add(result)
+		return nil
+	}
+	result.Path = path.Join(extractor.root, name)
+
+	switch {
+	case entry.isDir:
+		err = extractor.ensureDirectory(result.Path)
+		if err != nil {
+			result.Status, result.Error = EntryFailed, err.Error()
+		} else {
+			result.Status = EntryCreated
+		}
+	case entry.isFile:
+		if entry.size > extractor.limits.MaxEntryBytes {
+			result.Status, result.Error = EntryFailed, fmt.Sprintf("entry exceeds the maximum size of %d bytes", extractor.limits.MaxEntryBytes)
+			break
+		}
+		if extractor.totalBytes+entry.size > extractor.limits.MaxTotalBytes {
+			return ErrArchiveTooLarge
+		}
+		var written int64
+		written, err = extractor.extractFile(result.Path, entry)
+		extractor.totalBytes += written
+		if err != nil {
+			result.Status, result.Error = EntryFailed, err.Error()
+		} else {
+			result.Status, result.Size = EntryCreated, written
+		}
+	default:
+		// Links could point anywhere, they are never created
+		result.Type = "other"
+		result.Status, result.Error = EntrySkipped, "links and special files are not supported"
+	}
+
+	extractor.report.add(result)
+	if errors.Is(err, ErrArchiveTooLarge) {
+		return err
+	}
+	return nil
+}
+
+// ensureDirectory creates dirPath and its missing parents below the extraction root
+func (extractor *extractor) ensureDirectory(dirPath string) error {
+	if dirPath == extractor.root || extractor.ensured[dirPath] {
+		return nil
+	}
+	err := extractor.ensureDirectory(path.Dir(dirPath))
+	if err != nil {
+		return err
+	}
+
+	_, err = extractor.store.GetDirectoryInfo(dirPath)
+	if err != nil {
+		err = extractor.store.CreateDirectory(dirPath, nil)
+		if err != nil {
+			return err
+		}
+	}
+	extractor.ensured[dirPath] = true
+	return nil
+}
+
+func (extractor *extractor) extractFile(filePath string, entry archiveEntry) (int64, error) {
+	err := extractor.ensureDirectory(path.Dir(filePath))
+	if err != nil {
+		return 0, err
+	}
+	content, err := entry.open()
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+
+	fileInfo, err := extractor.store.StartFileUpload(filePath, entry.metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	// Declared sizes can't be trusted, the actual content is bounded as well
+	limit := extractor.limits.MaxEntryBytes
+	if remaining := extractor.limits.MaxTotalBytes - extractor.totalBytes; remaining < limit {
+		limit = remaining
+	}
+	reader := io.LimitReader(content, limit+1)
+	hash := md5.New()
+	buffer := make([]byte, extractPartSize)
+	var written int64
+	for {
+		n, readErr := io.ReadFull(reader, buffer)
+		if n > 0 {
+			written += int64(n)
+			if written > limit {
+				extractor.store.DeleteFile(filePath)
+				if limit < extractor.limits.MaxEntryBytes {
+					return written, ErrArchiveTooLarge
+				}
+				return written, fmt.Errorf("entry exceeds the maximum size of %d bytes", extractor.limits.MaxEntryBytes)
+			}
+			hash.Write(buffer[:n])
+			fileInfo, err = extractor.store.WriteFilePart(filePath, buffer[:n], 0)
+			if err != nil {
+				extractor.store.DeleteFile(filePath)
+				return written, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			extractor.store.DeleteFile(filePath)
+			return written, readErr
+		}
+	}
+
+	fileInfo.MD5sum = hex.EncodeToString(hash.Sum(nil))
+	return written, extractor.store.UpdateFileInfo(filePath, fileInfo)
+}
@@ -0,0 +1,284 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// The audit log is a JSON lines file only ever appended to, one Record per mutating
+// operation. Each record holds the hash of the previous one and its own hash covers its
+// content, so changing, removing or reordering records breaks the chain.
+//
+// The chain only proves what the hash can't be forged for. Without a key the hashes are
+// plain SHA-256: anyone able to write the file can rewrite it and recompute every hash, so
+// it only catches accidental damage and careless edits. With a key configured the hashes are
+// HMAC-SHA256 and only the holders of the key can produce a valid chain, the key must then be
+// kept away from whoever could edit the file. In both cases dropping records from the end,
+// or a rewrite by a key holder, can't be detected from the file alone: the sequence number
+// and hash of the last record, logged on startup and reported by Verify, must be kept
+// elsewhere to check it. The key applies to the whole file, a keyed log is started anew.
+
+// Record describes a mutating operation and its result
+type Record struct {
+	Seq        int64             `json:"seq"`
+	Time       time.Time         `json:"time"`
+	Principal  string            `json:"principal"`
+	AuthMethod string            `json:"auth_method,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Operation  string            `json:"operation"`
+	Path       string            `json:"path"`
+	Status     int               `json:"status"`
+	Result     string            `json:"result"`
+	Bytes      int64             `json:"bytes"`
+	Checksum   string            `json:"checksum,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	PrevHash   string            `json:"prev_hash"`
+	Hash       string            `json:"hash"`
+}
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+var ErrBrokenChain = errors.New("audit chain broken")
+
+// computeHash returns the hash of record, that is of its JSON encoding without hash. It's
+// an HMAC with key, unless nil.
+func (record Record) computeHash(key []byte) string {
+	record.Hash = ""
+	data, _ := json.Marshal(record)
+	if key == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ReadKey reads the HMAC key of the chain from filename, nil if no file is set
+func ReadKey(filename string) ([]byte, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < 32 {
+		return nil, fmt.Errorf("%v: HMAC key must be at least 32 bytes", filename)
+	}
+	return key, nil
+}
+
+// Log appends hash chained records to a file
+type Log struct {
+	mutex    sync.Mutex
+	file     *os.File
+	key      []byte
+	seq      int64
+	lastHash string
+}
+
+var auditLog *Log
+
+// Init opens the configured audit log
+func Init() error {
+	cfg := config.AppConfig.Audit
+	if !cfg.Enabled {
+		return nil
+	}
+	key, err := ReadKey(cfg.HMACKeyFile)
+	if err != nil {
+		return fmt.Errorf("reading audit key: %w", err)
+	}
+	if key == nil {
+		config.Log.Warn("Audit log not keyed, its chain can be recomputed by anyone able to write it")
+	}
+	auditLog, err = Open(cfg.File, key)
+	if err != nil {
+		return fmt.Errorf("opening audit log %v: %w", cfg.File, err)
+	}
+	// The head of the chain, to check later the log wasn't cut or rewritten since
+	config.Log.Info("Audit log opened", "file", cfg.File, "seq", auditLog.seq, "hash", auditLog.lastHash)
+	return nil
+}
+
+// Enabled tells whether mutating operations are being audited
+func Enabled() bool {
+	return auditLog != nil
+}
+
+// Append adds record to the audit log, if enabled
+func Append(record Record) error {
+	if auditLog == nil {
+		return nil
+	}
+	return auditLog.Append(record)
+}
+
+// Open opens the audit log at path, creating it if needed, and resumes its chain. Records
+// are hashed with an HMAC with key, unless nil.
+func Open(path string, key []byte) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	line, err := lastLine(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	auditLog := &Log{file: file, key: key}
+	if line != nil {
+		var last Record
+		err = json.Unmarshal(line, &last)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("last record: %w", err)
+		}
+		auditLog.seq, auditLog.lastHash = last.Seq, last.Hash
+	}
+	return auditLog, nil
+}
+
+// lastLine returns the last line of file, nil if it's empty
+func lastLine(file *os.File) ([]byte, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Records are way smaller than this
+	const maxRecordSize = 1 << 20
+	offset := max(0, stat.Size()-maxRecordSize)
+	tail := make([]byte, stat.Size()-offset)
+	_, err = file.ReadAt(tail, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	if len(tail) == 0 {
+		return nil, nil
+	}
+	start := bytes.LastIndexByte(tail, '\n')
+	if start < 0 && offset > 0 {
+		return nil, errors.New("last record too large")
+	}
+	return tail[start+1:], nil
+}
+
+// Append chains record to the previous ones and writes it, synced to disk
+func (auditLog *Log) Append(record Record) error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	record.Seq = auditLog.seq + 1
+	record.Time = record.Time.UTC()
+	record.PrevHash = auditLog.lastHash
+	record.Hash = record.computeHash(auditLog.key)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = auditLog.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	err = auditLog.file.Sync()
+	if err != nil {
+		return err
+	}
+	auditLog.seq, auditLog.lastHash = record.Seq, record.Hash
+	return nil
+}
+
+func (auditLog *Log) Close() error {
+	return auditLog.file.Close()
+}
+
+// VerifyReport is the result of checking an audit log
+type VerifyReport struct {
+	File     string `json:"file"`
+	Records  int64  `json:"records"`
+	LastSeq  int64  `json:"last_seq"`
+	LastHash string `json:"last_hash"`
+	// Whether the hashes were checked as HMACs
+	Keyed bool `json:"keyed"`
+	Valid bool `json:"valid"`
+	// Line of the first record failing the check
+	BrokenLine int    `json:"broken_line,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// String formats the report as JSON
+func (report VerifyReport) String() string {
+	data, _ := json.MarshalIndent(report, "", "  ")
+	return string(data)
+}
+
+// Verify checks the chain of the audit log at path, hashed with key unless nil. A broken
+// chain is reported as an invalid report along with ErrBrokenChain.
+func Verify(path string, key []byte) (VerifyReport, error) {
+	report := VerifyReport{File: path, Keyed: key != nil}
+	file, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+
+	broken := func(line int, format string, args ...any) (VerifyReport, error) {
+		report.BrokenLine = line
+		report.Error = fmt.Sprintf(format, args...)
+		return report, fmt.Errorf("%w: line %v: %v", ErrBrokenChain, line, report.Error)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var record Record
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return broken(line, "invalid record: %v", err)
+		}
+		// Anything not covered by the hash, like unknown fields, is tampering too
+		encoded, _ := json.Marshal(record)
+		if !bytes.Equal(encoded, scanner.Bytes()) {
+			return broken(line, "record not in canonical form")
+		}
+		if record.Seq != report.LastSeq+1 {
+			return broken(line, "sequence %v follows %v", record.Seq, report.LastSeq)
+		}
+		if record.PrevHash != report.LastHash {
+			return broken(line, "previous hash mismatch")
+		}
+		if !hmac.Equal([]byte(record.Hash), []byte(record.computeHash(key))) {
+			return broken(line, "hash mismatch")
+		}
+		report.Records++
+		report.LastSeq, report.LastHash = record.Seq, record.Hash
+	}
+	err = scanner.Err()
+	if err != nil {
+		return broken(line+1, "%v", err)
+	}
+	report.Valid = true
+	return report, nil
+}
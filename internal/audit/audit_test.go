@@ -0,0 +1,141 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+var testDir string
+
+// writeLog appends count records to a new audit log hashed with key, reopening it for each
+func writeLog(t *testing.T, name string, count int, key []byte) string {
+	path := filepath.Join(testDir, name)
+	for i := 0; i < count; i++ {
+		auditLog, err := Open(path, key)
+		if err != nil {
+			t.Fatal("Error opening audit log ", err)
+		}
+		err = auditLog.Append(Record{Time: time.Now(), Principal: "alice", Operation: "CreateFile",
+			Path: "/dir/file", Status: 200, Result: ResultSuccess, Bytes: int64(i), Checksum: "abcd"})
+		if err != nil {
+			t.Fatal("Error appending record ", err)
+		}
+		auditLog.Close()
+	}
+	return path
+}
+
+func TestChain(t *testing.T) {
+	path := writeLog(t, "chain.log", 3, nil)
+	report, err := Verify(path, nil)
+	if err != nil || !report.Valid || report.Records != 3 || report.LastSeq != 3 || report.LastHash == "" {
+		t.Fatalf("Wrong report %+v: %v", report, err)
+	}
+
+	auditLog, _ := Open(path, nil)
+	defer auditLog.Close()
+	if auditLog.seq != 3 || auditLog.lastHash != report.LastHash {
+		t.Error("Chain not resumed on open")
+	}
+}
+
+func TestTampering(t *testing.T) {
+	for name, tamper := range map[string]func(lines [][]byte) [][]byte{
+		"changed": func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte(`"bytes":1`), []byte(`"bytes":9`), 1)
+			return lines
+		},
+		"removed": func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		},
+		"reordered": func(lines [][]byte) [][]byte {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		},
+		"field added": func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte(`{`), []byte(`{"note":"x",`), 1)
+			return lines
+		},
+	} {
+		path := writeLog(t, name+".log", 3, nil)
+		data, _ := os.ReadFile(path)
+		lines := tamper(bytes.Split(bytes.TrimSpace(data), []byte("\n")))
+		os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600)
+
+		report, err := Verify(path, nil)
+		if !errors.Is(err, ErrBrokenChain) || report.Valid || report.BrokenLine == 0 {
+			t.Errorf("Tampering %v not detected: %+v", name, report)
+		}
+	}
+
+	// A rehashed record still breaks the link with the next one
+	path := writeLog(t, "rehashed.log", 3, nil)
+	data, _ := os.ReadFile(path)
+	auditLog, _ := Open(filepath.Join(testDir, "rehashed-copy.log"), nil)
+	defer auditLog.Close()
+	auditLog.Append(Record{Principal: "mallory"})
+	copied, _ := os.ReadFile(filepath.Join(testDir, "rehashed-copy.log"))
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	lines[0] = bytes.TrimSpace(copied)
+	os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600)
+	if report, err := Verify(path, nil); err == nil || report.BrokenLine != 2 {
+		t.Errorf("Rehashed record not detected: %+v", report)
+	}
+}
+
+func TestKeyedChain(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	path := writeLog(t, "keyed.log", 3, key)
+	report, err := Verify(path, key)
+	if err != nil || !report.Valid || !report.Keyed || report.Records != 3 {
+		t.Fatalf("Wrong report %+v: %v", report, err)
+	}
+
+	// A chain recomputed without the key, or with another one, doesn't verify
+	forged := writeLog(t, "forged.log", 3, nil)
+	if report, err := Verify(forged, key); !errors.Is(err, ErrBrokenChain) || report.BrokenLine != 1 {
+		t.Errorf("Unkeyed chain accepted: %+v", report)
+	}
+	forged = writeLog(t, "forged-key.log", 3, bytes.Repeat([]byte("x"), 32))
+	if report, err := Verify(forged, key); !errors.Is(err, ErrBrokenChain) || report.BrokenLine != 1 {
+		t.Errorf("Chain of another key accepted: %+v", report)
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	if key, err := ReadKey(""); key != nil || err != nil {
+		t.Error("Key read without a file ", key, err)
+	}
+	short := filepath.Join(testDir, "short.key")
+	os.WriteFile(short, []byte("too short\n"), 0600)
+	if _, err := ReadKey(short); err == nil {
+		t.Error("Short key accepted")
+	}
+	valid := filepath.Join(testDir, "valid.key")
+	os.WriteFile(valid, []byte(strings.Repeat("k", 32)+"\n"), 0600)
+	if key, err := ReadKey(valid); err != nil || string(key) != strings.Repeat("k", 32) {
+		t.Errorf("Wrong key %q: %v", key, err)
+	}
+}
+
+func TestMain(m *testing.M) {
+	var err error
+	testDir, err = os.MkdirTemp("", "hss-audit-test-")
+	if err != nil {
+		panic(err)
+	}
+	config.AppConfig.Logging.LogFile = filepath.Join(testDir, "test.log")
+	config.InitLogger()
+
+	exitCode := m.Run()
+	os.RemoveAll(testDir)
+
+	os.Exit(exitCode)
+}
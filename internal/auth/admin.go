@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+var ErrNotAdmin = errors.New("invalid admin credentials")
+
+// NewAdminToken generates a console admin token and returns it with the hash to configure
+func NewAdminToken() (string, string, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+	token := "hssadm_" + secret
+	return token, hashSecret(token), nil
+}
+
+// ValidateAdmins checks the console admins are usable when console authentication is enabled
+func ValidateAdmins(cfg config.ConsoleConfig) error {
+	if !cfg.AuthEnabled {
+		return nil
+	}
+	if len(cfg.Admins) == 0 {
+		return errors.New("console authentication enabled without admins")
+	}
+	for _, admin := range cfg.Admins {
+		if admin.Name == "" || !strings.HasPrefix(admin.TokenHash, "sha256:") || len(admin.TokenHash) != len("sha256:")+64 {
+			return fmt.Errorf("console admin %q: a name and a sha256:<hex> token hash are required", admin.Name)
+		}
+	}
+	return nil
+}
+
+// AuthenticateAdmin returns the console admin a request is made by, from a bearer token or
+// the password of HTTP basic authentication. With basic authentication the user name must
+// match the admin name too.
+func AuthenticateAdmin(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	user, password, basic := r.BasicAuth()
+	if basic {
+		token, ok = password, true
+	}
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	hash := []byte(hashSecret(token))
+	var admin *config.AdminConfig
+	// Every admin is compared, not to leak which one matched through timing
+	admins := config.Current().Console.Admins
+	for i, candidate := range admins {
+		if subtle.ConstantTimeCompare(hash, []byte(candidate.TokenHash)) == 1 {
+			admin = &admins[i]
+		}
+	}
+	if admin == nil || (basic && user != admin.Name) {
+		return nil, ErrNotAdmin
+	}
+	return &Principal{Name: admin.Name, Method: "admin-token"}, nil
+}
+
+// consoleOpenPaths are served without admin credentials, to probes and metric scrapers
+var consoleOpenPaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// AdminMiddleware requires admin credentials on the console port. When they aren't enabled
+// the admin API is only served to clients on the local host.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if consoleOpenPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !config.Current().Console.AuthEnabled {
+			if !isLoopback(r.RemoteAddr) {
+				config.LogFromContext(r.Context()).Warn("Console request from a remote host without console authentication",
+					"method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+				http.Error(w, "Forbidden: console authentication is required from remote hosts", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := AuthenticateAdmin(r)
+		if err != nil {
+			config.LogFromContext(r.Context()).Warn("Console authentication failed", "method", r.Method, "path", r.URL.Path,
+				"remote_addr", r.RemoteAddr, "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hss-console"`)
+			http.Error(w, fmt.Sprintf("Unauthorized: %v", err), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// isLoopback tells whether the remote address of a request is on the loopback interface
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
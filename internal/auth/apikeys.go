@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API keys are presented as hss_<id>_<secret>, either in the X-API-Key header or as a bearer
+// token. Only a SHA-256 hash of the secret is stored, the key itself is shown once on creation.
+const apiKeyPrefix = "hss_"
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrExpiredAPIKey = errors.New("expired API key")
+	ErrKeyNotFound   = errors.New("API key not found")
+)
+
+type APIKey struct {
+	ID         string    `json:"id"`
+	Principal  string    `json:"principal"`
+	Groups     []string  `json:"groups,omitempty"`
+	SecretHash string    `json:"secret_hash"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires,omitempty"`
+}
+
+func (key APIKey) Expired(now time.Time) bool {
+	return !key.Expires.IsZero() && now.After(key.Expires)
+}
+
+type credentialsFile struct {
+	APIKeys    []APIKey    `json:"api_keys"`
+	AccessKeys []AccessKey `json:"access_keys,omitempty"`
+}
+
+// CredentialStore holds the API keys and access keys, persisted to a JSON file
+type CredentialStore struct {
+	mutex      sync.RWMutex
+	path       string
+	keys       map[string]APIKey
+	accessKeys map[string]AccessKey
+}
+
+var Credentials = newCredentialStore("")
+
+func newCredentialStore(path string) *CredentialStore {
+	return &CredentialStore{path: path, keys: map[string]APIKey{}, accessKeys: map[string]AccessKey{}}
+}
+
+// LoadCredentials replaces the credentials with the content of filename. A missing file
+// means no credentials yet, it's created on the first key creation.
+func LoadCredentials(filename string) error {
+	store := newCredentialStore(filename)
+	if filename == "" {
+		Credentials = store
+		return nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var content credentialsFile
+		err = json.Unmarshal(data, &content)
+		if err != nil {
+			return fmt.Errorf("%v: %w", filename, err)
+		}
+		for _, key := range content.APIKeys {
+			store.keys[key.ID] = key
+		}
+		for _, key := range content.AccessKeys {
+			store.accessKeys[key.AccessKeyID] = key
+		}
+	}
+
+	Credentials = store
+	return nil
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+func randomHex(size int) (string, error) {
+	buffer := make([]byte, size)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+// save writes the credentials file atomically. Caller must hold the mutex.
+func (store *CredentialStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+	var content credentialsFile
+	for _, id := range sortedKeys(store.keys) {
+		content.APIKeys = append(content.APIKeys, store.keys[id])
+	}
+	for _, id := range sortedKeys(store.accessKeys) {
+		content.AccessKeys = append(content.AccessKeys, store.accessKeys[id])
+	}
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(store.path), ".credentials-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmpFile.Name(), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), store.path)
+}
+
+// sortedKeys keeps the credentials file stable across saves
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CreateKey adds an API key for principal, valid for ttl (forever if zero). It returns the
+// key record and the key to hand to the client, which can't be recovered afterwards.
+func (store *CredentialStore) CreateKey(principal string, groups []string, ttl time.Duration) (APIKey, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	key := APIKey{
+		ID:         id,
+		Principal:  principal,
+		Groups:     groups,
+		SecretHash: hashSecret(secret),
+		Created:    time.Now().UTC(),
+	}
+	if ttl > 0 {
+		key.Expires = key.Created.Add(ttl)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.keys[id] = key
+	err = store.save()
+	if err != nil {
+		delete(store.keys, id)
+		return APIKey{}, "", err
+	}
+	return key, apiKeyPrefix + id + "_" + secret, nil
+}
+
+func (store *CredentialStore) RevokeKey(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key, ok := store.keys[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	delete(store.keys, id)
+	err := store.save()
+	if err != nil {
+		store.keys[id] = key
+	}
+	return err
+}
+
+// ListKeys returns the API keys without their secret hashes
+func (store *CredentialStore) ListKeys() []APIKey {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	keys := make([]APIKey, 0, len(store.keys))
+	for _, key := range store.keys {
+		key.SecretHash = ""
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// VerifyKey checks an API key as presented by a client and returns its principal
+func (store *CredentialStore) VerifyKey(apiKey string) (*Principal, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(apiKey, apiKeyPrefix), "_")
+	if !strings.HasPrefix(apiKey, apiKeyPrefix) || !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	store.mutex.RLock()
+	key, found := store.keys[id]
+	store.mutex.RUnlock()
+
+	// Compare against a dummy hash when the key is unknown to keep timing uniform
+	expectedHash := key.SecretHash
+	if !found {
+		expectedHash = hashSecret("")
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(expectedHash)) != 1 || !found {
+		return nil, ErrInvalidAPIKey
+	}
+	if key.Expired(time.Now()) {
+		return nil, ErrExpiredAPIKey
+	}
+	return &Principal{Name: key.Principal, Groups: key.Groups, Method: "api-key"}, nil
+}
+
+// APIKeyAuthenticator authenticates requests with an API key in the X-API-Key header or as
+// an Authorization bearer token
+type APIKeyAuthenticator struct{}
+
+func (APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		token, ok := bearerToken(r)
+		if !ok || !strings.HasPrefix(token, apiKeyPrefix) {
+			return nil, ErrNoCredentials
+		}
+		apiKey = token
+	}
+	return Credentials.VerifyKey(apiKey)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
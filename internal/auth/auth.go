@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// Principal is the authenticated identity a request is served on behalf of
+type Principal struct {
+	Name   string   `json:"name"`
+	Groups []string `json:"groups,omitempty"`
+	// Authentication method that established the principal
+	Method string `json:"method"`
+}
+
+var Anonymous = &Principal{Name: "anonymous", Method: "none"}
+
+// ErrNoCredentials is returned by an Authenticator when the request carries no credentials
+// it handles, so the next authenticator can be tried
+var ErrNoCredentials = errors.New("no credentials")
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Authenticators tried in order on every request
+var authenticators []Authenticator
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal of the request, Anonymous if not authenticated
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	if !ok || principal == nil {
+		return Anonymous
+	}
+	return principal
+}
+
+// Init checks the policies, sets up the presigned URL key, loads the credentials and sets up
+// the authenticators according to the configuration
+func init() {
+	// Reloaded policies and console admins are checked as they are at startup
+	config.RegisterValidator(func(cfg *config.AppConfigRecord) error {
+		err := ValidatePolicies(cfg.Auth.Policies)
+		if err != nil {
+			return err
+		}
+		return ValidateAdmins(cfg.Console)
+	})
+}
+
+func Init() error {
+	authenticators = nil
+	err := ValidatePolicies(config.AppConfig.Auth.Policies)
+	if err != nil {
+		return err
+	}
+	err = initPresign()
+	if err != nil {
+		return err
+	}
+	err = ValidateAdmins(config.AppConfig.Console)
+	if err != nil {
+		return err
+	}
+	if !config.AppConfig.Auth.Enabled {
+		return nil
+	}
+
+	err = LoadCredentials(config.AppConfig.Auth.CredentialsFile)
+	if err != nil {
+		return fmt.Errorf("loading credentials: %w", err)
+	}
+	if config.AppConfig.ServerTLS.Enabled && config.AppConfig.ServerTLS.ClientCAFile != "" {
+		authenticators = append(authenticators, ClientCertAuthenticator{})
+	}
+	authenticators = append(authenticators, APIKeyAuthenticator{})
+	if config.AppConfig.Auth.SigV4.Enabled {
+		authenticators = append(authenticators, SigV4Authenticator{})
+	}
+	if config.AppConfig.Auth.JWT.Enabled {
+		jwtAuthenticator, err := NewJWTAuthenticator(config.AppConfig.Auth.JWT)
+		if err != nil {
+			return fmt.Errorf("setting up JWT authentication: %w", err)
+		}
+		authenticators = append(authenticators, jwtAuthenticator)
+	}
+	return nil
+}
+
+// Authenticate returns the principal of the request from the first authenticator handling it
+func Authenticate(r *http.Request) (*Principal, error) {
+	for _, authenticator := range authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// Middleware authenticates every request and makes the principal available in its context
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.AppConfig.Auth.Enabled {
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), Anonymous)))
+			return
+		}
+
+		principal, err := Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) && config.AppConfig.Auth.AllowAnonymous {
+			principal, err = Anonymous, nil
+		}
+		if err != nil {
+			config.LogFromContext(r.Context()).Info("Authentication failed", "method", r.Method, "path", r.URL.Path,
+				"remote_addr", r.RemoteAddr, "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hss"`)
+			http.Error(w, fmt.Sprintf("Unauthorized: %v", err), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// Redacted replaces the values of the credentials so requests can be logged
+const Redacted = "<redacted>"
+
+// credentialHeaders carry secrets, keyed by canonical name
+var credentialHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Api-Key":           true,
+}
+
+// credentialParams carry the signatures of presigned URLs
+var credentialParams = map[string]bool{PresignSignatureParam: true, "X-Amz-Signature": true}
+
+// RedactedHeaders returns a copy of header with the credentials replaced
+func RedactedHeaders(header http.Header) http.Header {
+	result := header.Clone()
+	for key := range result {
+		if credentialHeaders[http.CanonicalHeaderKey(key)] {
+			result[key] = []string{Redacted}
+		}
+	}
+	return result
+}
+
+// RedactedQuery returns a copy of query with the signatures replaced
+func RedactedQuery(query url.Values) url.Values {
+	result := url.Values{}
+	for key, values := range query {
+		if credentialParams[key] {
+			values = []string{Redacted}
+		}
+		result[key] = values
+	}
+	return result
+}
+
+// RedactedURI returns the request URI uri with the signatures in its query replaced, keeping
+// the rest as sent
+func RedactedURI(uri string) string {
+	uriPath, rawQuery, found := strings.Cut(uri, "?")
+	if !found {
+		return uri
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(key); err == nil && credentialParams[name] {
+			params[i] = key + "=" + Redacted
+		}
+	}
+	return uriPath + "?" + strings.Join(params, "&")
+}
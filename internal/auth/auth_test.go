@@ -0,0 +1,451 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// serve runs a request through the middleware and returns the status and principal seen
+func serve(r *http.Request) (int, *Principal) {
+	var principal *Principal
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = PrincipalFromContext(r.Context())
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	return recorder.Code, principal
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	key, apiKey, err := Credentials.CreateKey("alice", []string{"dev"}, 0)
+	if err != nil {
+		t.Fatal("Error creating key ", err)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/foo?type=file", nil)
+	request.Header.Set("Authorization", "Bearer "+apiKey)
+	status, principal := serve(request)
+	if status != http.StatusOK || principal.Name != "alice" || principal.Groups[0] != "dev" {
+		t.Errorf("Bearer key rejected: %v %+v", status, principal)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/foo?type=file", nil)
+	request.Header.Set("X-API-Key", apiKey)
+	if status, _ := serve(request); status != http.StatusOK {
+		t.Errorf("X-API-Key rejected: %v", status)
+	}
+
+	// The hash is persisted, never the key
+	data, _ := os.ReadFile(config.AppConfig.Auth.CredentialsFile)
+	if len(data) == 0 || bytes.Contains(data, []byte(apiKey[len(apiKeyPrefix)+len(key.ID)+1:])) {
+		t.Error("Credentials file missing or holding the secret")
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/foo?type=file", nil)
+	request.Header.Set("X-API-Key", apiKey+"0")
+	if status, _ := serve(request); status != http.StatusUnauthorized {
+		t.Errorf("Wrong key accepted: %v", status)
+	}
+
+	Credentials.RevokeKey(key.ID)
+	request = httptest.NewRequest(http.MethodGet, "/foo?type=file", nil)
+	request.Header.Set("X-API-Key", apiKey)
+	if status, _ := serve(request); status != http.StatusUnauthorized {
+		t.Errorf("Revoked key accepted: %v", status)
+	}
+}
+
+func TestExpiredAPIKey(t *testing.T) {
+	key, apiKey, _ := Credentials.CreateKey("bob", nil, time.Nanosecond)
+	defer Credentials.RevokeKey(key.ID)
+	time.Sleep(time.Millisecond)
+
+	_, err := Credentials.VerifyKey(apiKey)
+	if err != ErrExpiredAPIKey {
+		t.Errorf("Expected expired key error, got %v", err)
+	}
+}
+
+func TestAnonymousRequests(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/foo?type=file", nil)
+	if status, _ := serve(request); status != http.StatusUnauthorized {
+		t.Errorf("Anonymous request accepted: %v", status)
+	}
+
+	config.AppConfig.Auth.AllowAnonymous = true
+	defer func() { config.AppConfig.Auth.AllowAnonymous = false }()
+	status, principal := serve(request)
+	if status != http.StatusOK || principal != Anonymous {
+		t.Errorf("Anonymous request rejected: %v %+v", status, principal)
+	}
+}
+
+func TestSigV4Authentication(t *testing.T) {
+	config.AppConfig.Auth.SigV4 = config.SigV4Config{Enabled: true, Region: "us-east-1"}
+	defer func() { config.AppConfig.Auth.SigV4 = config.SigV4Config{} }()
+	Init()
+	defer Init()
+	Credentials.accessKeys["AKIDTEST"] = AccessKey{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret", Principal: "s3-client"}
+
+	signer := v4.NewSigner(credentials.NewStaticCredentials("AKIDTEST", "secret", ""), func(signer *v4.Signer) {
+		signer.DisableURIPathEscaping = true
+	})
+	body := []byte("hello")
+	request := httptest.NewRequest(http.MethodPost, "http://hss.local/dir/some%20file?type=file&part=0", bytes.NewReader(body))
+	request.Header.Set("X-Amz-Meta-Note", "two  spaces")
+	_, err := signer.Sign(request, bytes.NewReader(body), "s3", "us-east-1", time.Now())
+	if err != nil {
+		t.Fatal("Error signing request ", err)
+	}
+	status, principal := serve(request)
+	if status != http.StatusOK || principal.Name != "s3-client" || principal.Method != "sigv4" {
+		t.Errorf("Signed request rejected: %v %+v", status, principal)
+	}
+	// Headers are normalized to be signed, not in the request
+	if note := request.Header.Get("X-Amz-Meta-Note"); note != "two  spaces" {
+		t.Errorf("Signed header changed: %q", note)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "http://hss.local/dir/file?type=file", nil)
+	_, err = signer.Presign(request, nil, "s3", "us-east-1", time.Hour, time.Now())
+	if err != nil {
+		t.Fatal("Error presigning request ", err)
+	}
+	presigned := httptest.NewRequest(http.MethodGet, request.URL.String(), nil)
+	if status, _ := serve(presigned); status != http.StatusOK {
+		t.Errorf("Presigned request rejected: %v", status)
+	}
+
+	tampered := httptest.NewRequest(http.MethodGet, strings.Replace(request.URL.String(), "dir/file", "dir/other", 1), nil)
+	if status, _ := serve(tampered); status != http.StatusUnauthorized {
+		t.Errorf("Tampered request accepted: %v", status)
+	}
+
+	_, err = signer.Presign(request, nil, "s3", "eu-west-1", time.Hour, time.Now())
+	if err != nil {
+		t.Fatal("Error presigning request ", err)
+	}
+	if status, _ := serve(httptest.NewRequest(http.MethodGet, request.URL.String(), nil)); status != http.StatusUnauthorized {
+		t.Errorf("Request for another region accepted: %v", status)
+	}
+}
+
+func TestSigV4PayloadMismatch(t *testing.T) {
+	Credentials.accessKeys["AKIDTEST"] = AccessKey{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret", Principal: "s3-client"}
+	defer delete(Credentials.accessKeys, "AKIDTEST")
+
+	signer := v4.NewSigner(credentials.NewStaticCredentials("AKIDTEST", "secret", ""), func(signer *v4.Signer) {
+		signer.DisableURIPathEscaping = true
+	})
+	request := httptest.NewRequest(http.MethodPost, "http://hss.local/file?type=file", strings.NewReader("hello"))
+	_, err := signer.Sign(request, strings.NewReader("hello"), "s3", "us-east-1", time.Now())
+	if err != nil {
+		t.Fatal("Error signing request ", err)
+	}
+	request.Body = io.NopCloser(strings.NewReader("world"))
+
+	_, err = SigV4Authenticator{}.Authenticate(request)
+	if err != nil {
+		t.Fatal("Signed request rejected ", err)
+	}
+	_, err = io.ReadAll(request.Body)
+	if err != ErrPayloadMismatch {
+		t.Errorf("Expected payload mismatch, got %v", err)
+	}
+}
+
+// signJWT builds a token signed with key, RSA or EC
+func signJWT(t *testing.T, key crypto.Signer, alg string, kid string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal("Error signing token ", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encode := func(value *big.Int) string { return base64.RawURLEncoding.EncodeToString(value.Bytes()) }
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+	}})
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(jwksFile, jwks, 0644)
+
+	config.AppConfig.Auth.JWT = config.JWTConfig{Enabled: true, Issuer: "https://idp", Audience: "hss", JWKSFile: jwksFile}
+	defer func() { config.AppConfig.Auth.JWT = config.JWTConfig{} }()
+	err := Init()
+	if err != nil {
+		t.Fatal("Error setting up JWT authentication ", err)
+	}
+	defer Init()
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		claims := map[string]any{"iss": "https://idp", "aud": []string{"other", "hss"}, "sub": "carol", "groups": []string{"ops"}, "exp": now + 60}
+		for name, value := range changes {
+			claims[name] = value
+		}
+		return claims
+	}
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"RS256", signJWT(t, rsaKey, "RS256", "rsa", claims(nil)), http.StatusOK},
+		{"ES256", signJWT(t, ecKey, "ES256", "ec", claims(nil)), http.StatusOK},
+		{"expired", signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]any{"exp": now - 3600})), http.StatusUnauthorized},
+		{"issuer", signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]any{"iss": "https://evil"})), http.StatusUnauthorized},
+		{"audience", signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]any{"aud": "other"})), http.StatusUnauthorized},
+		{"unknown key", signJWT(t, rsaKey, "RS256", "missing", claims(nil)), http.StatusUnauthorized},
+		{"wrong key", signJWT(t, rsaKey, "RS256", "ec", claims(nil)), http.StatusUnauthorized},
+		{"none", "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"carol"}`)) + ".", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/foo?type=file", nil)
+		request.Header.Set("Authorization", "Bearer "+test.token)
+		status, principal := serve(request)
+		if status != test.status {
+			t.Errorf("%v: expected status %v, got %v", test.name, test.status, status)
+		}
+		if status == http.StatusOK && (principal.Name != "carol" || principal.Groups[0] != "ops" || principal.Method != "jwt") {
+			t.Errorf("%v: wrong principal %+v", test.name, principal)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	config.AppConfig.Auth.Policies = []config.PolicyConfig{
+		{Name: "dev-data", Effect: "allow", Groups: []string{"dev"}, Actions: []string{"read", "list", "write"}, Prefixes: []string{"/data"}},
+		{Name: "dev-secrets", Effect: "deny", Groups: []string{"dev"}, Actions: []string{"read"}, Prefixes: []string{"data/secrets"}},
+		{Name: "root", Effect: "allow", Principals: []string{"root"}, Actions: []string{"admin"}, Prefixes: []string{"/"}},
+		{Name: "frozen", Effect: "deny", Principals: []string{"*"}, Actions: []string{"delete"}, Prefixes: []string{"/data/frozen"}},
+	}
+	defer func() { config.AppConfig.Auth.Policies = nil }()
+	if err := ValidatePolicies(config.AppConfig.Auth.Policies); err != nil {
+		t.Fatal("Valid policies rejected ", err)
+	}
+
+	dev := &Principal{Name: "alice", Groups: []string{"dev"}}
+	root := &Principal{Name: "root"}
+	tests := []struct {
+		principal *Principal
+		action    Action
+		path      string
+		allowed   bool
+		policy    string
+	}{
+		{dev, ActionRead, "data/file", true, "dev-data"},
+		{dev, ActionWrite, "/data", true, "dev-data"},
+		{dev, ActionRead, "data/secrets/key", false, "dev-secrets"},
+		{dev, ActionList, "data/secrets", true, "dev-data"},
+		{dev, ActionDelete, "data/file", false, ""},
+		{dev, ActionRead, "database", false, ""},
+		{dev, ActionRead, "data/../etc", false, ""},
+		{root, ActionDelete, "anything", true, "root"},
+		{root, ActionDelete, "data/frozen/file", false, "frozen"},
+		{Anonymous, ActionRead, "data", false, ""},
+	}
+	for _, test := range tests {
+		decision := Authorize(test.principal, test.action, test.path)
+		if decision.Allowed != test.allowed || decision.Policy != test.policy {
+			t.Errorf("%v %v %v: unexpected decision %+v", test.principal.Name, test.action, test.path, decision)
+		}
+	}
+
+	if Authorize(dev, ActionRead, "data").Allowed != true || AuthorizeTree(dev, ActionRead, "data").Allowed {
+		t.Error("Reading the whole data tree should be denied by dev-secrets")
+	}
+	if !AuthorizeTree(root, ActionDelete, "other").Allowed || AuthorizeTree(root, ActionDelete, "/").Allowed {
+		t.Error("Deleting the root tree should be denied by frozen")
+	}
+
+	invalid := []config.PolicyConfig{{Effect: "allow", Principals: []string{"*"}, Actions: []string{"execute"}, Prefixes: []string{"/"}}}
+	if ValidatePolicies(invalid) == nil {
+		t.Error("Unknown action accepted")
+	}
+}
+
+func TestPresignedURLs(t *testing.T) {
+	grant := PresignedGrant{
+		Method:    http.MethodPut,
+		Path:      "dir/file",
+		Expires:   time.Now().Add(time.Minute),
+		Principal: &Principal{Name: "alice", Groups: []string{"dev"}},
+		MaxSize:   10,
+	}
+	target := "/dir/file?" + grant.Query().Encode()
+
+	verified, err := VerifyPresigned(httptest.NewRequest(http.MethodPut, target, nil), "dir/file")
+	if err != nil || verified.Principal.Name != "alice" || verified.Principal.Groups[0] != "dev" || verified.MaxSize != 10 {
+		t.Errorf("Presigned request rejected: %+v %v", verified, err)
+	}
+	_, err = VerifyPresigned(httptest.NewRequest(http.MethodPut, target, nil), "dir/file")
+	if err != ErrPresignUsed {
+		t.Errorf("Presigned upload URL used twice: %v", err)
+	}
+
+	tampered := []struct {
+		method string
+		target string
+		path   string
+	}{
+		{http.MethodGet, target, "dir/file"},
+		{http.MethodPut, target, "dir/other"},
+		{http.MethodPut, strings.Replace(target, "presign-max-size=10", "presign-max-size=1000", 1), "dir/file"},
+		{http.MethodPut, strings.Replace(target, "presign-principal=alice", "presign-principal=root", 1), "dir/file"},
+	}
+	for _, test := range tampered {
+		_, err := VerifyPresigned(httptest.NewRequest(test.method, test.target, nil), test.path)
+		if err != ErrPresignSignature {
+			t.Errorf("Tampered request %v %v %v accepted: %v", test.method, test.target, test.path, err)
+		}
+	}
+
+	grant.Expires = time.Now().Add(-time.Second)
+	_, err = VerifyPresigned(httptest.NewRequest(http.MethodPut, "/dir/file?"+grant.Query().Encode(), nil), "dir/file")
+	if err != ErrPresignExpired {
+		t.Errorf("Expected expired URL error, got %v", err)
+	}
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	token, hash, err := NewAdminToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AppConfig.Console = config.ConsoleConfig{AuthEnabled: true, Admins: []config.AdminConfig{{Name: "root", TokenHash: hash}}}
+	defer func() { config.AppConfig.Console = config.ConsoleConfig{} }()
+	if err := ValidateAdmins(config.AppConfig.Console); err != nil {
+		t.Error("Valid admins rejected ", err)
+	}
+	if err := ValidateAdmins(config.ConsoleConfig{AuthEnabled: true}); err == nil {
+		t.Error("Console authentication enabled without admins")
+	}
+
+	var principal *Principal
+	handler := AdminMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = PrincipalFromContext(r.Context())
+	}))
+	serveConsole := func(path string, setCredentials func(r *http.Request)) int {
+		principal = nil
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		setCredentials(r)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		return recorder.Code
+	}
+
+	if status := serveConsole("/config", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }); status != http.StatusOK || principal.Name != "root" {
+		t.Error("Admin token rejected ", status)
+	}
+	if status := serveConsole("/config", func(r *http.Request) { r.SetBasicAuth("root", token) }); status != http.StatusOK {
+		t.Error("Admin basic authentication rejected ", status)
+	}
+	if status := serveConsole("/config", func(r *http.Request) { r.SetBasicAuth("other", token) }); status != http.StatusUnauthorized {
+		t.Error("Admin token accepted for another name ", status)
+	}
+	if status := serveConsole("/config", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token+"x") }); status != http.StatusUnauthorized {
+		t.Error("Invalid admin token accepted ", status)
+	}
+	if status := serveConsole("/jobs", func(r *http.Request) {}); status != http.StatusUnauthorized {
+		t.Error("Console served without credentials ", status)
+	}
+	if status := serveConsole("/readyz", func(r *http.Request) {}); status != http.StatusOK {
+		t.Error("Probe required credentials ", status)
+	}
+
+	// Without console authentication the admin API is only served to the local host
+	config.AppConfig.Console = config.ConsoleConfig{}
+	if status := serveConsole("/auth/keys", func(r *http.Request) {}); status != http.StatusForbidden {
+		t.Error("Console served to a remote host without credentials ", status)
+	}
+	if status := serveConsole("/auth/keys", func(r *http.Request) { r.RemoteAddr = "[::1]:2000" }); status != http.StatusOK {
+		t.Error("Console not served to the local host ", status)
+	}
+	if status := serveConsole("/metrics", func(r *http.Request) {}); status != http.StatusOK {
+		t.Error("Metrics not served to a remote host ", status)
+	}
+}
+
+func TestRedactedCredentials(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/foo?type=file&"+PresignSignatureParam+"=abc&X-Amz-Signature=def", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	request.Header.Set("X-API-Key", "secret")
+	request.Header.Set("Cookie", "session=secret")
+	request.Header.Set("User-Agent", "test")
+
+	headers := RedactedHeaders(request.Header)
+	for _, name := range []string{"Authorization", "X-API-Key", "Cookie"} {
+		if headers.Get(name) != Redacted {
+			t.Errorf("Header %v not redacted: %v", name, headers.Get(name))
+		}
+	}
+	if headers.Get("User-Agent") != "test" || request.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("Wrong headers redacted %v %v", headers, request.Header)
+	}
+
+	query := RedactedQuery(request.URL.Query())
+	if query.Get(PresignSignatureParam) != Redacted || query.Get("X-Amz-Signature") != Redacted || query.Get("type") != "file" {
+		t.Errorf("Wrong query redacted %v", query)
+	}
+	if uri := RedactedURI(request.RequestURI); uri != "/foo?type=file&"+PresignSignatureParam+"=<redacted>&X-Amz-Signature=<redacted>" {
+		t.Errorf("Wrong URI redacted %v", uri)
+	}
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "hss-auth-test-")
+	if err != nil {
+		panic(err)
+	}
+	config.AppConfig.Logging.LogFile = filepath.Join(dir, "test.log")
+	config.InitLogger()
+	config.AppConfig.Auth = config.AuthConfig{Enabled: true, CredentialsFile: filepath.Join(dir, "credentials.json")}
+	err = Init()
+	if err != nil {
+		panic(err)
+	}
+
+	exitCode := m.Run()
+	os.RemoveAll(dir)
+
+	os.Exit(exitCode)
+}
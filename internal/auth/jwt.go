@@ -0,0 +1,401 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// Bearer JWT validation against the keys of a JWKS, as published by OIDC identity providers.
+// Only asymmetric signatures are accepted: RS256/384/512 and ES256/384/512.
+
+const (
+	jwtLeeway = time.Minute
+	// Minimum time between two JWKS fetches triggered by an unknown key id
+	jwksRefreshInterval = time.Minute
+	jwksMaxAge          = time.Hour
+	jwksMaxSize         = 1 << 20
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("expired token")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+type jwtAlgorithm struct {
+	hash crypto.Hash
+	// EC curve of ES algorithms, nil for RS ones
+	curve elliptic.Curve
+}
+
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"ES256": {hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {hash: crypto.SHA512, curve: elliptic.P521()},
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// publicKey is a verification key of the key set, with the algorithm it's restricted to if any
+type publicKey struct {
+	key crypto.PublicKey
+	alg string
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < 2048 || !e.IsInt64() {
+			return nil, errors.New("unsupported RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// parseJWKS returns the signature keys of a JWKS document by key id. Keys that can't be used
+// are skipped rather than failing the whole set.
+func parseJWKS(data []byte) (map[string]publicKey, error) {
+	var keySet jsonWebKeySet
+	err := json.Unmarshal(data, &keySet)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]publicKey{}
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			config.Log.Warn("Skipping JWKS key", "kid", jwk.Kid, "error", err)
+			continue
+		}
+		keys[jwk.Kid] = publicKey{key: key, alg: jwk.Alg}
+	}
+	return keys, nil
+}
+
+// keySet caches the JWKS. A key set from a URL is fetched again when it gets old or when a
+// token refers to an unknown key, at most once per jwksRefreshInterval.
+type keySet struct {
+	mutex     sync.Mutex
+	file      string
+	url       string
+	keys      map[string]publicKey
+	fetched   time.Time
+	attempted time.Time
+}
+
+func (set *keySet) load() error {
+	var data []byte
+	var err error
+	if set.file != "" {
+		data, err = os.ReadFile(set.file)
+	} else {
+		data, err = fetchJWKS(set.url)
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("parsing JWKS: %w", err)
+	}
+	set.keys = keys
+	set.fetched = time.Now()
+	return nil
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v: %v", url, response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, jwksMaxSize))
+}
+
+func (set *keySet) key(kid string) (publicKey, error) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	key, ok := set.keys[kid]
+	stale := set.url != "" && time.Since(set.fetched) > jwksMaxAge
+	if (!ok || stale) && set.url != "" && time.Since(set.attempted) > jwksRefreshInterval {
+		set.attempted = time.Now()
+		err := set.load()
+		if err != nil {
+			config.Log.Error("Error refreshing JWKS", "url", set.url, "error", err)
+		}
+		key, ok = set.keys[kid]
+	}
+	if !ok {
+		return publicKey{}, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// JWTAuthenticator authenticates requests with a bearer JWT
+type JWTAuthenticator struct {
+	config config.JWTConfig
+	keys   *keySet
+}
+
+func NewJWTAuthenticator(jwtConfig config.JWTConfig) (*JWTAuthenticator, error) {
+	if (jwtConfig.JWKSFile == "") == (jwtConfig.JWKSURL == "") {
+		return nil, errors.New("exactly one of jwks_file and jwks_url must be set")
+	}
+	if jwtConfig.PrincipalClaim == "" {
+		jwtConfig.PrincipalClaim = "sub"
+	}
+	if jwtConfig.GroupsClaim == "" {
+		jwtConfig.GroupsClaim = "groups"
+	}
+
+	keys := &keySet{file: jwtConfig.JWKSFile, url: jwtConfig.JWKSURL}
+	keys.attempted = time.Now()
+	err := keys.load()
+	if err != nil {
+		// An identity provider that's down at startup shouldn't keep the server from starting
+		if keys.url == "" {
+			return nil, err
+		}
+		config.Log.Error("Error fetching JWKS", "url", keys.url, "error", err)
+	}
+	return &JWTAuthenticator{config: jwtConfig, keys: keys}, nil
+}
+
+func (authenticator *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	claims, err := authenticator.verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return authenticator.principal(claims)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+func decodeSegment(segment string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// verify checks the signature and the registered claims of token and returns its claims
+func (authenticator *JWTAuthenticator) verify(token string, now time.Time) (map[string]any, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header jwtHeader
+	if decodeSegment(segments[0], &header) != nil {
+		return nil, ErrInvalidToken
+	}
+	algorithm, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	key, err := authenticator.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, fmt.Errorf("%w: algorithm %q not allowed for key %q", ErrInvalidToken, header.Alg, header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	hasher := algorithm.hash.New()
+	hasher.Write([]byte(segments[0] + "." + segments[1]))
+	if !verifySignature(algorithm, key.key, hasher.Sum(nil), signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims map[string]any
+	if decodeSegment(segments[1], &claims) != nil {
+		return nil, ErrInvalidToken
+	}
+	return claims, authenticator.checkClaims(claims, now)
+}
+
+func verifySignature(algorithm jwtAlgorithm, key crypto.PublicKey, digest []byte, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return algorithm.curve == nil && rsa.VerifyPKCS1v15(key, algorithm.hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS ECDSA signatures are r || s, each padded to the curve size
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if algorithm.curve != key.Curve || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+func numericDate(claims map[string]any, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("%w: malformed %v claim", ErrInvalidToken, name)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: malformed %v claim", ErrInvalidToken, name)
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+func (authenticator *JWTAuthenticator) checkClaims(claims map[string]any, now time.Time) error {
+	expires, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	}
+	if now.After(expires.Add(jwtLeeway)) {
+		return ErrExpiredToken
+	}
+	notBefore, ok, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Before(notBefore.Add(-jwtLeeway)) {
+		return fmt.Errorf("%w: token not valid yet", ErrInvalidToken)
+	}
+
+	if issuer := authenticator.config.Issuer; issuer != "" && claims["iss"] != issuer {
+		return fmt.Errorf("%w: invalid issuer %v", ErrInvalidToken, claims["iss"])
+	}
+	if audience := authenticator.config.Audience; audience != "" && !contains(stringList(claims["aud"]), audience) {
+		return fmt.Errorf("%w: invalid audience %v", ErrInvalidToken, claims["aud"])
+	}
+	return nil
+}
+
+// stringList reads a claim holding either a string or an array of strings
+func stringList(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (authenticator *JWTAuthenticator) principal(claims map[string]any) (*Principal, error) {
+	name, _ := claims[authenticator.config.PrincipalClaim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("%w: missing %v claim", ErrInvalidToken, authenticator.config.PrincipalClaim)
+	}
+	return &Principal{Name: name, Groups: stringList(claims[authenticator.config.GroupsClaim]), Method: "jwt"}, nil
+}
@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"net/http"
+)
+
+// ClientCertAuthenticator authenticates requests with the client certificate verified by the
+// TLS listener. The certificate subject common name is the principal name, its organizational
+// units the groups.
+type ClientCertAuthenticator struct{}
+
+func (ClientCertAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	name := subject.CommonName
+	if name == "" {
+		name = subject.String()
+	}
+	return &Principal{Name: name, Groups: subject.OrganizationalUnit, Method: "mtls"}, nil
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// Action is an operation a policy grants or denies on a path prefix
+type Action string
+
+const (
+	ActionRead   Action = "read"
+	ActionWrite  Action = "write"
+	ActionDelete Action = "delete"
+	ActionList   Action = "list"
+	// Admin grants (or denies) every action
+	ActionAdmin Action = "admin"
+)
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+var actions = map[Action]bool{ActionRead: true, ActionWrite: true, ActionDelete: true, ActionList: true, ActionAdmin: true}
+
+func IsAction(action Action) bool {
+	return actions[action]
+}
+
+// Decision is the outcome of evaluating the policies for a request
+type Decision struct {
+	Allowed   bool   `json:"allowed"`
+	Principal string `json:"principal"`
+	Action    Action `json:"action"`
+	Path      string `json:"path"`
+	// Policy that decided, empty when no policy is defined or none matched
+	Policy string `json:"policy,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ValidatePolicies checks the policies of the configuration
+func ValidatePolicies(policies []config.PolicyConfig) error {
+	for i, policy := range policies {
+		name := policyName(policy, i)
+		if policy.Effect != EffectAllow && policy.Effect != EffectDeny {
+			return fmt.Errorf("policy %v: effect must be %q or %q", name, EffectAllow, EffectDeny)
+		}
+		if len(policy.Principals) == 0 && len(policy.Groups) == 0 {
+			return fmt.Errorf("policy %v: no principals or groups", name)
+		}
+		if len(policy.Actions) == 0 || len(policy.Prefixes) == 0 {
+			return fmt.Errorf("policy %v: no actions or prefixes", name)
+		}
+		for _, action := range policy.Actions {
+			if !IsAction(Action(action)) {
+				return fmt.Errorf("policy %v: unknown action %q", name, action)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizePolicyPath returns p as an absolute clean path, the form prefixes are matched on
+func normalizePolicyPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// underPrefix tells whether p is prefix or within it, path components are matched whole
+func underPrefix(p string, prefix string) bool {
+	prefix = normalizePolicyPath(prefix)
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func policyName(policy config.PolicyConfig, index int) string {
+	if policy.Name != "" {
+		return policy.Name
+	}
+	return fmt.Sprintf("#%v", index)
+}
+
+func appliesTo(policy config.PolicyConfig, principal *Principal) bool {
+	for _, name := range policy.Principals {
+		if name == "*" || name == principal.Name {
+			return true
+		}
+	}
+	for _, group := range policy.Groups {
+		if contains(principal.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func coversAction(policy config.PolicyConfig, action Action) bool {
+	for _, a := range policy.Actions {
+		if Action(a) == action || Action(a) == ActionAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize evaluates the configured policies for principal doing action on p. Without any
+// policy everything is allowed. Otherwise an action must be allowed by a policy and not
+// denied by any.
+func Authorize(principal *Principal, action Action, p string) Decision {
+	p = normalizePolicyPath(p)
+	decision := Decision{Principal: principal.Name, Action: action, Path: p}
+	policies := config.Current().Auth.Policies
+	if len(policies) == 0 {
+		decision.Allowed = true
+		decision.Reason = "no policies defined"
+		return decision
+	}
+
+	allowedBy := -1
+	for i, policy := range policies {
+		if !appliesTo(policy, principal) || !coversAction(policy, action) {
+			continue
+		}
+		for _, prefix := range policy.Prefixes {
+			if !underPrefix(p, prefix) {
+				continue
+			}
+			if policy.Effect == EffectDeny {
+				decision.Policy = policyName(policy, i)
+				decision.Reason = fmt.Sprintf("denied on %v", normalizePolicyPath(prefix))
+				return decision
+			}
+			if allowedBy < 0 {
+				allowedBy = i
+			}
+		}
+	}
+
+	if allowedBy < 0 {
+		decision.Reason = "no policy allows it"
+		return decision
+	}
+	decision.Allowed = true
+	decision.Policy = policyName(policies[allowedBy], allowedBy)
+	decision.Reason = "allowed"
+	return decision
+}
+
+// AuthorizeTree is Authorize for operations on the whole tree under p, such as recursive
+// deletes and archives: it's also denied when a deny policy covers a path below p.
+func AuthorizeTree(principal *Principal, action Action, p string) Decision {
+	decision := Authorize(principal, action, p)
+	if !decision.Allowed {
+		return decision
+	}
+	for i, policy := range config.Current().Auth.Policies {
+		if policy.Effect != EffectDeny || !appliesTo(policy, principal) || !coversAction(policy, action) {
+			continue
+		}
+		for _, prefix := range policy.Prefixes {
+			prefix = normalizePolicyPath(prefix)
+			if underPrefix(prefix, decision.Path) {
+				decision.Allowed = false
+				decision.Policy = policyName(policy, i)
+				decision.Reason = fmt.Sprintf("denied on %v", prefix)
+				return decision
+			}
+		}
+	}
+	return decision
+}
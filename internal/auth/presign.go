@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// Presigned URLs grant one request (a download with GET or an upload with PUT) on a file
+// to whoever holds the URL, on behalf of the principal that issued it, until it expires.
+// The grant is carried by query parameters signed with an HMAC of the server secret.
+// Download URLs can be used repeatedly until they expire, upload URLs only once. Uploads
+// never overwrite a file either, so replaying an upload URL after a restart (which forgets
+// the URLs used) only works if the file was deleted meanwhile.
+
+const (
+	PresignSignatureParam   = "presign-signature"
+	PresignExpiresParam     = "presign-expires"
+	PresignPrincipalParam   = "presign-principal"
+	PresignGroupsParam      = "presign-groups"
+	PresignMaxSizeParam     = "presign-max-size"
+	PresignContentTypeParam = "presign-content-type"
+
+	DefaultPresignExpiry    = 15 * time.Minute
+	defaultMaxPresignExpiry = 7 * 24 * time.Hour
+)
+
+var (
+	ErrPresignExpired   = errors.New("presigned URL expired")
+	ErrPresignSignature = errors.New("invalid presigned URL signature")
+	ErrPresignUsed      = errors.New("presigned upload URL already used")
+)
+
+// presignSecret is the HMAC key of presigned URLs, set up by Init
+var presignSecret []byte
+
+// usedUploads holds the signatures of the presigned upload URLs used, until they expire
+var usedUploads = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: map[string]time.Time{}}
+
+// PresignedGrant is what a presigned URL allows
+type PresignedGrant struct {
+	Method    string
+	Path      string
+	Expires   time.Time
+	Principal *Principal
+	// Maximum size of an upload, unlimited if zero
+	MaxSize int64
+	// Content type an upload must have, any if empty
+	ContentType string
+}
+
+func initPresign() error {
+	if config.AppConfig.Auth.Presign.Secret != "" {
+		presignSecret = []byte(config.AppConfig.Auth.Presign.Secret)
+		return nil
+	}
+	presignSecret = make([]byte, 32)
+	_, err := rand.Read(presignSecret)
+	return err
+}
+
+// MaxPresignExpiry is the longest validity a presigned URL can be issued for
+func MaxPresignExpiry() time.Duration {
+	if seconds := config.AppConfig.Auth.Presign.MaxExpirySeconds; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultMaxPresignExpiry
+}
+
+func (grant PresignedGrant) signature() string {
+	payload := strings.Join([]string{
+		grant.Method,
+		path.Clean("/" + grant.Path),
+		strconv.FormatInt(grant.Expires.Unix(), 10),
+		grant.Principal.Name,
+		strings.Join(grant.Principal.Groups, ","),
+		strconv.FormatInt(grant.MaxSize, 10),
+		grant.ContentType,
+	}, "\n")
+	mac := hmac.New(sha256.New, presignSecret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Query returns the query parameters of the presigned URL for grant
+func (grant PresignedGrant) Query() url.Values {
+	query := url.Values{}
+	query.Set("type", "file")
+	query.Set(PresignExpiresParam, strconv.FormatInt(grant.Expires.Unix(), 10))
+	query.Set(PresignPrincipalParam, grant.Principal.Name)
+	if len(grant.Principal.Groups) > 0 {
+		query.Set(PresignGroupsParam, strings.Join(grant.Principal.Groups, ","))
+	}
+	if grant.MaxSize > 0 {
+		query.Set(PresignMaxSizeParam, strconv.FormatInt(grant.MaxSize, 10))
+	}
+	if grant.ContentType != "" {
+		query.Set(PresignContentTypeParam, grant.ContentType)
+	}
+	query.Set(PresignSignatureParam, grant.signature())
+	return query
+}
+
+// IsPresigned tells whether r carries a presigned URL signature
+func IsPresigned(r *http.Request) bool {
+	return r.URL.Query().Has(PresignSignatureParam)
+}
+
+// VerifyPresigned checks the signature and expiry of the presigned request r for the file at
+// filePath, and returns what it's allowed to do. Upload URLs are spent once verified.
+func VerifyPresigned(r *http.Request, filePath string) (PresignedGrant, error) {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get(PresignExpiresParam), 10, 64)
+	if err != nil {
+		return PresignedGrant{}, fmt.Errorf("%w: malformed %v", ErrPresignSignature, PresignExpiresParam)
+	}
+	grant := PresignedGrant{
+		Method:      r.Method,
+		Path:        filePath,
+		Expires:     time.Unix(expires, 0),
+		Principal:   &Principal{Name: query.Get(PresignPrincipalParam), Method: "presigned"},
+		ContentType: query.Get(PresignContentTypeParam),
+	}
+	if groups := query.Get(PresignGroupsParam); groups != "" {
+		grant.Principal.Groups = strings.Split(groups, ",")
+	}
+	if maxSize := query.Get(PresignMaxSizeParam); maxSize != "" {
+		grant.MaxSize, err = strconv.ParseInt(maxSize, 10, 64)
+		if err != nil {
+			return PresignedGrant{}, fmt.Errorf("%w: malformed %v", ErrPresignSignature, PresignMaxSizeParam)
+		}
+	}
+
+	if !hmac.Equal([]byte(grant.signature()), []byte(query.Get(PresignSignatureParam))) {
+		return PresignedGrant{}, ErrPresignSignature
+	}
+	if time.Now().After(grant.Expires) {
+		return PresignedGrant{}, ErrPresignExpired
+	}
+	if grant.Method == http.MethodPut && !claimUpload(query.Get(PresignSignatureParam), grant.Expires) {
+		return PresignedGrant{}, ErrPresignUsed
+	}
+	return grant, nil
+}
+
+// claimUpload marks the upload URL with signature as used, it returns false if it already was
+func claimUpload(signature string, expires time.Time) bool {
+	usedUploads.Lock()
+	defer usedUploads.Unlock()
+	now := time.Now()
+	for used, usedExpires := range usedUploads.expires {
+		if now.After(usedExpires) {
+			delete(usedUploads.expires, used)
+		}
+	}
+	if _, used := usedUploads.expires[signature]; used {
+		return false
+	}
+	usedUploads.expires[signature] = expires
+	return true
+}
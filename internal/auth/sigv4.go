@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// AWS Signature Version 4 verification, for requests signed in the Authorization header or
+// presigned in the query string, as produced by the AWS SDKs and S3 tooling.
+// See https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv-create-signed-request.html
+
+const (
+	sigV4Algorithm     = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat    = "20060102T150405Z"
+	sigV4DateFormat    = "20060102"
+	sigV4MaxClockSkew  = 15 * time.Minute
+	sigV4MaxExpiration = 7 * 24 * time.Hour
+	unsignedPayload    = "UNSIGNED-PAYLOAD"
+	emptyPayloadHash   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	ErrSignatureMismatch = errors.New("request signature does not match")
+	ErrUnknownAccessKey  = errors.New("unknown access key")
+	ErrPayloadMismatch   = errors.New("payload does not match x-amz-content-sha256")
+)
+
+// AccessKey is an access key / secret key pair for SigV4 signed requests. Unlike API keys
+// the secret can't be stored hashed, as it's needed to compute the signature.
+type AccessKey struct {
+	AccessKeyID     string   `json:"access_key_id"`
+	SecretAccessKey string   `json:"secret_access_key"`
+	Principal       string   `json:"principal"`
+	Groups          []string `json:"groups,omitempty"`
+}
+
+func (store *CredentialStore) accessKey(id string) (AccessKey, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	key, ok := store.accessKeys[id]
+	return key, ok
+}
+
+// sigV4Request holds the signature elements of a request, from its headers or query string
+type sigV4Request struct {
+	accessKeyID   string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	signTime      time.Time
+	expires       time.Duration
+	presigned     bool
+	payloadHash   string
+}
+
+// SigV4Authenticator authenticates AWS Signature Version 4 signed requests
+type SigV4Authenticator struct{}
+
+func (SigV4Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	var request *sigV4Request
+	var err error
+	switch {
+	case strings.HasPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" "):
+		request, err = parseSigV4Header(r)
+	case r.URL.Query().Get("X-Amz-Algorithm") != "":
+		request, err = parseSigV4Query(r)
+	default:
+		return nil, ErrNoCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := Credentials.accessKey(request.accessKeyID)
+	if !ok {
+		return nil, ErrUnknownAccessKey
+	}
+	err = request.checkScope(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	expected := request.sign(r, key.SecretAccessKey)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(request.signature))) {
+		return nil, ErrSignatureMismatch
+	}
+
+	// The payload hash is signed, the payload itself is checked as it's read
+	if !request.presigned && request.payloadHash != unsignedPayload && r.Body != nil && r.Body != http.NoBody {
+		r.Body = &payloadVerifier{body: r.Body, hash: sha256.New(), expected: request.payloadHash}
+	}
+
+	return &Principal{Name: key.Principal, Groups: key.Groups, Method: "sigv4"}, nil
+}
+
+// parseCredential splits a credential of the form <key>/<date>/<region>/<service>/aws4_request
+func (request *sigV4Request) parseCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return fmt.Errorf("malformed credential %q", credential)
+	}
+	request.accessKeyID, request.date, request.region, request.service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+func parseSigV4Header(r *http.Request) (*sigV4Request, error) {
+	request := &sigV4Request{}
+	fields := strings.TrimPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" ")
+	for _, field := range strings.Split(fields, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch name {
+		case "Credential":
+			err := request.parseCredential(value)
+			if err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			request.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			request.signature = value
+		}
+	}
+	if request.accessKeyID == "" || len(request.signedHeaders) == 0 || request.signature == "" {
+		return nil, errors.New("malformed authorization header")
+	}
+
+	var err error
+	if amzDate := r.Header.Get("X-Amz-Date"); amzDate != "" {
+		request.signTime, err = time.Parse(sigV4TimeFormat, amzDate)
+	} else {
+		request.signTime, err = http.ParseTime(r.Header.Get("Date"))
+	}
+	if err != nil {
+		return nil, errors.New("missing or malformed request date")
+	}
+
+	request.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case request.payloadHash == "" && r.ContentLength == 0:
+		request.payloadHash = emptyPayloadHash
+	case request.payloadHash == "":
+		return nil, errors.New("x-amz-content-sha256 is required for requests with a payload")
+	case strings.HasPrefix(request.payloadHash, "STREAMING-"):
+		return nil, errors.New("streaming signed payloads are not supported")
+	}
+	return request, nil
+}
+
+func parseSigV4Query(r *http.Request) (*sigV4Request, error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, fmt.Errorf("unsupported algorithm %q", query.Get("X-Amz-Algorithm"))
+	}
+
+	request := &sigV4Request{presigned: true, payloadHash: unsignedPayload}
+	err := request.parseCredential(query.Get("X-Amz-Credential"))
+	if err != nil {
+		return nil, err
+	}
+	request.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	request.signature = query.Get("X-Amz-Signature")
+	if request.signature == "" {
+		return nil, errors.New("missing signature")
+	}
+	request.signTime, err = time.Parse(sigV4TimeFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errors.New("missing or malformed X-Amz-Date")
+	}
+	seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || seconds <= 0 {
+		return nil, errors.New("missing or malformed X-Amz-Expires")
+	}
+	request.expires = time.Duration(seconds) * time.Second
+	if hash := query.Get("X-Amz-Content-Sha256"); hash != "" {
+		request.payloadHash = hash
+	}
+	return request, nil
+}
+
+// checkScope validates the credential scope and the signing time against now
+func (request *sigV4Request) checkScope(now time.Time) error {
+	if request.date != request.signTime.UTC().Format(sigV4DateFormat) {
+		return errors.New("credential date doesn't match the request date")
+	}
+	sigV4Config := config.AppConfig.Auth.SigV4
+	if sigV4Config.Region != "" && request.region != sigV4Config.Region {
+		return fmt.Errorf("invalid region %q", request.region)
+	}
+	service := sigV4Config.Service
+	if service == "" {
+		service = "s3"
+	}
+	if request.service != service {
+		return fmt.Errorf("invalid service %q", request.service)
+	}
+
+	hasHost := false
+	for _, header := range request.signedHeaders {
+		hasHost = hasHost || header == "host"
+	}
+	if !hasHost {
+		return errors.New("the host header must be signed")
+	}
+
+	if request.presigned {
+		if request.expires > sigV4MaxExpiration {
+			return errors.New("presigned URL expiration is too long")
+		}
+		if now.Before(request.signTime.Add(-sigV4MaxClockSkew)) || now.After(request.signTime.Add(request.expires)) {
+			return errors.New("presigned URL expired")
+		}
+		return nil
+	}
+	if now.Sub(request.signTime).Abs() > sigV4MaxClockSkew {
+		return errors.New("request time too skewed")
+	}
+	return nil
+}
+
+// sign computes the expected signature of r with secret
+func (request *sigV4Request) sign(r *http.Request, secret string) string {
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		request.canonicalURI(r),
+		request.canonicalQuery(r),
+		request.canonicalHeaders(r),
+		strings.Join(request.signedHeaders, ";"),
+		request.payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{request.date, request.region, request.service, "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		request.signTime.UTC().Format(sigV4TimeFormat),
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), request.date)
+	key = hmacSHA256(key, request.region)
+	key = hmacSHA256(key, request.service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalURI returns the request path, encoded once more for services other than S3
+func (request *sigV4Request) canonicalURI(r *http.Request) string {
+	uri := r.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	if request.service == "s3" {
+		return uri
+	}
+	var builder strings.Builder
+	for i := 0; i < len(uri); i++ {
+		c := uri[i]
+		if c == '/' || isUnreserved(c) {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+	}
+	return builder.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+func (request *sigV4Request) canonicalQuery(r *http.Request) string {
+	query := r.URL.Query()
+	query.Del("X-Amz-Signature")
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func (request *sigV4Request) canonicalHeaders(r *http.Request) string {
+	var builder strings.Builder
+	for _, name := range request.signedHeaders {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = r.Header.Values("Content-Length")
+			if len(values) == 0 {
+				values = []string{strconv.FormatInt(r.ContentLength, 10)}
+			}
+		default:
+			values = r.Header.Values(name)
+		}
+		// Normalized in a copy, the values are those of the request
+		values = slices.Clone(values)
+		for i, value := range values {
+			values[i] = strings.Join(strings.Fields(value), " ")
+		}
+		builder.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return builder.String()
+}
+
+// payloadVerifier fails the read of a request body whose hash doesn't match the signed one
+type payloadVerifier struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (verifier *payloadVerifier) Read(p []byte) (int, error) {
+	n, err := verifier.body.Read(p)
+	verifier.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(verifier.hash.Sum(nil)) != strings.ToLower(verifier.expected) {
+		return n, ErrPayloadMismatch
+	}
+	return n, err
+}
+
+func (verifier *payloadVerifier) Close() error {
+	return verifier.body.Close()
+}
@@ -0,0 +1,218 @@
+package console
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/auth"
+	"github.com/rkachach/hss/internal/dataStore"
+	"github.com/rkachach/hss/internal/jobs"
+	"github.com/rkachach/hss/internal/uploads"
+)
+
+// UploadsHandler manages the uploads in progress on the server port:
+//
+//	GET /uploads          lists the uploads
+//	DELETE /uploads/<id>  aborts an upload, its partial file is deleted
+func UploadsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, uploads.List())
+
+	case r.Method == http.MethodDelete && id != "":
+		if !uploads.Abort(id) {
+			http.Error(w, fmt.Sprintf("No upload in progress with id %q", id), http.StatusNotFound)
+			return
+		}
+		config.Log.Info("Aborted upload", "upload_id", id, "admin", auth.PrincipalFromContext(r.Context()).Name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type usageResponse struct {
+	dataStore.DirectoryInfo
+	Directories []dataStore.DirectoryInfo `json:"directories"`
+}
+
+// UsageHandler returns the usage of a directory (GET /usage?path=/data, the root if no path)
+// and of each of its subdirectories
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dirPath := r.URL.Query().Get("path")
+	if dirPath == "" {
+		dirPath = "/"
+	}
+	store := dataStore.OsFileSystem{}.WithContext(r.Context())
+	info, err := store.GetDirectoryInfo(dirPath)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	elements, err := store.ListDirectory(dirPath)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	response := usageResponse{DirectoryInfo: info, Directories: []dataStore.DirectoryInfo{}}
+	for _, element := range elements {
+		if element.Type != "directory" {
+			continue
+		}
+		child, err := store.GetDirectoryInfo(path.Join(dirPath, element.Name))
+		if err != nil {
+			config.LogFromContext(r.Context()).Warn("Error reading directory usage", "path", path.Join(dirPath, element.Name), "error", err)
+			continue
+		}
+		response.Directories = append(response.Directories, child)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, dataStore.ErrDirectoryNotFound), errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, dataStore.ErrInvalidPath), errors.Is(err, dataStore.ErrReservedName), errors.Is(err, dataStore.ErrPathEscape):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+type startJobRequest struct {
+	Type string `json:"type"`
+}
+
+// JobsHandler manages the maintenance jobs:
+//
+//	GET /jobs          lists the jobs, latest first
+//	POST /jobs         starts a job, the body holds its type and parameters ({"type": "gc", "dry_run": true})
+//	GET /jobs/<id>     returns a job, with its result once finished
+//	DELETE /jobs/<id>  cancels a running job
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, jobs.List())
+
+	case r.Method == http.MethodPost && id == "":
+		var params json.RawMessage
+		var request startJobRequest
+		err := json.NewDecoder(r.Body).Decode(&params)
+		if err == nil {
+			err = json.Unmarshal(params, &request)
+		}
+		if err != nil || request.Type == "" {
+			http.Error(w, "A JSON body with the job type is required", http.StatusBadRequest)
+			return
+		}
+		job, err := jobs.Start(request.Type, params)
+		switch {
+		case errors.Is(err, jobs.ErrUnknownType):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, jobs.ErrAlreadyRunning):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			config.Log.Info("Started job", "job_id", job.ID, "type", job.Type, "admin", auth.PrincipalFromContext(r.Context()).Name)
+			writeJSON(w, http.StatusAccepted, job)
+		}
+
+	case r.Method == http.MethodGet && id != "":
+		job, ok := jobs.Get(id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("No job with id %q", id), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+
+	case r.Method == http.MethodDelete && id != "":
+		if !jobs.Cancel(id) {
+			http.Error(w, fmt.Sprintf("No running job with id %q", id), http.StatusNotFound)
+			return
+		}
+		config.Log.Info("Canceled job", "job_id", id, "admin", auth.PrincipalFromContext(r.Context()).Name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type gcParams struct {
+	DryRun bool `json:"dry_run"`
+	// Uploads not written to for this duration are abandoned, 24h if empty
+	OlderThan string `json:"older_than"`
+}
+
+const defaultGCGracePeriod = 24 * time.Hour
+
+// RegisterJobs makes the maintenance jobs of the store available
+func RegisterJobs() {
+	jobs.Register("gc", func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var params gcParams
+		if len(raw) > 0 {
+			err := json.Unmarshal(raw, &params)
+			if err != nil {
+				return nil, err
+			}
+		}
+		gracePeriod := defaultGCGracePeriod
+		if params.OlderThan != "" {
+			var err error
+			gracePeriod, err = time.ParseDuration(params.OlderThan)
+			if err != nil || gracePeriod < 0 {
+				return nil, fmt.Errorf("invalid older_than: %q", params.OlderThan)
+			}
+		}
+		return dataStore.OsFileSystem{}.GC(ctx, dataStore.GCOptions{DryRun: params.DryRun, GracePeriod: gracePeriod, UploadActive: uploadActive})
+	})
+	jobs.Register("scrub", func(ctx context.Context, raw json.RawMessage) (any, error) {
+		return dataStore.OsFileSystem{}.Scrub(ctx)
+	})
+	jobs.Register("fsck", func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var params fsckParams
+		if len(raw) > 0 {
+			err := json.Unmarshal(raw, &params)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return dataStore.OsFileSystem{}.Fsck(ctx, dataStore.FsckOptions{Repair: params.Repair, UploadActive: uploadActive})
+	})
+}
+
+type fsckParams struct {
+	// Rebuild the metadata and quarantine what can't be repaired
+	Repair bool `json:"repair"`
+}
+
+// uploadActive tells whether an upload is in progress on the server port for filePath
+func uploadActive(filePath string) bool {
+	sessions := uploads.List()
+	for i := range sessions {
+		if path.Clean("/"+sessions[i].Path) == filePath {
+			return true
+		}
+	}
+	return false
+}
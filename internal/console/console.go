@@ -3,8 +3,80 @@ package console
 import (
 	"fmt"
 	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/jobs"
+	"github.com/rkachach/hss/internal/uploads"
 )
 
+// Version of the server, set at build time:
+//
+//	go build -ldflags "-X github.com/rkachach/hss/internal/console.Version=1.2.0" ./cmd/app
+var Version = "dev"
+
+var started = time.Now().UTC()
+
+// ConsoleHandler returns the effective configuration of the server, secrets redacted
 func ConsoleHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "Welcome to the management console!")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	effective, err := config.Redacted(config.Current())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, effective)
+}
+
+// ReloadHandler reloads the configuration file (POST /config/reload) and returns the
+// settings applied and those needing a restart
+func ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := config.Reload()
+	if err != nil {
+		config.LogFromContext(r.Context()).Error("Error reloading configuration", "error", err)
+		http.Error(w, fmt.Sprintf("Configuration not reloaded: %v", err), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+type statusResponse struct {
+	Version       string    `json:"version"`
+	GoVersion     string    `json:"go_version"`
+	Started       time.Time `json:"started"`
+	Uptime        string    `json:"uptime"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	ActiveUploads int       `json:"active_uploads"`
+	RunningJobs   int       `json:"running_jobs"`
+}
+
+// StatusHandler returns the version and uptime of the server, and what it's busy with
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uptime := time.Since(started)
+	response := statusResponse{
+		Version:       Version,
+		GoVersion:     runtime.Version(),
+		Started:       started,
+		Uptime:        uptime.Truncate(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+		ActiveUploads: len(uploads.List()),
+	}
+	for _, job := range jobs.List() {
+		if job.State == jobs.StateRunning {
+			response.RunningJobs++
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
 }
@@ -0,0 +1,112 @@
+package console
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/dataStore"
+)
+
+// readinessTimeout bounds the readiness checks, a hung filesystem must not hang the probes
+const readinessTimeout = 5 * time.Second
+
+// readinessInterval is how long the result of the readiness checks is reused, so probes,
+// which aren't authenticated, can't make the store write more often than that
+const readinessInterval = 2 * time.Second
+
+// readiness is the last result of the readiness checks. A single run is in progress at a
+// time, the probes arriving meanwhile wait for it rather than starting their own.
+var readiness struct {
+	mutex   sync.Mutex
+	checks  []dataStore.HealthCheck
+	checked time.Time
+	// Closed once the run in progress is done, nil if none
+	running chan struct{}
+}
+
+// readinessChecks returns the result of the readiness checks, from the last run if recent
+// enough. It gives up waiting for the run when ctx is done.
+func readinessChecks(ctx context.Context) []dataStore.HealthCheck {
+	readiness.mutex.Lock()
+	if readiness.checks != nil && time.Since(readiness.checked) < readinessInterval {
+		checks := readiness.checks
+		readiness.mutex.Unlock()
+		return checks
+	}
+	running := readiness.running
+	if running == nil {
+		running = make(chan struct{})
+		readiness.running = running
+		go runReadinessChecks(running)
+	}
+	readiness.mutex.Unlock()
+
+	select {
+	case <-running:
+		readiness.mutex.Lock()
+		defer readiness.mutex.Unlock()
+		return readiness.checks
+	case <-ctx.Done():
+		return []dataStore.HealthCheck{{Name: "store", Message: "checks not completed: " + ctx.Err().Error()}}
+	}
+}
+
+// runReadinessChecks runs the checks, bounded by readinessTimeout, and closes done once their
+// result is stored
+func runReadinessChecks(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+	cfg := config.Current().Health
+	checks := dataStore.OsFileSystem{}.CheckReadiness(ctx, cfg.MinFreeMB<<20, cfg.MinFreePercent)
+
+	readiness.mutex.Lock()
+	defer readiness.mutex.Unlock()
+	readiness.checks, readiness.checked, readiness.running = checks, time.Now(), nil
+	close(done)
+}
+
+// shuttingDown makes the server not ready while it drains the requests in progress
+var shuttingDown atomic.Bool
+
+// SetShuttingDown reports the server as not ready from now on, for load balancers to stop
+// sending it requests
+func SetShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+type healthResponse struct {
+	Status string                  `json:"status"`
+	Checks []dataStore.HealthCheck `json:"checks,omitempty"`
+}
+
+// HealthzHandler reports the server is alive
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// ReadyzHandler reports whether the server can serve requests, with a 503 listing the
+// failed checks if not
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "shutting_down"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	checks := readinessChecks(ctx)
+
+	response := healthResponse{Status: "ready", Checks: checks}
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			config.Log.Warn("Readiness check failed", "check", check.Name, "message", check.Message)
+			response.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, response)
+}
@@ -0,0 +1,90 @@
+package console
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/auth"
+)
+
+type createKeyRequest struct {
+	Principal string   `json:"principal"`
+	Groups    []string `json:"groups"`
+	// Validity of the key as a duration (i.e: "720h"), the key never expires if empty
+	ExpiresIn string `json:"expires_in"`
+}
+
+type createKeyResponse struct {
+	Key    auth.APIKey `json:"key"`
+	APIKey string      `json:"api_key"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	jsonResponse, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
+
+// APIKeysHandler manages the API keys of the server port:
+//
+//	GET /auth/keys          lists the keys
+//	POST /auth/keys         creates a key, the response holds the only copy of the key
+//	DELETE /auth/keys/<id>  revokes a key
+func APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/auth/keys"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, auth.Credentials.ListKeys())
+
+	case r.Method == http.MethodPost && id == "":
+		var request createKeyRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Principal == "" {
+			http.Error(w, "A JSON body with the key principal is required", http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if request.ExpiresIn != "" {
+			ttl, err = time.ParseDuration(request.ExpiresIn)
+			if err != nil || ttl <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid expires_in: %q", request.ExpiresIn), http.StatusBadRequest)
+				return
+			}
+		}
+		key, apiKey, err := auth.Credentials.CreateKey(request.Principal, request.Groups, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		config.Log.Info("Created API key", "id", key.ID, "principal", key.Principal)
+		key.SecretHash = ""
+		writeJSON(w, http.StatusCreated, createKeyResponse{Key: key, APIKey: apiKey})
+
+	case r.Method == http.MethodDelete && id != "":
+		err := auth.Credentials.RevokeKey(id)
+		if errors.Is(err, auth.ErrKeyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		config.Log.Info("Revoked API key", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
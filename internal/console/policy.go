@@ -0,0 +1,63 @@
+package console
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rkachach/hss/internal/auth"
+)
+
+type simulateRequest struct {
+	Principal string      `json:"principal"`
+	Groups    []string    `json:"groups"`
+	Action    auth.Action `json:"action"`
+	Path      string      `json:"path"`
+	// Evaluate the action on the whole tree under path, as recursive operations do
+	Recursive bool `json:"recursive"`
+}
+
+// PolicySimulateHandler evaluates the access policies for a principal, an action and a path
+// without doing anything, to debug access. The request is given either as query parameters
+// (GET /policy/simulate?principal=alice&groups=dev,ops&action=read&path=/data) or as a JSON
+// body with the same fields.
+func PolicySimulateHandler(w http.ResponseWriter, r *http.Request) {
+	var request simulateRequest
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		request.Principal = query.Get("principal")
+		if groups := query.Get("groups"); groups != "" {
+			request.Groups = strings.Split(groups, ",")
+		}
+		request.Action = auth.Action(query.Get("action"))
+		request.Path = query.Get("path")
+		request.Recursive = query.Get("recursive") == "true"
+	case http.MethodPost:
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if request.Principal == "" || request.Action == "" || request.Path == "" {
+		http.Error(w, "principal, action and path are required", http.StatusBadRequest)
+		return
+	}
+	if !auth.IsAction(request.Action) {
+		http.Error(w, fmt.Sprintf("Unknown action: %q", request.Action), http.StatusBadRequest)
+		return
+	}
+
+	principal := &auth.Principal{Name: request.Principal, Groups: request.Groups}
+	if request.Recursive {
+		writeJSON(w, http.StatusOK, auth.AuthorizeTree(principal, request.Action, request.Path))
+	} else {
+		writeJSON(w, http.StatusOK, auth.Authorize(principal, request.Action, request.Path))
+	}
+}
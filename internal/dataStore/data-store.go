@@ -1,16 +1,17 @@
 package dataStore
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
+	"log/slog"
 	"os"
-	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 	"github.com/google/uuid"
 	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/tracing"
 	fsutils "github.com/rkachach/hss/internal/utils"
 )
 
@@ -21,24 +22,80 @@ type DataStore interface {
   ReadFileInfo(filePath string) (FileInfo, error)
   WriteFilePart(filePath string, objectPartData []byte, PartNumber int) (FileInfo, error)
   ReadFile(filePath string) ([]byte, error) // TODO: this should be a FilePartReader or something like that
+  OpenFile(filePath string) (FileReader, error)
   DeleteFile(filePath string) error
   UpdateFileInfo(filePath string, fileInfo FileInfo) error
   CreateDirectory(relativeDirPath string, userMetadata map[string]string) error
   GetDirectoryInfo(relativeDirPath string) (DirectoryInfo, error)
-  DeleteDirectory(relativeDirPath string) error
+  DeleteDirectory(relativeDirPath string, options DeleteDirectoryOptions) (DeleteDirectoryReport, error)
   ListDirectory(relativeDirPath string) ([]ElementExtendedInfo, error)
+  // WithContext returns a copy of the store running its operations in the context of the
+  // request they serve, for its logger and trace
+  WithContext(ctx context.Context) DataStore
 }
 
 type OsFileSystem struct {
+	ctx context.Context
 }
 
+func (store OsFileSystem) WithContext(ctx context.Context) DataStore {
+	store.ctx = ctx
+	return store
+}
+
+// requestContext returns the context of the store operations
+func (store OsFileSystem) requestContext() context.Context {
+	if store.ctx == nil {
+		return context.Background()
+	}
+	return store.ctx
+}
+
+// log returns the logger of the store operations
+func (store OsFileSystem) log() *slog.Logger {
+	return config.LogFromContext(store.requestContext())
+}
+
+// startSpan starts the span of an internal operation on filePath
+func (store OsFileSystem) startSpan(name string, filePath storePath) *tracing.Span {
+	_, span := tracing.Start(store.requestContext(), "DataStore."+name, "path", filePath.Path)
+	return span
+}
+
+// FileReader gives streaming access to the content of a file
+type FileReader interface {
+	io.ReadSeekCloser
+	// Size of the file content
+	Size() int64
+}
+
+type osFileReader struct {
+	*os.File
+	size int64
+}
+
+func (reader osFileReader) Size() int64 { return reader.size }
+
 type FileError struct {
 	Op     string
 	Key   string
 	Err    error
 }
 
-func (e *FileError) Error() string { return e.Op + " " + e.Key + ": " + e.Err.Error() }
+func (e *FileError) Error() string {
+	if e.Err == nil {
+		return e.Op + " " + e.Key
+	}
+	return e.Op + " " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error { return e.Err }
+
+// ErrFileExists is returned when uploading a file that already exists
+var ErrFileExists = errors.New("file already exists")
+
+// ErrDirectoryExists is returned when creating a directory that already exists
+var ErrDirectoryExists = errors.New("directory already exists")
 
 type ElementExtendedInfo struct {
 	Name         string    `json:"name"`
@@ -59,6 +116,9 @@ type FileInfo struct {
 
 	// Metadata for the directory
 	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Set when the file content is encrypted at rest
+	Encryption *FileEncryption `json:"encryption,omitempty"`
 }
 
 func (store OsFileSystem) Init(dataStore string) error {
@@ -66,55 +126,51 @@ func (store OsFileSystem) Init(dataStore string) error {
 	if err != nil {
 		return &DirectoryError{Op: "Error creating directory", Key: dataStore}
 	}
-	return err
+	return initEncryption()
 }
 
 func (store OsFileSystem) IsMetadataFile(filename string) bool {
-	return strings.HasSuffix(filename, ".json")
+	return isReservedName(filename)
 }
 
-func getFilePath(filePath string) string {
-	dir := filepath.Dir(filePath)
-	filename := filepath.Base(filePath)
-	return fmt.Sprintf("%s/%s/%s", config.AppConfig.StoreConfig.Root, dir, filename)
-}
-
-func getFileInfoPath(filePath string) string {
-	dir := filepath.Dir(filePath)
-	filename := filepath.Base(filePath)
-	return fmt.Sprintf("%s/%s/__%s__.json", config.AppConfig.StoreConfig.Root, dir, filename)
-}
-
-func writeFileInfo(filePath string, fileInfo *FileInfo) error {
+func (store OsFileSystem) writeFileInfo(filePath storePath, fileInfo *FileInfo) (err error) {
+	span := store.startSpan("writeFileInfo", filePath)
+	defer func() { span.EndWithError(err) }()
 
 	jsonData, err := json.MarshalIndent(fileInfo, "", "  ")
 	if err != nil {
-		fmt.Println("Error when writing Fileinfo:", err)
 		return err
 	}
 
-	infoFilePath := getFileInfoPath(filePath)
+	infoFilePath := filePath.fileInfoPath()
 	file, err := os.Create(infoFilePath)
 	if err != nil {
-		fmt.Printf("os.Create Error: %v (path: %v)\n", err, infoFilePath)
 		return err
 	}
 	defer file.Close()
 
 	_, err = file.Write(jsonData)
 	if err != nil {
-		fmt.Println("file.Write Error:", err)
 		return err
 	}
 
 	return nil
 }
 
-func (store OsFileSystem) ReadFileInfo(filePath string) (FileInfo, error) {
+func (store OsFileSystem) readFileInfo(filePath storePath) (_ FileInfo, err error) {
+	span := store.startSpan("readFileInfo", filePath)
+	defer func() {
+		// Operations check whether files exist by reading their info
+		if errors.Is(err, os.ErrNotExist) {
+			span.SetAttributes("exists", false)
+			span.End()
+			return
+		}
+		span.EndWithError(err)
+	}()
 
-	file, err := os.Open(getFileInfoPath(filePath))
+	file, err := os.Open(filePath.fileInfoPath())
 	if err != nil {
-		fmt.Println("Error:", err)
 		return FileInfo{}, err
 	}
 	defer file.Close()
@@ -123,23 +179,39 @@ func (store OsFileSystem) ReadFileInfo(filePath string) (FileInfo, error) {
 	decoder := json.NewDecoder(file)
 	err = decoder.Decode(&fileInfo)
 	if err != nil {
-		fmt.Println("Error:", err)
 		return FileInfo{}, err
 	}
 
 	return fileInfo, nil
 }
 
-// FIXME: fix createion on files like "/", this could go pretty wrogn if we create a file in host root instead of 
-// "datastore root"
+func (store OsFileSystem) ReadFileInfo(filePath string) (FileInfo, error) {
+	resolved, err := resolveFilePath(filePath)
+	if err != nil {
+		return FileInfo{}, &FileError{Op: "Invalid path", Key: filePath, Err: err}
+	}
+	return store.readFileInfo(resolved)
+}
+
 func (store OsFileSystem) StartFileUpload(filePath string, userMetadata map[string]string) (FileInfo, error){
-	lock.Lock()
+	resolved, err := resolveFilePath(filePath)
+	if err != nil {
+		return FileInfo{}, &FileError{Op: "Invalid path", Key: filePath, Err: err}
+	}
+
+	lockStore()
 	defer lock.Unlock()
 
-	_, err := store.ReadFileInfo(filePath)
+	_, err = store.readFileInfo(resolved)
 	if err == nil {
-		// File already exists
-		fmt.Printf("File %v already exsits\n", filePath)
+		// Files are never overwritten, they must be deleted first
+		store.log().Debug("File already exists", "op", "StartFileUpload", "path", filePath)
+		return FileInfo{}, &FileError{Op: "StartFileUpload", Key: filePath, Err: ErrFileExists}
+	}
+
+	err = store.checkQuota(resolved, 0, 1)
+	if err != nil {
+		store.log().Warn("Upload rejected", "op", "StartFileUpload", "path", filePath, "error", err)
 		return FileInfo{}, err
 	}
 
@@ -149,8 +221,19 @@ func (store OsFileSystem) StartFileUpload(filePath string, userMetadata map[stri
 		UploadID: uuid.New().String(),
 		Size: 0,
 		Metadata: userMetadata}
+	if config.AppConfig.StoreConfig.Encryption.Enabled {
+		fileInfo.Encryption, err = newFileEncryption()
+		if err != nil {
+			return FileInfo{}, &FileError{Op: "Error setting up file encryption", Key: filePath, Err: err}
+		}
+	}
+
+	err = store.writeFileInfo(resolved, &fileInfo)
+	if err != nil {
+		return FileInfo{}, err
+	}
 
-	err = writeFileInfo(filePath, &fileInfo)
+	err = store.updateDirectoryStats(resolved, 0, 1)
 	return fileInfo, err
 }
 
@@ -161,24 +244,53 @@ func (store OsFileSystem) StartFileUpload(filePath string, userMetadata map[stri
 //             - Read range
 //
 func (store OsFileSystem) WriteFilePart(filePath string, objectPartData []byte, PartNumber int) (FileInfo, error) {
+	resolved, err := resolveFilePath(filePath)
+	if err != nil {
+		return FileInfo{}, &FileError{Op: "Invalid path", Key: filePath, Err: err}
+	}
 
-	lock.Lock()
+	lockStore()
 	defer lock.Unlock()
 
-	fileInfo, err := store.ReadFileInfo(filePath)
+	fileInfo, err := store.readFileInfo(resolved)
 	if err != nil {
-		fmt.Printf("Error reading file info: %v\n", err)
+		store.log().Error("Error reading file info", "op", "WriteFilePart", "path", filePath, "error", err)
 		return FileInfo{}, err
 	}
 
-	fsutils.AppendToFile(getFilePath(filePath), objectPartData)
+	// Directory statistics and quotas account the bytes stored, encryption overhead included
+	storedBytes := int64(len(objectPartData))
+	if fileInfo.Encryption != nil {
+		newSize := fileInfo.Size + int64(len(objectPartData))
+		storedBytes = fileInfo.Encryption.storedSize(newSize) - fileInfo.Encryption.storedSize(fileInfo.Size)
+	}
+
+	err = store.checkQuota(resolved, storedBytes, 0)
+	if err != nil {
+		store.log().Warn("Part rejected", "op", "WriteFilePart", "path", filePath, "error", err)
+		return FileInfo{}, err
+	}
+
+	if fileInfo.Encryption != nil {
+		err = appendEncrypted(resolved.OSPath, fileInfo.Encryption, fileInfo.Size, objectPartData)
+	} else {
+		err = fsutils.AppendToFile(resolved.OSPath, objectPartData)
+	}
+	if err != nil {
+		return FileInfo{}, &FileError{Op: "Error writing object", Key: filePath, Err: err}
+	}
 
 	// Update object info
 	fileInfo.Size = fileInfo.Size + int64(len(objectPartData))
 	fileInfo.LastModified = time.Now().UTC()
-	err = writeFileInfo(filePath, &fileInfo)
+	err = store.writeFileInfo(resolved, &fileInfo)
+	if err != nil {
+		store.log().Error("Error writing file info", "op", "WriteFilePart", "path", filePath, "error", err)
+		return FileInfo{}, err
+	}
+
+	err = store.updateDirectoryStats(resolved, storedBytes, 0)
 	if err != nil {
-		fmt.Printf("Error writing file info: %v\n", err)
 		return FileInfo{}, err
 	}
 
@@ -186,11 +298,29 @@ func (store OsFileSystem) WriteFilePart(filePath string, objectPartData []byte,
 }
 
 func (store OsFileSystem) ReadFile(filePath string) ([]byte, error) {
+	resolved, err := resolveFilePath(filePath)
+	if err != nil {
+		return nil, &FileError{Op: "Invalid path", Key: filePath, Err: err}
+	}
 
-	lock.Lock()
+	lockStore()
 	defer lock.Unlock()
 
-	file, err := os.Open(getFilePath(filePath))
+	fileInfo, err := store.readFileInfo(resolved)
+	if err == nil && fileInfo.Encryption != nil {
+		reader, err := openEncryptedFile(resolved, fileInfo)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, &FileError{Op: "Error reading object", Key: filePath, Err: err}
+		}
+		return data, nil
+	}
+
+	file, err := os.Open(resolved.OSPath)
 	if err != nil {
 		return nil, &FileError{Op: "Error reading object", Key: filePath}
 	}
@@ -210,12 +340,58 @@ func (store OsFileSystem) ReadFile(filePath string) ([]byte, error) {
 	return data, nil
 }
 
+func (store OsFileSystem) OpenFile(filePath string) (FileReader, error) {
+	resolved, err := resolveFilePath(filePath)
+	if err != nil {
+		return nil, &FileError{Op: "Invalid path", Key: filePath, Err: err}
+	}
+
+	lockStore()
+	defer lock.Unlock()
+
+	fileInfo, err := store.readFileInfo(resolved)
+	if err == nil && fileInfo.Encryption != nil {
+		return openEncryptedFile(resolved, fileInfo)
+	}
+
+	file, err := os.Open(resolved.OSPath)
+	if err != nil {
+		return nil, &FileError{Op: "Error reading object", Key: filePath, Err: err}
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, &FileError{Op: "Error reading object", Key: filePath, Err: err}
+	}
+
+	return osFileReader{File: file, size: stat.Size()}, nil
+}
+
+// openEncryptedFile returns a reader decrypting the content of filePath
+func openEncryptedFile(filePath storePath, fileInfo FileInfo) (FileReader, error) {
+	file, err := os.Open(filePath.OSPath)
+	if err != nil {
+		return nil, &FileError{Op: "Error reading object", Key: filePath.Path, Err: err}
+	}
+	reader, err := newDecryptingReader(file, fileInfo.Encryption, fileInfo.Size)
+	if err != nil {
+		file.Close()
+		return nil, &FileError{Op: "Error decrypting object", Key: filePath.Path, Err: err}
+	}
+	return reader, nil
+}
+
 func (store OsFileSystem) UpdateFileInfo(filePath string, fileInfo FileInfo) error {
+	resolved, err := resolveFilePath(filePath)
+	if err != nil {
+		return &FileError{Op: "Invalid path", Key: filePath, Err: err}
+	}
 
-	lock.Lock()
+	lockStore()
 	defer lock.Unlock()
 
-	err := writeFileInfo(filePath, &fileInfo)
+	err = store.writeFileInfo(resolved, &fileInfo)
 	if err != nil {
 		return err
 	}
@@ -224,24 +400,52 @@ func (store OsFileSystem) UpdateFileInfo(filePath string, fileInfo FileInfo) err
 }
 
 func (store OsFileSystem) DeleteFile(filePath string) error {
+	resolved, err := resolveFilePath(filePath)
+	if err != nil {
+		return &FileError{Op: "Invalid path", Key: filePath, Err: err}
+	}
 
-	lock.Lock()
+	lockStore()
 	defer lock.Unlock()
+	return store.deleteFile(resolved)
+}
 
-	_, err := store.ReadFileInfo(filePath)
+// deleteFile removes resolved and its info. Caller must hold the store lock.
+func (store OsFileSystem) deleteFile(resolved storePath) error {
+	filePath := resolved.Path
+	_, err := store.readFileInfo(resolved)
 	if err != nil {
-		config.Logger.Printf("Error When reading info file for %v: %v", filePath, err)
+		store.log().Warn("Error reading file info", "op", "DeleteFile", "path", filePath, "error", err)
 	}
 
-	err = os.Remove(getFileInfoPath(filePath))
-	if err != nil {
-		config.Logger.Printf("Error When removing file for %v: %v", filePath, err)
+	// Compute what the file accounts for in the directory statistics before removing it
+	var removedBytes int64
+	removedFiles := 0
+	if err == nil {
+		removedFiles = 1
+	}
+	if stat, statErr := os.Stat(resolved.OSPath); statErr == nil {
+		removedBytes = stat.Size()
+		removedFiles = 1
 	}
 
-	fmt.Printf("Deleting file: %v\n", getFilePath(filePath))
-	err = os.Remove(getFilePath(filePath))
+	err = os.Remove(resolved.fileInfoPath())
 	if err != nil {
-		config.Logger.Printf("Error When removing %v", filePath)
+		store.log().Warn("Error removing file info", "op", "DeleteFile", "path", filePath, "error", err)
+	}
+
+	store.log().Debug("Deleting file", "op", "DeleteFile", "path", filePath)
+	removeErr := os.Remove(resolved.OSPath)
+
+	if removedFiles > 0 {
+		err = store.updateDirectoryStats(resolved, -removedBytes, -removedFiles)
+		if err != nil {
+			store.log().Error("Error updating directory stats", "op", "DeleteFile", "path", filePath, "error", err)
+		}
+	}
+
+	if removeErr != nil {
+		store.log().Error("Error removing file", "op", "DeleteFile", "path", filePath, "error", removeErr)
 		return &FileError{Op: "Error deleting object", Key: filePath}
 	}
 
@@ -254,7 +458,14 @@ type DirectoryError struct {
 	Err    error
 }
 
-func (e *DirectoryError) Error() string { return e.Op + " " + e.Key + ": " + e.Err.Error() }
+func (e *DirectoryError) Error() string {
+	if e.Err == nil {
+		return e.Op + " " + e.Key
+	}
+	return e.Op + " " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *DirectoryError) Unwrap() error { return e.Err }
 
 type DirectoryInfo struct {
 	// Name of the directory
@@ -265,10 +476,19 @@ type DirectoryInfo struct {
 	Size        int64     `json:"size"`
 	FilesCount  int       `json:"files_count"`
 
+	// Quota configured on the directory, if any
+	Quota *DirectoryQuota `json:"quota,omitempty"`
+
 	// Date and time when the directory was created/deleted
 	CreatedTime time.Time `json:"created"`
 	DeletedTime time.Time `json:"deleted,omitempty"`
 
+	// Date and time of the latest change in the directory tree
+	LastModified time.Time `json:"lastModified"`
+
+	// Whether Size, FilesCount and LastModified are maintained incrementally
+	StatsTracked bool `json:"stats_tracked,omitempty"`
+
 	// Metadata for the directory
 	Metadata map[string]string `json:"metadata,omitempty"`
 }
@@ -277,170 +497,177 @@ var(
     lock sync.Mutex
 )
 
-func isSubdirectory(parent, child string) bool {
-	relPath, err := filepath.Rel(parent, child)
-	if err != nil {
-		// Error occurred, indicating that the paths are not related
-		return false
-	}
-	// Check if the relative path starts with ".." or "../"
-	return relPath == "." || relPath == ".." || relPath[:3] == "../"
-}
+func (store OsFileSystem) writeDirectoryInfo(dirPath storePath, directoryInfo *DirectoryInfo) (err error) {
+	span := store.startSpan("writeDirectoryInfo", dirPath)
+	defer func() { span.EndWithError(err) }()
 
-func getDirectoryPath(dirPath string) (string, error) {
-	// Concatenate the directory path with the root directory path
-	finalPath := filepath.Join(config.AppConfig.StoreConfig.Root, dirPath)
-
-	// Check if the directory path contains upward directory traversal
-	if !isSubdirectory(finalPath, config.AppConfig.StoreConfig.Root) {
-		return "", fmt.Errorf("invalid directory path")
-	}
-
-	return finalPath, nil
-}
-
-func getDirectoryInfoPath(dirPath string) string {
-	return fmt.Sprintf("%s/%s/__info__.json", config.AppConfig.StoreConfig.Root, dirPath)
-}
-
-func writeDirectoryInfo(relativeDirPath string, directoryInfo *DirectoryInfo) {
+	// The quota comes from the configuration, it's not persisted
+	info := *directoryInfo
+	info.Quota = nil
 
 	// Marshal struct to JSON
-	jsonData, err := json.MarshalIndent(directoryInfo, "", "  ")
+	jsonData, err := json.MarshalIndent(&info, "", "  ")
 	if err != nil {
-		fmt.Println("Error when writing directoryInfo:", err)
-		return
+		return err
 	}
 
 	// Write directory info file
-	file, err := os.Create(getDirectoryInfoPath(relativeDirPath))
+	file, err := os.Create(dirPath.directoryInfoPath())
 	if err != nil {
-		fmt.Println("Error:", err)
-		return
+		return err
 	}
 	defer file.Close()
 
 	_, err = file.Write(jsonData)
 	if err != nil {
-		fmt.Println("Error:", err)
-		return
+		return err
 	}
+	return nil
 }
 
 func (store OsFileSystem) CreateDirectory(relativeDirPath string, userMetadata map[string]string) error {
+	dirPath, err := resolvePath(relativeDirPath)
+	if err != nil {
+		store.log().Warn("Invalid path", "op", "CreateDirectory", "path", relativeDirPath, "error", err)
+		return &DirectoryError{Op: "CreateDirectory", Err: err, Key: relativeDirPath}
+	}
 
-	lock.Lock()
+	lockStore()
 	defer lock.Unlock()
 
 	var directoryInfo DirectoryInfo
 	directoryInfo.Name = relativeDirPath
+	directoryInfo.Path = dirPath.Path
 	directoryInfo.CreatedTime = time.Now()
+	directoryInfo.LastModified = directoryInfo.CreatedTime.UTC()
 	directoryInfo.Metadata = userMetadata
+	directoryInfo.StatsTracked = true
 
 	// Create a directory if it doesn't exist
-	dirPath, err := getDirectoryPath(relativeDirPath)
-	if err != nil {
-		config.Logger.Printf("CreateDirectory: %v invalid path", dirPath)
-		return &DirectoryError{Op: "CreateDirectory", Err: err, Key: relativeDirPath}
-	}
-
-	exists, err := fsutils.DirectoryExists(dirPath)
+	exists, err := fsutils.DirectoryExists(dirPath.OSPath)
 	if exists {
-		config.Logger.Printf("CreateDirectory: %v already exists", dirPath)
-		return &DirectoryError{Op: "already exists", Key: relativeDirPath}
+		store.log().Debug("Directory already exists", "op", "CreateDirectory", "path", relativeDirPath)
+		return &DirectoryError{Op: "CreateDirectory", Key: relativeDirPath, Err: ErrDirectoryExists}
 	}
 
-	err = os.MkdirAll(dirPath, 0755)
+	err = os.MkdirAll(dirPath.OSPath, 0755)
 	if err != nil {
 		return &DirectoryError{Op: "Error creating directory", Key: relativeDirPath}
 	}
-	config.Logger.Printf("Directory '%v' created successfully", dirPath)
+	store.log().Info("Directory created", "op", "CreateDirectory", "path", dirPath.Path)
 
-	writeDirectoryInfo(relativeDirPath, &directoryInfo)
+	err = store.writeDirectoryInfo(dirPath, &directoryInfo)
+	if err != nil {
+		// Not left without its info, it would be taken as an unknown directory
+		removeErr := os.RemoveAll(dirPath.OSPath)
+		if removeErr != nil {
+			store.log().Error("Error removing directory", "op", "CreateDirectory", "path", relativeDirPath, "error", removeErr)
+		}
+		return &DirectoryError{Op: "Error writing directory info", Key: relativeDirPath, Err: err}
+	}
+	err = store.updateDirectoryStats(dirPath, 0, 0)
+	if err != nil {
+		store.log().Error("Error updating directory stats", "op", "CreateDirectory", "path", relativeDirPath, "error", err)
+	}
 	return nil
 }
 
-func fillDirectoryInfo(info map[string]interface{}) DirectoryInfo {
-    dirInfo := DirectoryInfo{}
-    dirInfo.Name = info["Name"].(string)
-    dirInfo.Path = info["Path"].(string)
-    dirInfo.Size = info["Size"].(int64)
-    dirInfo.FilesCount = info["FilesCount"].(int)
-    dirInfo.CreatedTime = info["CreatedTime"].(time.Time)
-    return dirInfo
-}
-
 func (store OsFileSystem) GetDirectoryInfo(relativeDirPath string) (DirectoryInfo, error) {
-
-	dirInfoPath := getDirectoryInfoPath(relativeDirPath)
-	file, err := os.Open(dirInfoPath)
-	if err == nil {
-		var dirInfo DirectoryInfo
-		defer file.Close()
-		decoder := json.NewDecoder(file)
-		err = decoder.Decode(&dirInfo)
-		if err != nil {
-			fmt.Println("Error:", err)
-			return DirectoryInfo{}, err
-		}
-		return dirInfo, nil
+	dirPath, err := resolvePath(relativeDirPath)
+	if err != nil {
+		return DirectoryInfo{}, &DirectoryError{Op: "GetDirectoryInfo", Err: err, Key: relativeDirPath}
 	}
 
-	// Directory info file doesn't exist, let's get dir info from filesytem
-	dirPath, err := getDirectoryPath(relativeDirPath)
+	lockStore()
+	defer lock.Unlock()
+
+	dirInfo, err := store.loadDirectoryInfo(dirPath)
 	if err != nil {
-		config.Logger.Printf("Cannot get directory info: %v ", dirPath)
-		return DirectoryInfo{}, &DirectoryError{Op: "GetDirecotryInfo", Err: err, Key: relativeDirPath}
+		store.log().Debug("Cannot get directory info", "op", "GetDirectoryInfo", "path", relativeDirPath, "error", err)
+		return DirectoryInfo{}, err
 	}
+	dirInfo.Quota = quotaOf(dirPath.Path)
 
-	dirInfoMap, err := fsutils.GetDirectoryInfo(dirPath)
-	if err == nil {
-		return fillDirectoryInfo(dirInfoMap), nil
-	} else {
-		return DirectoryInfo{}, &DirectoryError{Op: "GetDirecotryInfo", Err: err, Key: relativeDirPath}
-	}
+	return dirInfo, nil
 }
 
-func (store OsFileSystem) DeleteDirectory(relativeDirPath string) error {
+func (store OsFileSystem) DeleteDirectory(relativeDirPath string, options DeleteDirectoryOptions) (DeleteDirectoryReport, error) {
+	report := DeleteDirectoryReport{Path: normalizeStorePath(relativeDirPath), DryRun: options.DryRun}
+	dirPath, err := resolvePath(relativeDirPath)
+	if err != nil {
+		store.log().Warn("Invalid path", "op", "DeleteDirectory", "path", relativeDirPath, "error", err)
+		return report, &DirectoryError{Op: "DeleteDirectory", Err: err, Key: relativeDirPath}
+	}
+	if dirPath.isRoot() {
+		return report, &DirectoryError{Op: "DeleteDirectory", Err: ErrDeleteRoot, Key: relativeDirPath}
+	}
 
-	lock.Lock()
+	lockStore()
 	defer lock.Unlock()
 
-	dirPath, err := getDirectoryPath(relativeDirPath)
-	if err != nil {
-		config.Logger.Printf("DeleteDirectory: %v invalid path", dirPath)
-		return &DirectoryError{Op: "DeleteDirectory", Err: err, Key: relativeDirPath}
+	exists, err := fsutils.DirectoryExists(dirPath.OSPath)
+	if !exists {
+		store.log().Debug("Directory not found", "op", "DeleteDirectory", "path", relativeDirPath)
+		return report, &DirectoryError{Op: "DeleteDirectory", Err: ErrDirectoryNotFound, Key: relativeDirPath}
 	}
 
-	exists, err := fsutils.DirectoryExists(dirPath)
-	if !exists {
-		config.Logger.Printf("getDirectory: Directory not found")
-		return &DirectoryError{Op: "Error creating directory", Key: relativeDirPath}
+	if !options.Recursive {
+		empty, err := isDirectoryEmpty(dirPath.OSPath)
+		if err != nil {
+			return report, &DirectoryError{Op: "DeleteDirectory", Err: err, Key: relativeDirPath}
+		}
+		if !empty {
+			return report, &DirectoryError{Op: "DeleteDirectory", Err: ErrDirectoryNotEmpty, Key: relativeDirPath}
+		}
 	}
 
-	// delete the directory from the data store
-	err = os.RemoveAll(dirPath)
+	dirInfo, err := store.loadDirectoryInfo(dirPath)
 	if err != nil {
-		fmt.Println("Error deleting directory:", err)
-		//http.Error(w, "Error deleting directory", http.StatusNotFound)
-		return &DirectoryError{Op: "Error deleting directory", Key: relativeDirPath}
+		// The parents must be told what is deleted, scan it when its info can't be read
+		store.log().Warn("Cannot get directory stats, scanning it", "op", "DeleteDirectory", "path", relativeDirPath, "error", err)
+		dirInfo.Size, dirInfo.FilesCount, _, err = store.directoryUsage(dirPath.OSPath)
+		if err != nil {
+			return report, &DirectoryError{Op: "DeleteDirectory", Err: err, Key: relativeDirPath}
+		}
+	}
+
+	// delete the directory from the data store
+	removed := store.deleteTree(dirPath, options.DryRun, &report)
+	if options.DryRun {
+		return report, nil
+	}
+
+	if removed {
+		store.log().Info("Directory deleted", "op", "DeleteDirectory", "path", dirPath.Path)
+		err = store.updateDirectoryStats(dirPath, -dirInfo.Size, -dirInfo.FilesCount)
 	} else {
-		fmt.Printf("Directory '%v' deleted successfully\n", relativeDirPath)
+		store.log().Warn("Directory partially deleted", "op", "DeleteDirectory", "path", relativeDirPath, "failures", len(report.Failures))
+		// What remains is only known by scanning it
+		size, filesCount, _, scanErr := store.directoryUsage(dirPath.OSPath)
+		if scanErr == nil {
+			err = store.updateDirectoryStats(dirPath, size-dirInfo.Size, filesCount-dirInfo.FilesCount)
+		}
+	}
+	if err != nil {
+		store.log().Error("Error updating directory stats", "op", "DeleteDirectory", "path", relativeDirPath, "error", err)
 	}
 
-	return nil
+	if !removed {
+		return report, &DirectoryError{Op: "DeleteDirectory", Err: ErrPartialDelete, Key: relativeDirPath}
+	}
+	return report, nil
 }
 
 func (store OsFileSystem) ListDirectory(relativeDirPath string) ([]ElementExtendedInfo, error) {
-	dirPath, err := getDirectoryPath(relativeDirPath)
+	dirPath, err := resolvePath(relativeDirPath)
 	if err != nil {
-		config.Logger.Printf("Cannot list directory: %v ", dirPath)
+		store.log().Warn("Invalid path", "op", "ListDirectory", "path", relativeDirPath, "error", err)
 		return nil, &DirectoryError{Op: "ListDirectory", Err: err, Key: relativeDirPath}
 	}
 
-	fmt.Printf("Listing '%v' directory\n", dirPath)
+	store.log().Debug("Listing directory", "op", "ListDirectory", "path", dirPath.Path)
 	var dirEntries []ElementExtendedInfo
-	elements, err := fsutils.ListDirectoryWithDetails(dirPath)
+	elements, err := fsutils.ListDirectoryWithDetails(dirPath.OSPath)
 	if err == nil {
 		for _, entry := range elements {
 			if ! store.IsMetadataFile(entry.Name){
@@ -1,10 +1,21 @@
 package dataStore
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/base64"
+	"errors"
+	"io"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/tracing"
 )
 
 var store OsFileSystem = OsFileSystem{}
@@ -109,18 +120,54 @@ func TestDeleteDirectory(t *testing.T) {
   if err != nil {
     t.Error("Error creating directory")
   }
-  err = store.DeleteDirectory("testdir")
+  _, err = store.DeleteDirectory("testdir", DeleteDirectoryOptions{})
   if err != nil {
     t.Error("Error removing dir")
   }
 }
 
+func TestDeleteDirectoryNotEmpty(t *testing.T) {
+  err := store.CreateDirectory("deldir", map[string]string{})
+  if err != nil {
+    t.Fatal("Error creating directory")
+  }
+  store.CreateDirectory("deldir/sub", map[string]string{})
+  createFile("deldir/a", t)
+  store.WriteFilePart("deldir/a", make([]byte, 4), 0)
+  createFile("deldir/sub/b", t)
+  store.WriteFilePart("deldir/sub/b", make([]byte, 6), 0)
+
+  _, err = store.DeleteDirectory("deldir", DeleteDirectoryOptions{})
+  if !errors.Is(err, ErrDirectoryNotEmpty) {
+    t.Errorf("Expected not empty error, got %v", err)
+  }
+
+  report, err := store.DeleteDirectory("deldir", DeleteDirectoryOptions{Recursive: true, DryRun: true})
+  if err != nil {
+    t.Fatal("Error on dry run ", err)
+  }
+  if report.FilesCount != 2 || report.Size != 10 || report.DirectoriesCount != 2 || len(report.SamplePaths) != 2 {
+    t.Errorf("Wrong dry run report %+v", report)
+  }
+  if _, err := store.ReadFileInfo("deldir/sub/b"); err != nil {
+    t.Error("Dry run deleted files")
+  }
+
+  report, err = store.DeleteDirectory("deldir", DeleteDirectoryOptions{Recursive: true})
+  if err != nil || report.FilesCount != 2 {
+    t.Errorf("Error removing dir %v %+v", err, report)
+  }
+  if _, err := store.DeleteDirectory("deldir", DeleteDirectoryOptions{}); !errors.Is(err, ErrDirectoryNotFound) {
+    t.Errorf("Expected not found error, got %v", err)
+  }
+}
+
 func TestCreateDirectory(t *testing.T) {
   err := store.CreateDirectory("testdir", map[string]string{})
   if err != nil {
     t.Error("Error creating directory")
   }
-  defer store.DeleteDirectory("testdir")
+  defer store.DeleteDirectory("testdir", DeleteDirectoryOptions{Recursive: true})
 }
 func TestGetDirectoryInfo(t *testing.T) {
   metadata := map[string]string{}
@@ -129,7 +176,7 @@ func TestGetDirectoryInfo(t *testing.T) {
   if err != nil {
     t.Error("Error creating directory")
   }
-  defer store.DeleteDirectory("testdir")
+  defer store.DeleteDirectory("testdir", DeleteDirectoryOptions{Recursive: true})
 
   dirInfo, err := store.GetDirectoryInfo("testdir")
   if dirInfo.Name != "testdir" {
@@ -146,8 +193,8 @@ func TestListDirectory(t *testing.T) {
   if err != nil {
     t.Error("Error creating directory")
   }
-  defer store.DeleteDirectory("testdir")
-  defer store.DeleteDirectory("testdir")
+  defer store.DeleteDirectory("testdir", DeleteDirectoryOptions{Recursive: true})
+  defer store.DeleteDirectory("testdir", DeleteDirectoryOptions{Recursive: true})
 
   createFile("testdir/a", t)
   store.WriteFilePart("testdir/a", []byte{}, 0)
@@ -166,13 +213,519 @@ func TestListDirectory(t *testing.T) {
     t.Errorf("Got wrong number of files %d!=3", len(files))
   }
 
-  if files[0] != "testdir/a" || files[1] != "testdir/b" || files[2] != "testdir/c"{
+  if files[0].Name != "a" || files[1].Name != "b" || files[2].Name != "c" {
     t.Error("Got different file names")
   } 
 }
 
-func TestIsMetadataFile(t *testing.T) {}
+func TestIsMetadataFile(t *testing.T) {
+  for name, reserved := range map[string]bool{"__info__.json": true, "__a__.json": true, "__x__": true,
+    "a.json": false, "__": false, "__a": false, "a__": false, "_a_.json": false} {
+    if store.IsMetadataFile(name) != reserved {
+      t.Errorf("Wrong reserved status for %q", name)
+    }
+  }
+}
+
+func TestDirectoryQuota(t *testing.T) {
+  err := store.CreateDirectory("quotadir", map[string]string{})
+  if err != nil {
+    t.Fatal("Error creating directory")
+  }
+  defer store.DeleteDirectory("quotadir", DeleteDirectoryOptions{Recursive: true})
+
+  quotas := config.AppConfig.StoreConfig.Quotas
+  config.AppConfig.StoreConfig.Quotas = []config.QuotaConfig{{Path: "/quotadir", MaxBytes: 10, MaxFiles: 2}}
+  defer func() { config.AppConfig.StoreConfig.Quotas = quotas }()
+
+  createFile("quotadir/a", t)
+  defer store.DeleteFile("quotadir/a")
+  _, err = store.WriteFilePart("quotadir/a", make([]byte, 8), 0)
+  if err != nil {
+    t.Fatal("Error writing file ", err)
+  }
+  _, err = store.WriteFilePart("quotadir/a", make([]byte, 3), 0)
+  if _, ok := err.(*QuotaError); !ok {
+    t.Errorf("Expected bytes quota error, got %v", err)
+  }
+
+  createFile("quotadir/b", t)
+  defer store.DeleteFile("quotadir/b")
+  store.WriteFilePart("quotadir/b", []byte{1}, 0)
+  _, err = store.StartFileUpload("quotadir/c", map[string]string{})
+  if _, ok := err.(*QuotaError); !ok {
+    t.Errorf("Expected files quota error, got %v", err)
+  }
+
+  dirInfo, err := store.GetDirectoryInfo("quotadir")
+  if err != nil {
+    t.Fatal("Error getting directory info ", err)
+  }
+  if dirInfo.Size != 9 || dirInfo.FilesCount != 2 {
+    t.Errorf("Wrong usage size=%d files=%d", dirInfo.Size, dirInfo.FilesCount)
+  }
+  if dirInfo.Quota == nil || dirInfo.Quota.MaxBytes != 10 {
+    t.Error("Quota not reported")
+  }
+}
+
+
+func TestDirectoryStats(t *testing.T) {
+  err := store.CreateDirectory("statsdir", map[string]string{})
+  if err != nil {
+    t.Fatal("Error creating directory")
+  }
+  defer store.DeleteDirectory("statsdir", DeleteDirectoryOptions{Recursive: true})
+  err = store.CreateDirectory("statsdir/sub", map[string]string{})
+  if err != nil {
+    t.Fatal("Error creating directory")
+  }
 
+  createFile("statsdir/a", t)
+  store.WriteFilePart("statsdir/a", make([]byte, 5), 0)
+  createFile("statsdir/sub/b", t)
+  store.WriteFilePart("statsdir/sub/b", make([]byte, 7), 0)
+  store.WriteFilePart("statsdir/sub/b", make([]byte, 1), 0)
+
+  dirInfo, err := store.GetDirectoryInfo("statsdir")
+  if err != nil {
+    t.Fatal("Error getting directory info ", err)
+  }
+  if dirInfo.Size != 13 || dirInfo.FilesCount != 2 {
+    t.Errorf("Wrong stats size=%d files=%d", dirInfo.Size, dirInfo.FilesCount)
+  }
+  if dirInfo.LastModified.IsZero() {
+    t.Error("LastModified not set")
+  }
+
+  store.DeleteFile("statsdir/sub/b")
+  dirInfo, _ = store.GetDirectoryInfo("statsdir")
+  if dirInfo.Size != 5 || dirInfo.FilesCount != 1 {
+    t.Errorf("Wrong stats after delete size=%d files=%d", dirInfo.Size, dirInfo.FilesCount)
+  }
+
+  // Stats must match a full scan of the directory
+  dirPath, _ := resolvePath("statsdir")
+  size, filesCount, _, _ := store.directoryUsage(dirPath.OSPath)
+  if size != dirInfo.Size || filesCount != dirInfo.FilesCount {
+    t.Errorf("Stats drifted from disk: size=%d/%d files=%d/%d", dirInfo.Size, size, dirInfo.FilesCount, filesCount)
+  }
+  store.DeleteFile("statsdir/a")
+}
+
+func TestEncryption(t *testing.T) {
+  oldKey := make([]byte, 32)
+  rand.Read(oldKey)
+  config.AppConfig.StoreConfig.Encryption = config.EncryptionConfig{Enabled: true, MasterKey: base64.StdEncoding.EncodeToString(oldKey)}
+  defer func() {
+    config.AppConfig.StoreConfig.Encryption = config.EncryptionConfig{}
+    initEncryption()
+  }()
+  if err := initEncryption(); err != nil {
+    t.Fatal("Error loading master key ", err)
+  }
+
+  // Parts spanning chunk boundaries, and a last partial chunk
+  filePath := "secret"
+  createFile(filePath, t)
+  defer store.DeleteFile(filePath)
+  var data []byte
+  for _, size := range []int{1000, encryptionChunkSize, 2*encryptionChunkSize - 500, 7} {
+    part := make([]byte, size)
+    rand.Read(part)
+    data = append(data, part...)
+    if _, err := store.WriteFilePart(filePath, part, 0); err != nil {
+      t.Fatal("Error writing file ", err)
+    }
+  }
+
+  readData, err := store.ReadFile(filePath)
+  if err != nil || !bytes.Equal(readData, data) {
+    t.Fatal("Wrong decrypted content ", err)
+  }
+  resolved, _ := resolveFilePath(filePath)
+  stored, _ := os.ReadFile(resolved.OSPath)
+  if bytes.Contains(stored, data[:64]) {
+    t.Error("File stored in clear")
+  }
+
+  reader, err := store.OpenFile(filePath)
+  if err != nil || reader.Size() != int64(len(data)) {
+    t.Fatal("Error opening file ", err)
+  }
+  defer reader.Close()
+  offset := int64(encryptionChunkSize - 10)
+  reader.Seek(offset, io.SeekStart)
+  readRange := make([]byte, 100)
+  if _, err := io.ReadFull(reader, readRange); err != nil || !bytes.Equal(readRange, data[offset:offset+100]) {
+    t.Error("Wrong range read across chunks ", err)
+  }
+
+  // Rotate to a new master key, keeping the old one only to read
+  keyFile := filepath.Join(t.TempDir(), "old.key")
+  os.WriteFile(keyFile, oldKey, 0600)
+  newKey := make([]byte, 32)
+  rand.Read(newKey)
+  config.AppConfig.StoreConfig.Encryption.MasterKey = base64.StdEncoding.EncodeToString(newKey)
+  config.AppConfig.StoreConfig.Encryption.PreviousKeyFiles = []string{keyFile}
+  initEncryption()
+  report, err := store.RotateKeys()
+  if err != nil || report.Rewrapped != 1 || len(report.Failed) != 0 {
+    t.Fatalf("Wrong rotation report %+v: %v", report, err)
+  }
+  if rotated, _ := os.ReadFile(resolved.OSPath); !bytes.Equal(rotated, stored) {
+    t.Error("Rotation rewrote the file data")
+  }
+
+  config.AppConfig.StoreConfig.Encryption.PreviousKeyFiles = nil
+  initEncryption()
+  readData, err = store.ReadFile(filePath)
+  if err != nil || !bytes.Equal(readData, data) {
+    t.Error("Wrong content after rotation ", err)
+  }
+}
+
+func TestPathResolution(t *testing.T) {
+  root := config.AppConfig.StoreConfig.Root
+  for userPath, expected := range map[string]string{"a/b": "/a/b", "/a//b/": "/a/b", "./a/./b": "/a/b", "": "/", "/": "/"} {
+    resolved, err := resolvePath(userPath)
+    if err != nil || resolved.Path != expected || resolved.OSPath != filepath.Join(root, expected) {
+      t.Errorf("Wrong resolution of %q: %+v %v", userPath, resolved, err)
+    }
+  }
+
+  for userPath, expected := range map[string]error{"..": ErrInvalidPath, "a/../../etc": ErrInvalidPath,
+    "a/..": ErrInvalidPath, "a\x00b": ErrInvalidPath, "__info__.json": ErrReservedName, "d/__f__.json/x": ErrReservedName} {
+    if _, err := resolvePath(userPath); !errors.Is(err, expected) {
+      t.Errorf("Path %q not rejected: %v", userPath, err)
+    }
+  }
+  if _, err := resolveFilePath("/"); !errors.Is(err, ErrInvalidPath) {
+    t.Error("Store root accepted as a file")
+  }
+
+  // Short paths used to panic the containment check
+  for _, userPath := range []string{"a", "/", "."} {
+    if _, err := store.ListDirectory(userPath); errors.Is(err, ErrInvalidPath) {
+      t.Errorf("Path %q rejected", userPath)
+    }
+  }
+
+  // Every operation refuses to follow a symlink out of the root
+  outside := t.TempDir()
+  os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+  os.WriteFile(filepath.Join(outside, "__secret__.json"), []byte("{}"), 0644)
+  if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+    t.Fatal(err)
+  }
+  defer os.Remove(filepath.Join(root, "escape"))
+  if _, err := store.ReadFile("escape/secret"); !errors.Is(err, ErrPathEscape) {
+    t.Error("Read through an escaping symlink ", err)
+  }
+  if _, err := store.StartFileUpload("escape/new", nil); !errors.Is(err, ErrPathEscape) {
+    t.Error("Upload through an escaping symlink ", err)
+  }
+  if _, err := store.ListDirectory("escape"); !errors.Is(err, ErrPathEscape) {
+    t.Error("Listed an escaping symlink ", err)
+  }
+  if _, err := store.DeleteDirectory("escape", DeleteDirectoryOptions{Recursive: true}); !errors.Is(err, ErrPathEscape) {
+    t.Error("Deleted through an escaping symlink ", err)
+  }
+  if err := store.DeleteFile("escape/secret"); !errors.Is(err, ErrPathEscape) {
+    t.Error("Deleted a file through an escaping symlink ", err)
+  }
+  if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+    t.Error("File outside the root removed")
+  }
+
+  // Symlinks staying inside the root are followed
+  store.CreateDirectory("inside", nil)
+  defer store.DeleteDirectory("inside", DeleteDirectoryOptions{Recursive: true})
+  os.Symlink(filepath.Join(root, "inside"), filepath.Join(root, "alias"))
+  defer os.Remove(filepath.Join(root, "alias"))
+  if _, err := resolvePath("alias/file"); err != nil {
+    t.Error("Symlink inside the root rejected ", err)
+  }
+}
+
+func TestInstrumentedStore(t *testing.T) {
+  instrumented := Instrumented(store)
+  notFound := storeErrors.Value("GetDirectoryInfo", "not_found")
+  invalid := storeErrors.Value("ReadFileInfo", "invalid_path")
+  locks := lockWaitSeconds.Count()
+
+  instrumented.GetDirectoryInfo("missing")
+  instrumented.ReadFileInfo("../escape")
+  if storeErrors.Value("GetDirectoryInfo", "not_found") != notFound+1 || storeErrors.Value("ReadFileInfo", "invalid_path") != invalid+1 {
+    t.Error("Errors not counted by type")
+  }
+  if lockWaitSeconds.Count() != locks+1 {
+    t.Error("Lock wait not observed")
+  }
+}
+
+func TestTracedStore(t *testing.T) {
+  var spans bytes.Buffer
+  tracing.SetExporter(&spans, 1)
+  defer tracing.SetExporter(nil, 0)
+
+  ctx, request := tracing.Start(context.Background(), "request")
+  traced := Traced(store).WithContext(ctx)
+  _, err := traced.StartFileUpload("traced", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer store.DeleteFile("traced")
+  traced.ReadFileInfo("../escape")
+  request.End()
+
+  exported, err := tracing.ReadSpans(&spans)
+  if err != nil {
+    t.Fatal(err)
+  }
+  byName := make(map[string]tracing.SpanData)
+  for _, span := range exported {
+    byName[span.Name] = span
+  }
+  root := byName["request"]
+  upload := byName["DataStore.StartFileUpload"]
+  if upload.ParentSpanID != root.SpanID || upload.TraceID != root.TraceID || upload.Attribute("path") != "traced" {
+    t.Error("Wrong operation span ", upload)
+  }
+  // Sidecar metadata files are accessed in spans of their own
+  if byName["DataStore.writeFileInfo"].ParentSpanID != upload.SpanID || byName["DataStore.writeFileInfo"].Attribute("path") != "/traced" {
+    t.Error("Wrong metadata span ", byName["DataStore.writeFileInfo"])
+  }
+  if byName["DataStore.ReadFileInfo"].Status.Code != tracing.StatusError {
+    t.Error("Error not recorded ", byName["DataStore.ReadFileInfo"])
+  }
+}
+
+func TestCheckReadiness(t *testing.T) {
+  ctx := context.Background()
+  for _, check := range store.CheckReadiness(ctx, 1, 0.001) {
+    if !check.OK {
+      t.Error("Check failed ", check)
+    }
+  }
+  left, _ := filepath.Glob(filepath.Join(config.AppConfig.StoreConfig.Root, healthDirName, "*"))
+  if len(left) != 0 {
+    t.Error("Health check files left ", left)
+  }
+  entries, _ := store.ListDirectory("/")
+  for _, entry := range entries {
+    if entry.Name == healthDirName {
+      t.Error("Health directory listed ", entry)
+    }
+  }
+
+  checks := store.CheckReadiness(ctx, 1<<62, 0)
+  if checks[1].Name != "free_space" || checks[1].OK || checks[1].Details["free_bytes"] <= 0 {
+    t.Error("Free space threshold not checked ", checks[1])
+  }
+  checks = store.CheckReadiness(ctx, 0, 100.1)
+  if checks[1].OK {
+    t.Error("Free space percent not checked ", checks[1])
+  }
+
+  // Unreadable metadata
+  infoPath := filepath.Join(config.AppConfig.StoreConfig.Root, directoryInfoName)
+  previous, readErr := os.ReadFile(infoPath)
+  os.WriteFile(infoPath, []byte("{corrupted"), 0644)
+  defer func() {
+    if readErr == nil {
+      os.WriteFile(infoPath, previous, 0644)
+    } else {
+      os.Remove(infoPath)
+    }
+  }()
+  checks = store.CheckReadiness(ctx, 0, 0)
+  if checks[2].Name != "metadata_readable" || checks[2].OK {
+    t.Error("Corrupted metadata not detected ", checks[2])
+  }
+
+  canceled, cancel := context.WithCancel(ctx)
+  cancel()
+  checks = store.CheckReadiness(canceled, 0, 0)
+  if len(checks) != 1 || checks[0].OK {
+    t.Error("Checks run once canceled ", checks)
+  }
+}
+
+func TestGCAndScrub(t *testing.T) {
+  store.CreateDirectory("maint", map[string]string{})
+  defer store.DeleteDirectory("maint", DeleteDirectoryOptions{Recursive: true})
+
+  // A completed upload, and one abandoned for two days
+  data := []byte("some content")
+  createFile("maint/done", t)
+  info, _ := store.WriteFilePart("maint/done", data, 0)
+  sum := md5.Sum(data)
+  info.MD5sum = hex.EncodeToString(sum[:])
+  store.UpdateFileInfo("maint/done", info)
+  createFile("maint/abandoned", t)
+  info, _ = store.WriteFilePart("maint/abandoned", data, 0)
+  info.LastModified = time.Now().Add(-48 * time.Hour)
+  store.UpdateFileInfo("maint/abandoned", info)
+
+  report, err := store.GC(context.Background(), GCOptions{DryRun: true, GracePeriod: 24 * time.Hour})
+  if err != nil || len(report.AbandonedUploads) != 1 || report.AbandonedUploads[0] != "/maint/abandoned" || report.BytesFreed != int64(len(data)) {
+    t.Error("Abandoned upload not found ", report, err)
+  }
+  if _, err := store.ReadFileInfo("maint/abandoned"); err != nil {
+    t.Error("Dry run removed the upload ", err)
+  }
+  // Idle but still being uploaded
+  active := func(path string) bool { return path == "/maint/abandoned" }
+  report, err = store.GC(context.Background(), GCOptions{GracePeriod: 24 * time.Hour, UploadActive: active})
+  if _, statErr := store.ReadFileInfo("maint/abandoned"); err != nil || statErr != nil || len(report.AbandonedUploads) != 0 {
+    t.Error("Active upload removed ", report, err)
+  }
+  report, err = store.GC(context.Background(), GCOptions{GracePeriod: 24 * time.Hour})
+  if _, statErr := store.ReadFileInfo("maint/abandoned"); err != nil || statErr == nil || len(report.AbandonedUploads) != 1 {
+    t.Error("Abandoned upload not removed ", report, err)
+  }
+  if _, err := store.ReadFileInfo("maint/done"); err != nil {
+    t.Error("Completed upload removed ", err)
+  }
+
+  scrub, err := store.Scrub(context.Background())
+  if err != nil || len(scrub.Problems) != 0 || scrub.Files == 0 {
+    t.Error("Unexpected scrub problems ", scrub, err)
+  }
+  // Corrupt the content keeping its size
+  os.WriteFile(filepath.Join(config.AppConfig.StoreConfig.Root, "maint", "done"), []byte("SOME CONTENT"), 0644)
+  scrub, _ = store.Scrub(context.Background())
+  if len(scrub.Problems) != 1 || scrub.Problems[0].Path != "/maint/done" || scrub.Problems[0].Problem != "checksum mismatch" {
+    t.Error("Corruption not found ", scrub)
+  }
+}
+
+func TestFsck(t *testing.T) {
+  store.CreateDirectory("fsck", map[string]string{})
+  defer store.DeleteDirectory("fsck", DeleteDirectoryOptions{Recursive: true})
+  dir := filepath.Join(config.AppConfig.StoreConfig.Root, "fsck")
+
+  // A data file without info, an orphaned info, a directory without info, a corrupted file
+  // and an upload left open
+  data := []byte("some content")
+  os.WriteFile(filepath.Join(dir, "noinfo"), data, 0644)
+  createFile("fsck/orphan", t)
+  info, _ := store.WriteFilePart("fsck/orphan", data, 0)
+  sum := md5.Sum(data)
+  info.MD5sum = hex.EncodeToString(sum[:])
+  store.UpdateFileInfo("fsck/orphan", info)
+  os.Remove(filepath.Join(dir, "orphan"))
+  os.Mkdir(filepath.Join(dir, "sub"), 0755)
+  createFile("fsck/corrupted", t)
+  info, _ = store.WriteFilePart("fsck/corrupted", data, 0)
+  info.MD5sum = hex.EncodeToString(sum[:])
+  store.UpdateFileInfo("fsck/corrupted", info)
+  os.WriteFile(filepath.Join(dir, "corrupted"), []byte("SOME CONTENT"), 0644)
+  createFile("fsck/open", t)
+  store.WriteFilePart("fsck/open", data, 0)
+
+  findings := func(report FsckReport) map[string]FsckFinding {
+    found := map[string]FsckFinding{}
+    for _, finding := range report.Findings {
+      if strings.HasPrefix(finding.Path, "/fsck") {
+        found[finding.Path] = finding
+      }
+    }
+    return found
+  }
+  expected := map[string]string{
+    "/fsck/noinfo":    ProblemMissingInfo,
+    "/fsck/orphan":    ProblemOrphanedInfo,
+    "/fsck/sub":       ProblemMissingDirectoryInfo,
+    "/fsck/corrupted": ProblemChecksumMismatch,
+    "/fsck/open":      ProblemOpenUpload,
+  }
+
+  // Uploads in progress aren't reported
+  report, err := store.Fsck(context.Background(), FsckOptions{UploadActive: func(path string) bool { return path == "/fsck/open" }})
+  if _, found := findings(report)["/fsck/open"]; err != nil || found {
+    t.Error("Upload in progress reported ", report, err)
+  }
+
+  report, err = store.Fsck(context.Background(), FsckOptions{})
+  found := findings(report)
+  if err != nil || len(found) != len(expected) {
+    t.Error("Unexpected fsck findings ", report, err)
+  }
+  for path, problem := range expected {
+    if found[path].Problem != problem || found[path].Repaired {
+      t.Error("Problem not found ", path, problem, found[path])
+    }
+  }
+  if _, err := os.Stat(filepath.Join(dir, "__orphan__.json")); err != nil {
+    t.Error("Check only run repaired ", err)
+  }
+
+  report, err = store.Fsck(context.Background(), FsckOptions{Repair: true})
+  found = findings(report)
+  for path := range expected {
+    if !found[path].Repaired {
+      t.Error("Problem not repaired ", path, found[path])
+    }
+  }
+  if info, err := store.ReadFileInfo("fsck/noinfo"); err != nil || info.Size != int64(len(data)) || info.MD5sum != hex.EncodeToString(sum[:]) {
+    t.Error("File info not rebuilt ", info, err)
+  }
+  if _, err := store.ReadFileInfo("fsck/open"); err == nil {
+    t.Error("Open upload not quarantined")
+  }
+  if _, err := os.Stat(filepath.Join(config.AppConfig.StoreConfig.Root, report.Quarantine, "fsck", "open")); err != nil {
+    t.Error("Open upload data not in the quarantine ", report.Quarantine, err)
+  }
+  if _, err := store.GetDirectoryInfo("fsck/sub"); err != nil {
+    t.Error("Directory info not rebuilt ", err)
+  }
+  if _, err := store.ReadFile("fsck/corrupted"); err != nil {
+    t.Error("Repaired file not readable ", err)
+  }
+
+  // The quarantine isn't scanned, nothing is left
+  report, err = store.Fsck(context.Background(), FsckOptions{})
+  if found := findings(report); err != nil || len(found) != 0 {
+    t.Error("Problems left after repair ", report, err)
+  }
+  os.RemoveAll(filepath.Join(config.AppConfig.StoreConfig.Root, quarantineName))
+
+  // With encryption enabled data without info can't be decrypted, it isn't served as is
+  config.AppConfig.StoreConfig.Encryption.Enabled = true
+  defer func() { config.AppConfig.StoreConfig.Encryption.Enabled = false }()
+  os.WriteFile(filepath.Join(dir, "encrypted"), data, 0644)
+  report, err = store.Fsck(context.Background(), FsckOptions{Repair: true})
+  if finding := findings(report)["/fsck/encrypted"]; err != nil || !finding.Repaired || finding.Repair != "quarantined" {
+    t.Error("Encrypted data without info not quarantined ", finding, err)
+  }
+  if _, err := store.ReadFileInfo("fsck/encrypted"); err == nil {
+    t.Error("Info rebuilt for encrypted data")
+  }
+  if _, err := os.Stat(filepath.Join(config.AppConfig.StoreConfig.Root, report.Quarantine, "fsck", "encrypted")); err != nil {
+    t.Error("Encrypted data not in the quarantine ", report.Quarantine, err)
+  }
+  os.RemoveAll(filepath.Join(config.AppConfig.StoreConfig.Root, quarantineName))
+}
+
+func TestAcquireStore(t *testing.T) {
+  if !fileLocking {
+    t.Skip("File locking not supported on this platform")
+  }
+  err := AcquireStore()
+  if err != nil {
+    t.Fatal("Error acquiring the store ", err)
+  }
+  // As another process would
+  _, err = lockStoreRoot(config.AppConfig.StoreConfig.Root)
+  if !errors.Is(err, ErrStoreBusy) {
+    t.Errorf("Expected store busy error, got %v", err)
+  }
+  if err := AcquireStore(); err != nil {
+    t.Error("Store not kept by its owner ", err)
+  }
+}
 
 func TestMain(m *testing.M) {
   println(os.Getwd())
@@ -180,7 +733,16 @@ func TestMain(m *testing.M) {
   config.ReadConfig("../../config/config.json")
   config.InitLogger()
 
+  // Run against a throwaway root so tests neither depend on nor pollute the configured store
+  root, err := os.MkdirTemp("", "hss-datastore-test-")
+  if err != nil {
+    panic(err)
+  }
+  config.AppConfig.StoreConfig.Root = root
+  store.Init(root)
+
   exitCode := m.Run()
+  os.RemoveAll(root)
 
   os.Exit(exitCode)
 }
@@ -0,0 +1,156 @@
+package dataStore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Maximum number of paths listed in a DeleteDirectoryReport
+const maxDeleteSamplePaths = 10
+
+var (
+	ErrDirectoryNotFound = errors.New("directory not found")
+	ErrDirectoryNotEmpty = errors.New("directory not empty, recursive deletion required")
+	ErrDeleteRoot        = errors.New("the store root cannot be deleted")
+	ErrPartialDelete     = errors.New("some entries could not be deleted")
+)
+
+type DeleteDirectoryOptions struct {
+	// Delete the directory even if it's not empty, along with all its content
+	Recursive bool
+	// Only report what would be deleted
+	DryRun bool
+}
+
+type DeletePathError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type DeleteDirectoryReport struct {
+	Path             string            `json:"path"`
+	DryRun           bool              `json:"dry_run"`
+	FilesCount       int               `json:"files_count"`
+	DirectoriesCount int               `json:"directories_count"`
+	Size             int64             `json:"size"`
+	SamplePaths      []string          `json:"sample_paths,omitempty"`
+	Failures         []DeletePathError `json:"failures,omitempty"`
+}
+
+func (report *DeleteDirectoryReport) addFile(relPath string, size int64) {
+	report.FilesCount++
+	report.Size += size
+	if len(report.SamplePaths) < maxDeleteSamplePaths {
+		report.SamplePaths = append(report.SamplePaths, relPath)
+	}
+}
+
+func (report *DeleteDirectoryReport) addFailure(relPath string, err error) {
+	report.Failures = append(report.Failures, DeletePathError{Path: relPath, Error: err.Error()})
+}
+
+// isDirectoryEmpty returns whether dirPath holds nothing but its own info sidecar
+func isDirectoryEmpty(dirPath string) (bool, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Name() != directoryInfoName {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// removeEntry removes absPath unless running a dry run, recording any failure
+func removeEntry(absPath string, relPath string, dryRun bool, report *DeleteDirectoryReport) bool {
+	if dryRun {
+		return true
+	}
+	err := os.Remove(absPath)
+	if err != nil && !os.IsNotExist(err) {
+		report.addFailure(relPath, err)
+		return false
+	}
+	return true
+}
+
+// deleteTree removes the content of dir and the directory itself, depth first. A data file's
+// sidecar is only removed once the data is gone, and a directory's own sidecar only when the
+// rest of its content could be removed, so a partial failure leaves consistent metadata
+// behind. Returns whether the whole tree was removed.
+func (store OsFileSystem) deleteTree(dir storePath, dryRun bool, report *DeleteDirectoryReport) bool {
+	entries, err := os.ReadDir(dir.OSPath)
+	if err != nil {
+		report.addFailure(dir.Path, err)
+		return false
+	}
+
+	complete := true
+	var dataFiles []os.DirEntry
+	sidecars := map[string]bool{}
+	for _, entry := range entries {
+		switch {
+		case entry.IsDir():
+			complete = store.deleteTree(dir.child(entry.Name()), dryRun, report) && complete
+		case store.IsMetadataFile(entry.Name()):
+			sidecars[entry.Name()] = true
+		default:
+			dataFiles = append(dataFiles, entry)
+		}
+	}
+
+	for _, entry := range dataFiles {
+		var size int64
+		if info, err := entry.Info(); err == nil {
+			size = info.Size()
+		}
+		file := dir.child(entry.Name())
+		sidecar := filepath.Base(file.fileInfoPath())
+		hasSidecar := sidecars[sidecar]
+		delete(sidecars, sidecar)
+
+		if !removeEntry(file.OSPath, file.Path, dryRun, report) {
+			complete = false
+			continue
+		}
+		report.addFile(file.Path, size)
+		if hasSidecar && !removeEntry(file.fileInfoPath(), dir.child(sidecar).Path, dryRun, report) {
+			complete = false
+		}
+	}
+
+	// Remaining sidecars belong to uploads without data yet or are orphaned
+	delete(sidecars, directoryInfoName)
+	remaining := make([]string, 0, len(sidecars))
+	for sidecar := range sidecars {
+		remaining = append(remaining, sidecar)
+	}
+	sort.Strings(remaining)
+	for _, sidecar := range remaining {
+		if !removeEntry(dir.child(sidecar).OSPath, dir.child(sidecar).Path, dryRun, report) {
+			complete = false
+			continue
+		}
+		if name, ok := fileSidecarName(sidecar); ok {
+			report.addFile(dir.child(name).Path, 0)
+		}
+	}
+
+	if !complete {
+		if !dryRun {
+			// Stats of what remains are rebuilt on next access
+			store.invalidateDirectoryStats(dir)
+		}
+		return false
+	}
+	removeEntry(dir.directoryInfoPath(), dir.child(directoryInfoName).Path, dryRun, report)
+	if !removeEntry(dir.OSPath, dir.Path, dryRun, report) {
+		return false
+	}
+	report.DirectoriesCount++
+	return true
+}
@@ -0,0 +1,419 @@
+package dataStore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// Encryption at rest: each file has its own random data key, stored in its info sidecar
+// wrapped (AES-GCM encrypted) with a master key. File data is split in chunks of
+// encryptionChunkSize bytes, each sealed with AES-GCM under a random nonce and stored as
+// nonce || ciphertext || tag, so any range can be read by decrypting only the chunks it spans.
+// The chunk index is authenticated with each chunk so they can't be reordered.
+
+const (
+	encryptionAlgorithm = "AES-256-GCM-CHUNKED"
+	encryptionChunkSize = 64 << 10
+	gcmNonceSize        = 12
+	gcmTagSize          = 16
+	chunkOverhead       = gcmNonceSize + gcmTagSize
+)
+
+var (
+	ErrNoMasterKey      = errors.New("no master key configured")
+	ErrUnknownMasterKey = errors.New("file data key wrapped with an unknown master key")
+)
+
+// FileEncryption describes how a file is encrypted
+type FileEncryption struct {
+	Algorithm string `json:"algorithm"`
+	ChunkSize int    `json:"chunkSize"`
+	// Data key of the file wrapped with the master key identified by KeyID
+	WrappedKey []byte `json:"wrappedKey"`
+	KeyID      string `json:"keyID"`
+}
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Master keys by id, current wraps the data keys of new files
+var keyring = struct {
+	current *masterKey
+	keys    map[string]*masterKey
+}{keys: map[string]*masterKey{}}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decodeMasterKey accepts a base64 encoded key or the raw 32 bytes
+func decodeMasterKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("master key must be 32 bytes, base64 encoded or raw")
+	}
+	return key, nil
+}
+
+func readMasterKeyFile(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeMasterKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+	return key, nil
+}
+
+func addMasterKey(key []byte) (*masterKey, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(key)
+	masterKey := &masterKey{id: hex.EncodeToString(hash[:8]), aead: aead}
+	keyring.keys[masterKey.id] = masterKey
+	return masterKey, nil
+}
+
+// initEncryption loads the master keys of the configuration
+func initEncryption() error {
+	keyring.current = nil
+	keyring.keys = map[string]*masterKey{}
+	encryptionConfig := config.AppConfig.StoreConfig.Encryption
+
+	var key []byte
+	var err error
+	switch {
+	case encryptionConfig.MasterKey != "":
+		key, err = decodeMasterKey([]byte(encryptionConfig.MasterKey))
+	case encryptionConfig.MasterKeyFile != "":
+		key, err = readMasterKeyFile(encryptionConfig.MasterKeyFile)
+		if os.IsNotExist(err) && !encryptionConfig.Enabled {
+			// Nothing was ever encrypted with it
+			key, err = nil, nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		keyring.current, err = addMasterKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	if encryptionConfig.Enabled && keyring.current == nil {
+		return ErrNoMasterKey
+	}
+
+	for _, filename := range encryptionConfig.PreviousKeyFiles {
+		key, err := readMasterKeyFile(filename)
+		if err != nil {
+			return err
+		}
+		_, err = addMasterKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sealWith(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, gcmNonceSize, gcmNonceSize+len(plaintext)+gcmTagSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openWith(aead cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < chunkOverhead {
+		return nil, errors.New("truncated ciphertext")
+	}
+	return aead.Open(nil, sealed[:gcmNonceSize], sealed[gcmNonceSize:], additionalData)
+}
+
+// newFileEncryption generates a data key for a new file, wrapped with the current master key
+func newFileEncryption() (*FileEncryption, error) {
+	if keyring.current == nil {
+		return nil, ErrNoMasterKey
+	}
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := sealWith(keyring.current.aead, dataKey, []byte(keyring.current.id))
+	if err != nil {
+		return nil, err
+	}
+	return &FileEncryption{
+		Algorithm:  encryptionAlgorithm,
+		ChunkSize:  encryptionChunkSize,
+		WrappedKey: wrappedKey,
+		KeyID:      keyring.current.id,
+	}, nil
+}
+
+func (encryption *FileEncryption) dataKey() ([]byte, error) {
+	masterKey, ok := keyring.keys[encryption.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %v", ErrUnknownMasterKey, encryption.KeyID)
+	}
+	return openWith(masterKey.aead, encryption.WrappedKey, []byte(masterKey.id))
+}
+
+// rewrap wraps the data key with the current master key
+func (encryption *FileEncryption) rewrap() error {
+	dataKey, err := encryption.dataKey()
+	if err != nil {
+		return err
+	}
+	wrappedKey, err := sealWith(keyring.current.aead, dataKey, []byte(keyring.current.id))
+	if err != nil {
+		return err
+	}
+	encryption.WrappedKey = wrappedKey
+	encryption.KeyID = keyring.current.id
+	return nil
+}
+
+func (encryption *FileEncryption) cipher() (cipher.AEAD, error) {
+	if encryption.Algorithm != encryptionAlgorithm || encryption.ChunkSize <= 0 {
+		return nil, fmt.Errorf("unsupported encryption %v", encryption.Algorithm)
+	}
+	dataKey, err := encryption.dataKey()
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(dataKey)
+}
+
+// storedSize returns the size on disk of size bytes of content
+func (encryption *FileEncryption) storedSize(size int64) int64 {
+	chunkSize := int64(encryption.ChunkSize)
+	chunks := (size + chunkSize - 1) / chunkSize
+	return size + chunks*chunkOverhead
+}
+
+func chunkAdditionalData(index int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(index))
+}
+
+// appendEncrypted appends data to the encrypted file at dataPath holding size bytes. A last
+// partial chunk is decrypted and sealed again with the new data.
+func appendEncrypted(dataPath string, encryption *FileEncryption, size int64, data []byte) error {
+	aead, err := encryption.cipher()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	chunkSize := int64(encryption.ChunkSize)
+	index := size / chunkSize
+	offset := index * (chunkSize + chunkOverhead)
+	if partial := size % chunkSize; partial > 0 {
+		sealed := make([]byte, partial+chunkOverhead)
+		_, err = file.ReadAt(sealed, offset)
+		if err != nil {
+			return err
+		}
+		plaintext, err := openWith(aead, sealed, chunkAdditionalData(index))
+		if err != nil {
+			return err
+		}
+		data = append(plaintext, data...)
+	}
+
+	var buffer bytes.Buffer
+	for ; len(data) > 0; index++ {
+		n := min(int64(len(data)), chunkSize)
+		sealed, err := sealWith(aead, data[:n], chunkAdditionalData(index))
+		if err != nil {
+			return err
+		}
+		buffer.Write(sealed)
+		data = data[n:]
+	}
+	_, err = file.WriteAt(buffer.Bytes(), offset)
+	if err != nil {
+		return err
+	}
+	return file.Truncate(offset + int64(buffer.Len()))
+}
+
+// decryptingReader reads an encrypted file, decrypting the chunk holding the read position
+type decryptingReader struct {
+	file      *os.File
+	aead      cipher.AEAD
+	chunkSize int64
+	size      int64
+	position  int64
+	// Last decrypted chunk
+	chunkIndex int64
+	chunk      []byte
+}
+
+func newDecryptingReader(file *os.File, encryption *FileEncryption, size int64) (*decryptingReader, error) {
+	aead, err := encryption.cipher()
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{file: file, aead: aead, chunkSize: int64(encryption.ChunkSize), size: size, chunkIndex: -1}, nil
+}
+
+func (reader *decryptingReader) Size() int64 { return reader.size }
+
+func (reader *decryptingReader) loadChunk(index int64) error {
+	if index == reader.chunkIndex {
+		return nil
+	}
+	length := min(reader.chunkSize, reader.size-index*reader.chunkSize)
+	sealed := make([]byte, length+chunkOverhead)
+	_, err := reader.file.ReadAt(sealed, index*(reader.chunkSize+chunkOverhead))
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	reader.chunk, err = openWith(reader.aead, sealed, chunkAdditionalData(index))
+	if err != nil {
+		return fmt.Errorf("decrypting chunk %v: %w", index, err)
+	}
+	reader.chunkIndex = index
+	return nil
+}
+
+func (reader *decryptingReader) Read(p []byte) (int, error) {
+	if reader.position >= reader.size {
+		return 0, io.EOF
+	}
+	index := reader.position / reader.chunkSize
+	err := reader.loadChunk(index)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, reader.chunk[reader.position-index*reader.chunkSize:])
+	reader.position += int64(n)
+	return n, nil
+}
+
+func (reader *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += reader.position
+	case io.SeekEnd:
+		offset += reader.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	reader.position = offset
+	return offset, nil
+}
+
+func (reader *decryptingReader) Close() error {
+	return reader.file.Close()
+}
+
+// RotationReport summarizes a master key rotation
+type RotationReport struct {
+	KeyID     string   `json:"keyID"`
+	Rewrapped int      `json:"rewrapped"`
+	Unchanged int      `json:"unchanged"`
+	Failed    []string `json:"failed,omitempty"`
+}
+
+// RotateKeys wraps the data key of every encrypted file not yet wrapped with the current
+// master key with it. File data is left untouched. It fails with ErrStoreBusy when run
+// while the server holds the store.
+func (store OsFileSystem) RotateKeys() (RotationReport, error) {
+	err := AcquireStore()
+	if err != nil {
+		return RotationReport{}, err
+	}
+	lockStore()
+	defer lock.Unlock()
+
+	if keyring.current == nil {
+		return RotationReport{}, ErrNoMasterKey
+	}
+	report := RotationReport{KeyID: keyring.current.id}
+	root := config.AppConfig.StoreConfig.Root
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, ok := fileSidecarName(entry.Name())
+		if entry.IsDir() || !ok {
+			return nil
+		}
+		filePath, err := entryPath(filepath.Join(filepath.Dir(path), name))
+		if err != nil {
+			return err
+		}
+
+		fileInfo, err := store.readFileInfo(filePath)
+		if err == nil && (fileInfo.Encryption == nil || fileInfo.Encryption.KeyID == keyring.current.id) {
+			report.Unchanged++
+			return nil
+		}
+		if err == nil {
+			err = fileInfo.Encryption.rewrap()
+		}
+		if err == nil {
+			err = store.writeFileInfo(filePath, &fileInfo)
+		}
+		if err != nil {
+			config.Log.Error("Error rotating file key", "op", "RotateKeys", "path", filePath.Path, "error", err)
+			report.Failed = append(report.Failed, filePath.Path)
+			return nil
+		}
+		report.Rewrapped++
+		return nil
+	})
+	return report, err
+}
+
+// String formats the report as JSON
+func (report RotationReport) String() string {
+	data, _ := json.MarshalIndent(report, "", "  ")
+	return string(data)
+}
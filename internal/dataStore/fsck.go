@@ -0,0 +1,414 @@
+package dataStore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// Fsck checks the metadata of the store against its data. In repair mode metadata is rebuilt
+// from the data, and what can't be (orphaned sidecars, uploads left open) is moved to the
+// quarantine directory of the root rather than deleted, to be inspected by an admin.
+//
+// The info of files without one is rebuilt assuming unencrypted data. With encryption enabled
+// such files are quarantined instead, as the key of their data was in the info.
+
+// Name of the directory of the store root holding what fsck quarantined
+const quarantineName = "__quarantine__"
+
+// Problems found by Fsck
+const (
+	ProblemMissingInfo             = "missing_info"
+	ProblemUnreadableInfo          = "unreadable_info"
+	ProblemOrphanedInfo            = "orphaned_info"
+	ProblemMissingDirectoryInfo    = "missing_directory_info"
+	ProblemUnreadableDirectoryInfo = "unreadable_directory_info"
+	ProblemSizeMismatch            = "size_mismatch"
+	ProblemChecksumMismatch        = "checksum_mismatch"
+	ProblemUnreadableData          = "unreadable_data"
+	ProblemOpenUpload              = "open_upload"
+)
+
+// FsckOptions sets what Fsck does
+type FsckOptions struct {
+	Repair bool
+	// Tells whether an upload is in progress on path, such uploads aren't left open. Nil
+	// when the server isn't running.
+	UploadActive func(path string) bool
+}
+
+// FsckFinding is a problem found, and what was done about it in repair mode
+type FsckFinding struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+	// Repair done: "rebuilt_info", "rebuilt_directory_info", "quarantined"...
+	Repair      string `json:"repair,omitempty"`
+	Repaired    bool   `json:"repaired"`
+	RepairError string `json:"repair_error,omitempty"`
+}
+
+// FsckReport lists the problems found by Fsck
+type FsckReport struct {
+	Repair      bool          `json:"repair"`
+	Directories int           `json:"directories"`
+	Files       int           `json:"files"`
+	Bytes       int64         `json:"bytes"`
+	Findings    []FsckFinding `json:"findings"`
+	// Problems left, not repaired
+	Unrepaired int `json:"unrepaired"`
+	// Directory of the store quarantined entries were moved to, if any
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// String formats the report as JSON
+func (report FsckReport) String() string {
+	data, _ := json.MarshalIndent(report, "", "  ")
+	return string(data)
+}
+
+// fsckRun holds the state of a Fsck
+type fsckRun struct {
+	store      OsFileSystem
+	options    FsckOptions
+	report     *FsckReport
+	quarantine storePath
+}
+
+// Fsck scans the whole store for inconsistencies between metadata and data, repairing them
+// when asked to
+func (store OsFileSystem) Fsck(ctx context.Context, options FsckOptions) (FsckReport, error) {
+	report := FsckReport{Repair: options.Repair, Findings: []FsckFinding{}}
+	if options.Repair {
+		// Repairs hold the lock file of the store so no other process changes it meanwhile,
+		// they run as a job of the server or with the server stopped. A check only run
+		// takes no lock: run beside a server it may report uploads in progress as left open
+		// and files deleted while checked as missing.
+		err := AcquireStore()
+		if err != nil {
+			return report, err
+		}
+	}
+	root, err := resolvePath("/")
+	if err != nil {
+		return report, err
+	}
+	run := fsckRun{
+		store:      store,
+		options:    options,
+		report:     &report,
+		quarantine: root.child(quarantineName).child(time.Now().UTC().Format(quarantineRunFormat)),
+	}
+
+	err = store.walkStore(ctx, root, func(entry storeEntry) error {
+		if entry.isDir {
+			report.Directories++
+			run.checkDirectory(entry)
+			return nil
+		}
+		report.Files++
+		run.checkFile(entry)
+		return nil
+	})
+	for _, finding := range report.Findings {
+		if !finding.Repaired {
+			report.Unrepaired++
+		}
+	}
+	return report, err
+}
+
+// quarantineRunFormat names the quarantine directory of each run by its time
+const quarantineRunFormat = "20060102T150405"
+
+// found records a problem of path. In repair mode repair is run and returns the repair done.
+func (run *fsckRun) found(path string, problem string, detail string, repair func() (string, error)) {
+	run.store.log().Warn("Fsck found a problem", "op", "Fsck", "path", path, "problem", problem, "detail", detail)
+	finding := FsckFinding{Path: path, Problem: problem, Detail: detail}
+	if run.options.Repair && repair != nil {
+		var err error
+		finding.Repair, err = repair()
+		if err != nil {
+			finding.RepairError = err.Error()
+		} else {
+			finding.Repaired = true
+			run.store.log().Info("Fsck repaired a problem", "op", "Fsck", "path", path, "problem", problem, "repair", finding.Repair)
+		}
+	}
+	run.report.Findings = append(run.report.Findings, finding)
+}
+
+func (run *fsckRun) checkDirectory(entry storeEntry) {
+	dir := entry.path
+	rebuild := func() (string, error) {
+		lockStore()
+		defer lock.Unlock()
+		if _, err := run.store.readDirectoryInfo(dir); err == nil {
+			return "", errors.New("repaired concurrently")
+		}
+		if entry.hasInfo {
+			err := run.quarantineFile(dir.directoryInfoPath())
+			if err != nil {
+				return "", err
+			}
+		}
+		_, err := run.store.loadDirectoryInfo(dir)
+		return "rebuilt_directory_info", err
+	}
+
+	if !entry.hasInfo {
+		run.found(dir.Path, ProblemMissingDirectoryInfo, "", rebuild)
+		return
+	}
+	_, err := run.store.readDirectoryInfo(dir)
+	if err != nil {
+		run.found(dir.Path, ProblemUnreadableDirectoryInfo, err.Error(), rebuild)
+	}
+}
+
+func (run *fsckRun) checkFile(entry storeEntry) {
+	file := entry.path
+	if !entry.hasInfo {
+		if stat, err := os.Stat(file.OSPath); err == nil {
+			run.report.Bytes += stat.Size()
+		}
+		run.found(file.Path, ProblemMissingInfo, "", func() (string, error) { return run.rebuildFileInfo(file, false) })
+		return
+	}
+	fileInfo, err := run.store.readFileInfo(file)
+	if err != nil {
+		if entry.hasData {
+			run.found(file.Path, ProblemUnreadableInfo, err.Error(), func() (string, error) { return run.rebuildFileInfo(file, true) })
+		} else {
+			run.found(file.Path, ProblemOrphanedInfo, "unreadable info: "+err.Error(), func() (string, error) { return run.quarantineEntry(file, false) })
+		}
+		return
+	}
+
+	if fileInfo.MD5sum == "" {
+		if run.options.UploadActive != nil && run.options.UploadActive(file.Path) {
+			return
+		}
+		run.found(file.Path, ProblemOpenUpload, "upload started "+fileInfo.LastModified.Format(time.RFC3339)+" never completed",
+			func() (string, error) { return run.quarantineEntry(file, true) })
+		return
+	}
+
+	storedSize := fileInfo.Size
+	if fileInfo.Encryption != nil {
+		storedSize = fileInfo.Encryption.storedSize(fileInfo.Size)
+	}
+	if !entry.hasData {
+		if storedSize != 0 {
+			run.found(file.Path, ProblemOrphanedInfo, "no data", func() (string, error) { return run.quarantineEntry(file, false) })
+		}
+		return
+	}
+	stat, err := os.Stat(file.OSPath)
+	if err != nil {
+		run.found(file.Path, ProblemUnreadableData, err.Error(), nil)
+		return
+	}
+	run.report.Bytes += stat.Size()
+	if stat.Size() != storedSize {
+		detail := fmt.Sprintf("data holds %d bytes, info expects %d", stat.Size(), storedSize)
+		var repair func() (string, error)
+		// The size of encrypted data can't be trusted
+		if fileInfo.Encryption == nil {
+			repair = func() (string, error) { return run.updateFileInfo(file) }
+		}
+		run.found(file.Path, ProblemSizeMismatch, detail, repair)
+		return
+	}
+	if storedSize == 0 {
+		return
+	}
+	checksum, err := run.store.fileChecksum(file.Path)
+	if err != nil {
+		run.found(file.Path, ProblemUnreadableData, err.Error(), nil)
+	} else if checksum != fileInfo.MD5sum {
+		run.found(file.Path, ProblemChecksumMismatch, "data MD5 "+checksum+", info "+fileInfo.MD5sum,
+			func() (string, error) { return run.updateFileInfo(file) })
+	}
+}
+
+// rawChecksum returns the MD5 of the data stored at osPath as is, and its state once read
+func rawChecksum(osPath string) (string, os.FileInfo, error) {
+	file, err := os.Open(osPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	hash := md5.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), stat, nil
+}
+
+// unchanged tells whether the data at osPath is still as when checksummed
+func unchanged(osPath string, checksummed os.FileInfo) bool {
+	stat, err := os.Stat(osPath)
+	return err == nil && stat.Size() == checksummed.Size() && stat.ModTime().Equal(checksummed.ModTime())
+}
+
+var errConcurrentChange = errors.New("changed while checking, not repaired")
+
+// rebuildFileInfo writes the info of file from its data, moving its unreadable info to the
+// quarantine first if any. With encryption enabled the file is quarantined instead.
+func (run *fsckRun) rebuildFileInfo(file storePath, unreadableInfo bool) (string, error) {
+	if config.AppConfig.StoreConfig.Encryption.Enabled {
+		return run.quarantineData(file, unreadableInfo)
+	}
+	checksum, stat, err := rawChecksum(file.OSPath)
+	if err != nil {
+		return "", err
+	}
+
+	lockStore()
+	defer lock.Unlock()
+	_, err = run.store.readFileInfo(file)
+	if err == nil || (!unreadableInfo && !errors.Is(err, os.ErrNotExist)) || !unchanged(file.OSPath, stat) {
+		return "", errConcurrentChange
+	}
+	if unreadableInfo {
+		err = run.quarantineFile(file.fileInfoPath())
+		if err != nil {
+			return "", err
+		}
+	}
+	key := strings.TrimPrefix(file.Path, "/")
+	fileInfo := FileInfo{
+		Name:         key,
+		Key:          key,
+		LastModified: stat.ModTime().UTC(),
+		Size:         stat.Size(),
+		UploadID:     uuid.New().String(),
+		MD5sum:       checksum,
+	}
+	return "rebuilt_info", run.store.writeFileInfo(file, &fileInfo)
+}
+
+// updateFileInfo sets the size and checksum of the info of file to those of its data
+func (run *fsckRun) updateFileInfo(file storePath) (string, error) {
+	stat, err := os.Stat(file.OSPath)
+	if err != nil {
+		return "", err
+	}
+	checksum, err := run.store.fileChecksum(file.Path)
+	if err != nil {
+		return "", err
+	}
+
+	lockStore()
+	defer lock.Unlock()
+	fileInfo, err := run.store.readFileInfo(file)
+	if err != nil || fileInfo.MD5sum == "" || !unchanged(file.OSPath, stat) {
+		return "", errConcurrentChange
+	}
+	if fileInfo.Encryption == nil {
+		fileInfo.Size = stat.Size()
+	}
+	fileInfo.MD5sum = checksum
+	return "updated_info", run.store.writeFileInfo(file, &fileInfo)
+}
+
+// quarantineEntry moves the info of file to the quarantine, with its data if it's an upload
+// left open
+func (run *fsckRun) quarantineEntry(file storePath, openUpload bool) (string, error) {
+	lockStore()
+	defer lock.Unlock()
+	fileInfo, err := run.store.readFileInfo(file)
+	stat, statErr := os.Stat(file.OSPath)
+	if openUpload {
+		active := run.options.UploadActive != nil && run.options.UploadActive(file.Path)
+		if err != nil || fileInfo.MD5sum != "" || active {
+			return "", errConcurrentChange
+		}
+	} else if statErr == nil || (err == nil && fileInfo.MD5sum == "") {
+		return "", errConcurrentChange
+	}
+
+	err = run.quarantineFile(file.fileInfoPath())
+	if err != nil {
+		return "", err
+	}
+	var removedBytes int64
+	if statErr == nil {
+		err = run.quarantineFile(file.OSPath)
+		if err != nil {
+			return "", err
+		}
+		removedBytes = stat.Size()
+	}
+	err = run.store.updateDirectoryStats(file, -removedBytes, -1)
+	if err != nil {
+		run.store.log().Error("Error updating directory stats", "op", "Fsck", "path", file.Path, "error", err)
+	}
+	return "quarantined", nil
+}
+
+// quarantineData moves the data of file without info to the quarantine, along with its
+// unreadable info if any
+func (run *fsckRun) quarantineData(file storePath, unreadableInfo bool) (string, error) {
+	lockStore()
+	defer lock.Unlock()
+	_, err := run.store.readFileInfo(file)
+	stat, statErr := os.Stat(file.OSPath)
+	if err == nil || (!unreadableInfo && !errors.Is(err, os.ErrNotExist)) || statErr != nil {
+		return "", errConcurrentChange
+	}
+
+	if unreadableInfo {
+		err = run.quarantineFile(file.fileInfoPath())
+		if err != nil {
+			return "", err
+		}
+	}
+	err = run.quarantineFile(file.OSPath)
+	if err != nil {
+		return "", err
+	}
+	err = run.store.updateDirectoryStats(file, -stat.Size(), -1)
+	if err != nil {
+		run.store.log().Error("Error updating directory stats", "op", "Fsck", "path", file.Path, "error", err)
+	}
+	return "quarantined", nil
+}
+
+// quarantineFile moves the file at osPath to the same relative location in the quarantine
+// directory of this run
+func (run *fsckRun) quarantineFile(osPath string) error {
+	root := filepath.Dir(filepath.Dir(run.quarantine.OSPath))
+	relative, err := filepath.Rel(root, osPath)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(run.quarantine.OSPath, relative)
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(osPath, target)
+	if err != nil {
+		return err
+	}
+	run.report.Quarantine = run.quarantine.Path
+	return nil
+}
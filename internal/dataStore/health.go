@@ -0,0 +1,121 @@
+package dataStore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// HealthCheck is the result of a check of the store
+type HealthCheck struct {
+	Name    string           `json:"name"`
+	OK      bool             `json:"ok"`
+	Message string           `json:"message,omitempty"`
+	Details map[string]int64 `json:"details,omitempty"`
+}
+
+// Name of the directory of the store root the write probes are made in, reserved so it's
+// neither served nor walked
+const healthDirName = "__health__"
+
+// CheckReadiness checks the store can serve requests: its root is writable, the free
+// space of its filesystem is above minFreeBytes and minFreePercent (zero disables each
+// threshold) and the metadata of the root is readable. The checks left once ctx is done
+// are reported as a single failed one.
+func (store OsFileSystem) CheckReadiness(ctx context.Context, minFreeBytes int64, minFreePercent float64) []HealthCheck {
+	root, err := resolvePath("/")
+	if err != nil {
+		return []HealthCheck{{Name: "root", Message: err.Error()}}
+	}
+	var checks []HealthCheck
+	for _, check := range []func() HealthCheck{
+		func() HealthCheck { return checkWritable(root) },
+		func() HealthCheck { return checkFreeSpace(root, minFreeBytes, minFreePercent) },
+		func() HealthCheck { return store.checkMetadata(root) },
+	} {
+		if ctx.Err() != nil {
+			return append(checks, HealthCheck{Name: "store", Message: "checks interrupted: " + ctx.Err().Error()})
+		}
+		checks = append(checks, check())
+	}
+	return checks
+}
+
+// checkWritable writes and removes a file in the health directory of the root
+func checkWritable(root storePath) HealthCheck {
+	check := HealthCheck{Name: "root_writable"}
+	dir := root.child(healthDirName).OSPath
+	err := os.Mkdir(dir, 0755)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		check.Message = err.Error()
+		return check
+	}
+	file, err := os.CreateTemp(dir, "probe-*")
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write([]byte("ok"))
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+func checkFreeSpace(root storePath, minFreeBytes int64, minFreePercent float64) HealthCheck {
+	check := HealthCheck{Name: "free_space"}
+	free, total, err := diskSpace(root.OSPath)
+	if errors.Is(err, errors.ErrUnsupported) {
+		// Not knowing the free space doesn't make the store unusable
+		check.OK = true
+		check.Message = "free space unknown on this platform"
+		return check
+	}
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	check.Details = map[string]int64{
+		"free_bytes":     free,
+		"total_bytes":    total,
+		"min_free_bytes": minFreeBytes,
+	}
+	switch {
+	case minFreeBytes > 0 && free < minFreeBytes:
+		check.Message = fmt.Sprintf("%d bytes free, below %d", free, minFreeBytes)
+	case minFreePercent > 0 && total > 0 && float64(free)*100 < minFreePercent*float64(total):
+		check.Message = fmt.Sprintf("%.1f%% free, below %v%%", float64(free)*100/float64(total), minFreePercent)
+	default:
+		check.OK = true
+	}
+	return check
+}
+
+// checkMetadata reads the info of the root, which doesn't exist until statistics are first
+// computed, and lists the root
+func (store OsFileSystem) checkMetadata(root storePath) HealthCheck {
+	check := HealthCheck{Name: "metadata_readable"}
+	_, err := store.readDirectoryInfo(root)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		check.Message = err.Error()
+		return check
+	}
+	_, err = os.ReadDir(root.OSPath)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	check.OK = true
+	return check
+}
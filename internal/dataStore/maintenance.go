@@ -0,0 +1,310 @@
+package dataStore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Maintenance jobs walk the whole store on disk. They take the store lock per file only, so
+// requests keep being served while they run.
+
+// storeEntry is a file or directory of the store as found on disk. A file is known from its
+// data file, its info sidecar or both.
+type storeEntry struct {
+	path    storePath
+	isDir   bool
+	hasData bool
+	hasInfo bool
+}
+
+// walkStore calls fn on dir and every entry under it, directories before their content.
+// Walking stops on the first error of fn or when ctx is canceled.
+func (store OsFileSystem) walkStore(ctx context.Context, dir storePath, fn func(storeEntry) error) error {
+	entries, err := os.ReadDir(dir.OSPath)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]*storeEntry)
+	fileOf := func(name string) *storeEntry {
+		if files[name] == nil {
+			files[name] = &storeEntry{path: dir.child(name)}
+		}
+		return files[name]
+	}
+	dirEntry := storeEntry{path: dir, isDir: true}
+	var subdirectories []string
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+			// Reserved directories (the quarantine) aren't part of the store content
+			if !isReservedName(name) {
+				subdirectories = append(subdirectories, name)
+			}
+		case name == directoryInfoName:
+			dirEntry.hasInfo = true
+		case isReservedName(name):
+			if file, ok := fileSidecarName(name); ok {
+				fileOf(file).hasInfo = true
+			}
+		default:
+			fileOf(name).hasData = true
+		}
+	}
+
+	err = fn(dirEntry)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = fn(*files[name])
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range subdirectories {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = store.walkStore(ctx, dir.child(name), fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GCReport lists what the garbage collection removed, or would remove in a dry run
+type GCReport struct {
+	DryRun bool `json:"dry_run"`
+	// Uploads never completed nor written to for the grace period
+	AbandonedUploads []string `json:"abandoned_uploads"`
+	// Leftovers of the readiness checks, in the health directory
+	TempFiles  []string          `json:"temp_files"`
+	BytesFreed int64             `json:"bytes_freed"`
+	Failures   map[string]string `json:"failures,omitempty"`
+}
+
+func (report *GCReport) addFailure(path string, err error) {
+	if report.Failures == nil {
+		report.Failures = make(map[string]string)
+	}
+	report.Failures[path] = err.Error()
+}
+
+// tempFilesGracePeriod keeps the files of readiness checks running from being collected
+const tempFilesGracePeriod = time.Hour
+
+// GCOptions sets what GC collects
+type GCOptions struct {
+	// List what would be collected without removing it
+	DryRun bool
+	// Uploads not written to for this duration are abandoned
+	GracePeriod time.Duration
+	// Tells whether an upload is in progress on path, such uploads aren't collected however
+	// long they've been idle. Nil when the server isn't running.
+	UploadActive func(path string) bool
+}
+
+// GC removes the uploads abandoned for the grace period, files whose info has no checksum as
+// it's only set once the upload completes, and the temporary files left behind in the root.
+// Unless a dry run, it fails with ErrStoreBusy when run while another process holds the store.
+func (store OsFileSystem) GC(ctx context.Context, options GCOptions) (GCReport, error) {
+	dryRun := options.DryRun
+	report := GCReport{DryRun: dryRun, AbandonedUploads: []string{}, TempFiles: []string{}}
+	if !dryRun {
+		// Keep a server on the same store from resuming the uploads being collected
+		err := AcquireStore()
+		if err != nil {
+			return report, err
+		}
+	}
+	root, err := resolvePath("/")
+	if err != nil {
+		return report, err
+	}
+
+	temporaries, _ := filepath.Glob(filepath.Join(root.child(healthDirName).OSPath, "probe-*"))
+	for _, temporary := range temporaries {
+		stat, err := os.Stat(temporary)
+		if err != nil || time.Since(stat.ModTime()) < tempFilesGracePeriod {
+			continue
+		}
+		name := healthDirName + "/" + filepath.Base(temporary)
+		report.TempFiles = append(report.TempFiles, name)
+		if !dryRun {
+			err = os.Remove(temporary)
+			if err != nil {
+				report.addFailure(name, err)
+			}
+		}
+	}
+
+	cutoff := time.Now().Add(-options.GracePeriod)
+	abandoned := func(file storePath) bool {
+		fileInfo, err := store.readFileInfo(file)
+		if err != nil || fileInfo.MD5sum != "" || fileInfo.LastModified.After(cutoff) {
+			return false
+		}
+		return options.UploadActive == nil || !options.UploadActive(file.Path)
+	}
+	err = store.walkStore(ctx, root, func(entry storeEntry) error {
+		if entry.isDir || !entry.hasInfo || !abandoned(entry.path) {
+			return nil
+		}
+
+		var size int64
+		if stat, err := os.Stat(entry.path.OSPath); err == nil {
+			size = stat.Size()
+		}
+		if !dryRun {
+			// The upload may have been resumed or completed since it was found
+			var err error
+			lockStore()
+			collected := abandoned(entry.path)
+			if collected {
+				err = store.deleteFile(entry.path)
+			}
+			lock.Unlock()
+			if !collected {
+				return nil
+			}
+			if err != nil {
+				report.addFailure(entry.path.Path, err)
+				return nil
+			}
+		}
+		store.log().Info("Abandoned upload collected", "op", "GC", "path", entry.path.Path, "dry_run", dryRun)
+		report.AbandonedUploads = append(report.AbandonedUploads, entry.path.Path)
+		report.BytesFreed += size
+		return nil
+	})
+	return report, err
+}
+
+// ScrubReport lists the problems found checking the content of the store
+type ScrubReport struct {
+	Directories int           `json:"directories"`
+	Files       int           `json:"files"`
+	Bytes       int64         `json:"bytes"`
+	Problems    []ScrubResult `json:"problems"`
+}
+
+type ScrubResult struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+// Scrub reads every completed file of the store and checks its size and checksum against its
+// info, decrypting encrypted files which also authenticates them. Nothing is changed.
+func (store OsFileSystem) Scrub(ctx context.Context) (ScrubReport, error) {
+	report := ScrubReport{Problems: []ScrubResult{}}
+	root, err := resolvePath("/")
+	if err != nil {
+		return report, err
+	}
+	problem := func(path string, description string) {
+		store.log().Warn("Scrub found a problem", "op", "Scrub", "path", path, "problem", description)
+		report.Problems = append(report.Problems, ScrubResult{Path: path, Problem: description})
+	}
+
+	err = store.walkStore(ctx, root, func(entry storeEntry) error {
+		if entry.isDir {
+			report.Directories++
+			if entry.hasInfo {
+				_, err := store.readDirectoryInfo(entry.path)
+				if err != nil {
+					problem(entry.path.Path, "unreadable directory info: "+err.Error())
+				}
+			}
+			return nil
+		}
+
+		report.Files++
+		if !entry.hasInfo {
+			problem(entry.path.Path, "no file info")
+			return nil
+		}
+		fileInfo, err := store.readFileInfo(entry.path)
+		if err != nil {
+			problem(entry.path.Path, "unreadable file info: "+err.Error())
+			return nil
+		}
+		// Uploads in progress are still changing
+		if fileInfo.MD5sum == "" {
+			return nil
+		}
+
+		storedSize := fileInfo.Size
+		if fileInfo.Encryption != nil {
+			storedSize = fileInfo.Encryption.storedSize(fileInfo.Size)
+		}
+		var actualSize int64
+		if stat, err := os.Stat(entry.path.OSPath); err == nil {
+			actualSize = stat.Size()
+		} else if !os.IsNotExist(err) || storedSize != 0 {
+			problem(entry.path.Path, "missing data")
+			return nil
+		}
+		if actualSize != storedSize {
+			problem(entry.path.Path, fmt.Sprintf("size mismatch: %d bytes stored, %d expected", actualSize, storedSize))
+			return nil
+		}
+		if storedSize == 0 {
+			return nil
+		}
+
+		checksum, err := store.fileChecksum(entry.path.Path)
+		report.Bytes += fileInfo.Size
+		if err != nil {
+			problem(entry.path.Path, "unreadable data: "+err.Error())
+		} else if checksum != fileInfo.MD5sum {
+			problem(entry.path.Path, "checksum mismatch")
+		}
+		return nil
+	})
+	return report, err
+}
+
+// fileChecksum returns the MD5 of the content of filePath, as recorded in its info
+func (store OsFileSystem) fileChecksum(filePath string) (string, error) {
+	reader, err := store.OpenFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	hash := md5.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// String formats the report as JSON
+func (report GCReport) String() string {
+	data, _ := json.MarshalIndent(report, "", "  ")
+	return string(data)
+}
+
+// String formats the report as JSON
+func (report ScrubReport) String() string {
+	data, _ := json.MarshalIndent(report, "", "  ")
+	return string(data)
+}
@@ -0,0 +1,133 @@
+package dataStore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/rkachach/hss/internal/metrics"
+)
+
+var (
+	lockWaitSeconds = metrics.NewHistogramVec("hss_store_lock_wait_seconds",
+		"Time spent waiting for the store lock.",
+		[]float64{.00001, .0001, .001, .01, .1, 1, 10})
+	storeErrors = metrics.NewCounterVec("hss_store_errors_total",
+		"DataStore operations failed, by operation and error type.", "operation", "type")
+)
+
+// lockStore takes the store lock, accounting the time waited for it
+func lockStore() {
+	start := time.Now()
+	lock.Lock()
+	lockWaitSeconds.Observe(time.Since(start).Seconds())
+}
+
+// ErrorType classifies a DataStore error for metrics
+func ErrorType(err error) string {
+	var quotaErr *QuotaError
+	switch {
+	case errors.As(err, &quotaErr):
+		return "quota"
+	case errors.Is(err, ErrInvalidPath), errors.Is(err, ErrReservedName), errors.Is(err, ErrPathEscape):
+		return "invalid_path"
+	case errors.Is(err, ErrDirectoryNotFound), errors.Is(err, os.ErrNotExist):
+		return "not_found"
+	case errors.Is(err, ErrDirectoryNotEmpty):
+		return "not_empty"
+	case errors.Is(err, ErrDeleteRoot):
+		return "delete_root"
+	case errors.Is(err, ErrPartialDelete):
+		return "partial_delete"
+	case errors.Is(err, ErrNoMasterKey), errors.Is(err, ErrUnknownMasterKey):
+		return "encryption"
+	}
+	return "other"
+}
+
+// instrumentedStore counts the errors of the DataStore it wraps
+type instrumentedStore struct {
+	DataStore
+}
+
+// Instrumented wraps store to expose its errors as metrics
+func Instrumented(store DataStore) DataStore {
+	return instrumentedStore{DataStore: store}
+}
+
+func (store instrumentedStore) WithContext(ctx context.Context) DataStore {
+	return instrumentedStore{DataStore: store.DataStore.WithContext(ctx)}
+}
+
+func countError(operation string, err error) {
+	if err != nil {
+		storeErrors.Inc(operation, ErrorType(err))
+	}
+}
+
+func (store instrumentedStore) StartFileUpload(filePath string, userMetadata map[string]string) (FileInfo, error) {
+	fileInfo, err := store.DataStore.StartFileUpload(filePath, userMetadata)
+	countError("StartFileUpload", err)
+	return fileInfo, err
+}
+
+func (store instrumentedStore) ReadFileInfo(filePath string) (FileInfo, error) {
+	fileInfo, err := store.DataStore.ReadFileInfo(filePath)
+	countError("ReadFileInfo", err)
+	return fileInfo, err
+}
+
+func (store instrumentedStore) WriteFilePart(filePath string, objectPartData []byte, partNumber int) (FileInfo, error) {
+	fileInfo, err := store.DataStore.WriteFilePart(filePath, objectPartData, partNumber)
+	countError("WriteFilePart", err)
+	return fileInfo, err
+}
+
+func (store instrumentedStore) ReadFile(filePath string) ([]byte, error) {
+	data, err := store.DataStore.ReadFile(filePath)
+	countError("ReadFile", err)
+	return data, err
+}
+
+func (store instrumentedStore) OpenFile(filePath string) (FileReader, error) {
+	reader, err := store.DataStore.OpenFile(filePath)
+	countError("OpenFile", err)
+	return reader, err
+}
+
+func (store instrumentedStore) DeleteFile(filePath string) error {
+	err := store.DataStore.DeleteFile(filePath)
+	countError("DeleteFile", err)
+	return err
+}
+
+func (store instrumentedStore) UpdateFileInfo(filePath string, fileInfo FileInfo) error {
+	err := store.DataStore.UpdateFileInfo(filePath, fileInfo)
+	countError("UpdateFileInfo", err)
+	return err
+}
+
+func (store instrumentedStore) CreateDirectory(relativeDirPath string, userMetadata map[string]string) error {
+	err := store.DataStore.CreateDirectory(relativeDirPath, userMetadata)
+	countError("CreateDirectory", err)
+	return err
+}
+
+func (store instrumentedStore) GetDirectoryInfo(relativeDirPath string) (DirectoryInfo, error) {
+	dirInfo, err := store.DataStore.GetDirectoryInfo(relativeDirPath)
+	countError("GetDirectoryInfo", err)
+	return dirInfo, err
+}
+
+func (store instrumentedStore) DeleteDirectory(relativeDirPath string, options DeleteDirectoryOptions) (DeleteDirectoryReport, error) {
+	report, err := store.DataStore.DeleteDirectory(relativeDirPath, options)
+	countError("DeleteDirectory", err)
+	return report, err
+}
+
+func (store instrumentedStore) ListDirectory(relativeDirPath string) ([]ElementExtendedInfo, error) {
+	entries, err := store.DataStore.ListDirectory(relativeDirPath)
+	countError("ListDirectory", err)
+	return entries, err
+}
@@ -0,0 +1,141 @@
+package dataStore
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// Every OsFileSystem method turns the paths it's given into a storePath with resolvePath, so
+// user input never reaches the filesystem unchecked: paths are normalized under the store
+// root, ".." elements, NUL bytes and names reserved for the store metadata are rejected, and
+// symlinks leading out of the root are refused.
+
+var (
+	ErrInvalidPath  = errors.New("invalid path")
+	ErrReservedName = errors.New("name reserved for the store metadata")
+	ErrPathEscape   = errors.New("path escapes the store root")
+)
+
+// Name of the info sidecar of every directory
+const directoryInfoName = "__info__.json"
+
+// isReservedName tells whether name is kept for the store metadata: names of the form
+// __*__ and __*__.json, such as the file and directory info sidecars
+func isReservedName(name string) bool {
+	name = strings.TrimSuffix(name, ".json")
+	return len(name) >= 4 && strings.HasPrefix(name, "__") && strings.HasSuffix(name, "__")
+}
+
+// storePath is a path validated to lie within the store
+type storePath struct {
+	// Clean "/"-rooted path, as seen by clients
+	Path string
+	// Location on disk
+	OSPath string
+}
+
+func (p storePath) isRoot() bool {
+	return p.Path == "/"
+}
+
+func (p storePath) parent() storePath {
+	return storePath{Path: path.Dir(p.Path), OSPath: filepath.Dir(p.OSPath)}
+}
+
+func (p storePath) child(name string) storePath {
+	return storePath{Path: path.Join(p.Path, name), OSPath: filepath.Join(p.OSPath, name)}
+}
+
+// fileInfoPath is the location of the info sidecar of the file at p
+func (p storePath) fileInfoPath() string {
+	return filepath.Join(filepath.Dir(p.OSPath), "__"+filepath.Base(p.OSPath)+"__.json")
+}
+
+// directoryInfoPath is the location of the info sidecar of the directory at p
+func (p storePath) directoryInfoPath() string {
+	return filepath.Join(p.OSPath, directoryInfoName)
+}
+
+// resolvePath validates userPath and returns where it lies in the store
+func resolvePath(userPath string) (storePath, error) {
+	if strings.ContainsRune(userPath, 0) {
+		return storePath{}, ErrInvalidPath
+	}
+	for _, element := range strings.Split(userPath, "/") {
+		if element == ".." {
+			return storePath{}, ErrInvalidPath
+		}
+		if isReservedName(element) {
+			return storePath{}, ErrReservedName
+		}
+	}
+
+	root := config.AppConfig.StoreConfig.Root
+	clean := path.Clean("/" + userPath)
+	resolved := storePath{Path: clean, OSPath: filepath.Join(root, filepath.FromSlash(clean))}
+	err := checkSymlinks(root, clean)
+	if err != nil {
+		return storePath{}, err
+	}
+	return resolved, nil
+}
+
+// resolveFilePath is resolvePath for files, which can't be the root
+func resolveFilePath(userPath string) (storePath, error) {
+	resolved, err := resolvePath(userPath)
+	if err == nil && resolved.isRoot() {
+		return storePath{}, ErrInvalidPath
+	}
+	return resolved, err
+}
+
+// entryPath returns the storePath of osPath, found on disk under the store root
+func entryPath(osPath string) (storePath, error) {
+	relative, err := filepath.Rel(config.AppConfig.StoreConfig.Root, osPath)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+		return storePath{}, ErrPathEscape
+	}
+	return storePath{Path: path.Clean("/" + filepath.ToSlash(relative)), OSPath: osPath}, nil
+}
+
+// checkSymlinks walks the existing elements of clean under root and fails if any of them is
+// a symlink resolving outside of root
+func checkSymlinks(root string, clean string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	current := root
+	for _, element := range strings.Split(strings.TrimPrefix(clean, "/"), "/") {
+		if element == "" {
+			continue
+		}
+		current = filepath.Join(current, element)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			// What doesn't exist yet can't lead anywhere
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			// A dangling link could be made to point anywhere by creating its target
+			return ErrPathEscape
+		}
+		relative, err := filepath.Rel(realRoot, target)
+		if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+			return ErrPathEscape
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package dataStore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+type DirectoryQuota struct {
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	MaxFiles int   `json:"max_files,omitempty"`
+}
+
+type QuotaError struct {
+	Key       string
+	QuotaPath string
+	Resource  string
+	Limit     int64
+	Usage     int64
+	Requested int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded for %s: %s quota on %s is %d, used %d, requested %d",
+		e.Key, e.Resource, e.QuotaPath, e.Limit, e.Usage, e.Requested)
+}
+
+// normalizeStorePath turns a user supplied path into a clean "/"-rooted path
+func normalizeStorePath(path string) string {
+	return filepath.Clean("/" + path)
+}
+
+// quotasFor returns the configured quotas applying to entries stored in dirPath,
+// that is quotas set on dirPath itself or on any of its parents
+func quotasFor(dirPath string) []config.QuotaConfig {
+	dirPath = normalizeStorePath(dirPath)
+	var quotas []config.QuotaConfig
+	for _, quota := range config.Current().StoreConfig.Quotas {
+		quotaPath := normalizeStorePath(quota.Path)
+		if quotaPath == "/" || dirPath == quotaPath || strings.HasPrefix(dirPath, quotaPath+"/") {
+			quotas = append(quotas, quota)
+		}
+	}
+	return quotas
+}
+
+// quotaOf returns the quota configured exactly on dirPath, if any
+func quotaOf(dirPath string) *DirectoryQuota {
+	dirPath = normalizeStorePath(dirPath)
+	for _, quota := range config.Current().StoreConfig.Quotas {
+		if normalizeStorePath(quota.Path) == dirPath {
+			return &DirectoryQuota{MaxBytes: quota.MaxBytes, MaxFiles: quota.MaxFiles}
+		}
+	}
+	return nil
+}
+
+// checkQuota verifies that adding newBytes and newFiles under the directory of filePath
+// keeps every applicable quota within its limits. Caller must hold the store lock.
+func (store OsFileSystem) checkQuota(filePath storePath, newBytes int64, newFiles int) error {
+	for _, quota := range quotasFor(filePath.parent().Path) {
+		if quota.MaxBytes <= 0 && quota.MaxFiles <= 0 {
+			continue
+		}
+		quotaPath, err := resolvePath(quota.Path)
+		if err != nil {
+			return err
+		}
+		dirInfo, err := store.loadDirectoryInfo(quotaPath)
+		if err != nil {
+			return err
+		}
+		size, filesCount := dirInfo.Size, dirInfo.FilesCount
+		if quota.MaxBytes > 0 && size+newBytes > quota.MaxBytes {
+			return &QuotaError{Key: filePath.Path, QuotaPath: quota.Path, Resource: "bytes",
+				Limit: quota.MaxBytes, Usage: size, Requested: newBytes}
+		}
+		if quota.MaxFiles > 0 && filesCount+newFiles > quota.MaxFiles {
+			return &QuotaError{Key: filePath.Path, QuotaPath: quota.Path, Resource: "files",
+				Limit: int64(quota.MaxFiles), Usage: int64(filesCount), Requested: int64(newFiles)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package dataStore
+
+import "github.com/rkachach/hss/cmd/config"
+
+// Shutdown waits for the metadata writes in progress and flushes the store to disk before the
+// server exits. The store is left locked, nothing can be written to it afterwards.
+func (store OsFileSystem) Shutdown() error {
+	lockStore()
+	store.log().Info("Flushing the store", "op", "Shutdown")
+	return syncFilesystem(config.AppConfig.StoreConfig.Root)
+}
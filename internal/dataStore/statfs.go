@@ -0,0 +1,38 @@
+//go:build linux || darwin || freebsd
+
+package dataStore
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// diskSpace returns the bytes available to unprivileged users and the size of the
+// filesystem holding path
+func diskSpace(path string) (int64, int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Blocks) * int64(stat.Bsize), nil
+}
+
+// syncFilesystem flushes the data written to the filesystems, that of path included
+func syncFilesystem(path string) error {
+	syscall.Sync()
+	return nil
+}
+
+// fileLocking tells whether lockFile excludes other processes on this platform
+const fileLocking = true
+
+// lockFile takes an exclusive lock on file, failing with ErrStoreBusy if another process holds it
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrStoreBusy
+	}
+	return err
+}
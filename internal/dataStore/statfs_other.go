@@ -0,0 +1,26 @@
+//go:build !linux && !darwin && !freebsd
+
+package dataStore
+
+import (
+	"errors"
+	"os"
+)
+
+// diskSpace isn't implemented on this platform
+func diskSpace(path string) (int64, int64, error) {
+	return 0, 0, errors.ErrUnsupported
+}
+
+// syncFilesystem isn't implemented on this platform, the OS flushes the data written
+func syncFilesystem(path string) error {
+	return nil
+}
+
+// fileLocking tells whether lockFile excludes other processes on this platform
+const fileLocking = false
+
+// lockFile isn't implemented on this platform, processes don't exclude each other
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,156 @@
+package dataStore
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Directory statistics (recursive size, files count and last modification) are kept in the
+// directory info sidecar and updated incrementally on every write and delete, so reading them
+// is O(1). Sidecars that don't track statistics yet (created by older versions or directories
+// created outside of the API) are initialized with a full scan the first time they are needed.
+
+// fileSidecarName returns the name of the data file described by a file info sidecar
+func fileSidecarName(filename string) (string, bool) {
+	if filename == directoryInfoName || !strings.HasPrefix(filename, "__") || !strings.HasSuffix(filename, "__.json") {
+		return "", false
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(filename, "__"), "__.json")
+	return name, name != ""
+}
+
+// directoryUsage scans dirPath and returns the bytes and number of files stored under it,
+// recursively, along with the latest modification time. Files being uploaded that have no
+// data yet are accounted through their info sidecar.
+func (store OsFileSystem) directoryUsage(dirPath string) (int64, int, time.Time, error) {
+	var size int64
+	var filesCount int
+	var lastModified time.Time
+	err := filepath.WalkDir(dirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if isReservedName(entry.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(lastModified) {
+			lastModified = info.ModTime()
+		}
+		if name, ok := fileSidecarName(entry.Name()); ok {
+			// Only account the sidecar when there is no data file for it
+			if _, err := os.Lstat(filepath.Join(filepath.Dir(path), name)); os.IsNotExist(err) {
+				filesCount++
+			}
+			return nil
+		}
+		if store.IsMetadataFile(entry.Name()) {
+			return nil
+		}
+		size += info.Size()
+		filesCount++
+		return nil
+	})
+	return size, filesCount, lastModified.UTC(), err
+}
+
+// loadDirectoryInfo returns the info of dirPath, scanning the directory and persisting the
+// result when its sidecar is missing or doesn't track statistics. Caller must hold the store lock.
+func (store OsFileSystem) loadDirectoryInfo(dirPath storePath) (DirectoryInfo, error) {
+	dirInfo, err := store.readDirectoryInfo(dirPath)
+	if err == nil && dirInfo.StatsTracked {
+		return dirInfo, nil
+	}
+
+	stat, err := os.Stat(dirPath.OSPath)
+	if err != nil {
+		return DirectoryInfo{}, &DirectoryError{Op: "GetDirectoryInfo", Err: err, Key: dirPath.Path}
+	}
+
+	if dirInfo.Name == "" {
+		dirInfo.Name = filepath.Base(dirPath.OSPath)
+		dirInfo.CreatedTime = stat.ModTime()
+	}
+	dirInfo.Path = dirPath.Path
+	dirInfo.Size, dirInfo.FilesCount, dirInfo.LastModified, err = store.directoryUsage(dirPath.OSPath)
+	if err != nil {
+		return DirectoryInfo{}, &DirectoryError{Op: "GetDirectoryInfo", Err: err, Key: dirPath.Path}
+	}
+	if dirInfo.LastModified.IsZero() {
+		dirInfo.LastModified = stat.ModTime().UTC()
+	}
+	dirInfo.StatsTracked = true
+
+	err = store.writeDirectoryInfo(dirPath, &dirInfo)
+	return dirInfo, err
+}
+
+// updateDirectoryStats propagates a change of deltaBytes and deltaFiles on entryPath to the
+// directory holding it and to every parent up to the root. It must be called once the change
+// is already on disk, as directories whose statistics are initialized here already account it.
+// Caller must hold the store lock.
+func (store OsFileSystem) updateDirectoryStats(entryPath storePath, deltaBytes int64, deltaFiles int) error {
+	now := time.Now().UTC()
+	dir := entryPath
+	for !dir.isRoot() {
+		dir = dir.parent()
+
+		dirInfo, err := store.readDirectoryInfo(dir)
+		if err != nil || !dirInfo.StatsTracked {
+			// Initialization scans the directory which already includes the change
+			_, err = store.loadDirectoryInfo(dir)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		dirInfo.Size += deltaBytes
+		dirInfo.FilesCount += deltaFiles
+		dirInfo.LastModified = now
+		err = store.writeDirectoryInfo(dir, &dirInfo)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store OsFileSystem) readDirectoryInfo(dirPath storePath) (_ DirectoryInfo, err error) {
+	span := store.startSpan("readDirectoryInfo", dirPath)
+	defer func() { span.EndWithError(err) }()
+
+	file, err := os.Open(dirPath.directoryInfoPath())
+	if err != nil {
+		return DirectoryInfo{}, err
+	}
+	defer file.Close()
+
+	var dirInfo DirectoryInfo
+	err = json.NewDecoder(file).Decode(&dirInfo)
+	if err != nil {
+		return DirectoryInfo{}, err
+	}
+	return dirInfo, nil
+}
+
+// invalidateDirectoryStats forces the statistics of dirPath to be rebuilt from a scan on
+// next access, keeping the rest of its info
+func (store OsFileSystem) invalidateDirectoryStats(dirPath storePath) {
+	dirInfo, err := store.readDirectoryInfo(dirPath)
+	if err != nil || !dirInfo.StatsTracked {
+		return
+	}
+	dirInfo.StatsTracked = false
+	store.writeDirectoryInfo(dirPath, &dirInfo)
+}
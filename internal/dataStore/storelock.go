@@ -0,0 +1,60 @@
+package dataStore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// The store lock only excludes the operations of one process. The server and the commands
+// changing the store behind its back (i.e: rotate-keys) also hold an exclusive lock on a file
+// of the store root, so they can't run at once.
+
+// Name of the lock file of the store root, holding the PID of its owner
+const storeLockName = "__lock__"
+
+var ErrStoreBusy = errors.New("store in use by another process (i.e: the server)")
+
+// storeLockFile is the lock file held by this process, nil until AcquireStore
+var storeLockFile *os.File
+
+// AcquireStore takes the lock file of the store root until the process exits, failing with
+// ErrStoreBusy if another process holds it
+func AcquireStore() error {
+	if storeLockFile != nil {
+		return nil
+	}
+	root := config.AppConfig.StoreConfig.Root
+	file, err := lockStoreRoot(root)
+	if err != nil {
+		return &DirectoryError{Op: "AcquireStore", Err: err, Key: root}
+	}
+	storeLockFile = file
+	return nil
+}
+
+func lockStoreRoot(root string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(root, storeLockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// The PID tells admins who holds the store
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("writing the lock file: %w", err)
+	}
+	return file, nil
+}
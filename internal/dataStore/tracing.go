@@ -0,0 +1,113 @@
+package dataStore
+
+import (
+	"context"
+
+	"github.com/rkachach/hss/internal/tracing"
+)
+
+// tracedStore traces the operations of the DataStore it wraps, as children of the span of
+// the request they serve
+type tracedStore struct {
+	DataStore
+	ctx context.Context
+}
+
+// Traced wraps store to trace its operations
+func Traced(store DataStore) DataStore {
+	return tracedStore{DataStore: store, ctx: context.Background()}
+}
+
+func (store tracedStore) WithContext(ctx context.Context) DataStore {
+	return tracedStore{DataStore: store.DataStore.WithContext(ctx), ctx: ctx}
+}
+
+// start starts the span of operation, returning the wrapped store running in it
+func (store tracedStore) start(operation string, path string, attributes ...any) (DataStore, *tracing.Span) {
+	ctx, span := tracing.Start(store.ctx, "DataStore."+operation, append([]any{"path", path}, attributes...)...)
+	if span == nil {
+		return store.DataStore, nil
+	}
+	return store.DataStore.WithContext(ctx), span
+}
+
+func (store tracedStore) StartFileUpload(filePath string, userMetadata map[string]string) (FileInfo, error) {
+	traced, span := store.start("StartFileUpload", filePath)
+	fileInfo, err := traced.StartFileUpload(filePath, userMetadata)
+	span.EndWithError(err)
+	return fileInfo, err
+}
+
+func (store tracedStore) ReadFileInfo(filePath string) (FileInfo, error) {
+	traced, span := store.start("ReadFileInfo", filePath)
+	fileInfo, err := traced.ReadFileInfo(filePath)
+	span.EndWithError(err)
+	return fileInfo, err
+}
+
+func (store tracedStore) WriteFilePart(filePath string, objectPartData []byte, partNumber int) (FileInfo, error) {
+	traced, span := store.start("WriteFilePart", filePath, "bytes", len(objectPartData))
+	fileInfo, err := traced.WriteFilePart(filePath, objectPartData, partNumber)
+	span.EndWithError(err)
+	return fileInfo, err
+}
+
+func (store tracedStore) ReadFile(filePath string) ([]byte, error) {
+	traced, span := store.start("ReadFile", filePath)
+	data, err := traced.ReadFile(filePath)
+	span.SetAttributes("bytes", len(data))
+	span.EndWithError(err)
+	return data, err
+}
+
+func (store tracedStore) OpenFile(filePath string) (FileReader, error) {
+	traced, span := store.start("OpenFile", filePath)
+	reader, err := traced.OpenFile(filePath)
+	span.EndWithError(err)
+	return reader, err
+}
+
+func (store tracedStore) DeleteFile(filePath string) error {
+	traced, span := store.start("DeleteFile", filePath)
+	err := traced.DeleteFile(filePath)
+	span.EndWithError(err)
+	return err
+}
+
+func (store tracedStore) UpdateFileInfo(filePath string, fileInfo FileInfo) error {
+	traced, span := store.start("UpdateFileInfo", filePath)
+	err := traced.UpdateFileInfo(filePath, fileInfo)
+	span.EndWithError(err)
+	return err
+}
+
+func (store tracedStore) CreateDirectory(relativeDirPath string, userMetadata map[string]string) error {
+	traced, span := store.start("CreateDirectory", relativeDirPath)
+	err := traced.CreateDirectory(relativeDirPath, userMetadata)
+	span.EndWithError(err)
+	return err
+}
+
+func (store tracedStore) GetDirectoryInfo(relativeDirPath string) (DirectoryInfo, error) {
+	traced, span := store.start("GetDirectoryInfo", relativeDirPath)
+	dirInfo, err := traced.GetDirectoryInfo(relativeDirPath)
+	span.EndWithError(err)
+	return dirInfo, err
+}
+
+func (store tracedStore) DeleteDirectory(relativeDirPath string, options DeleteDirectoryOptions) (DeleteDirectoryReport, error) {
+	traced, span := store.start("DeleteDirectory", relativeDirPath,
+		"recursive", options.Recursive, "dry_run", options.DryRun)
+	report, err := traced.DeleteDirectory(relativeDirPath, options)
+	span.SetAttributes("files", report.FilesCount)
+	span.EndWithError(err)
+	return report, err
+}
+
+func (store tracedStore) ListDirectory(relativeDirPath string) ([]ElementExtendedInfo, error) {
+	traced, span := store.start("ListDirectory", relativeDirPath)
+	entries, err := traced.ListDirectory(relativeDirPath)
+	span.SetAttributes("entries", len(entries))
+	span.EndWithError(err)
+	return entries, err
+}
@@ -0,0 +1,49 @@
+package hss
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/accesslog"
+	"github.com/rkachach/hss/internal/auth"
+	"github.com/rkachach/hss/internal/ratelimit"
+)
+
+// accessLogged writes the requests to the operation api in the access log once served, with
+// the presigned URL signatures redacted
+func accessLogged(api string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !accesslog.Enabled() {
+			f.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		f.ServeHTTP(recorder, r)
+
+		err := accesslog.Write(accesslog.Entry{
+			Time:          start,
+			RequestID:     w.Header().Get(requestIDHeader),
+			RemoteAddr:    ratelimit.ClientIP(r),
+			Principal:     auth.PrincipalFromContext(r.Context()).Name,
+			Operation:     api,
+			Method:        r.Method,
+			URI:           auth.RedactedURI(r.RequestURI),
+			Proto:         r.Proto,
+			Status:        recorder.statusCode(),
+			BytesSent:     recorder.written,
+			BytesReceived: body.read,
+			Duration:      time.Since(start).Seconds(),
+			Referer:       r.Referer(),
+			UserAgent:     r.UserAgent(),
+		})
+		if err != nil {
+			config.LogFromContext(r.Context()).Error("Error writing access log", "operation", api, "error", err)
+		}
+	}
+}
@@ -1,23 +1,37 @@
 package hss
 
 import (
+	"errors"
 	"strings"
 	"net/http"
 	"net/url"
+	"path"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/rkachach/hss/internal/archive"
+	"github.com/rkachach/hss/internal/auth"
 	"github.com/rkachach/hss/internal/dataStore"
+	"github.com/rkachach/hss/internal/ratelimit"
 	"github.com/rkachach/hss/cmd/config"
 	"io"
 	"crypto/md5"
 	"encoding/hex"
+	"mime"
+	"log/slog"
+	"github.com/google/uuid"
+	"time"
 )
 
 // TODO find where to get information about dataStores, there could be multiple Data Stores like
 // a metadata store, a data store...
 // Right now this is a hacky single store we have.
-var store dataStore.DataStore = dataStore.OsFileSystem{}
+var defaultStore dataStore.DataStore = dataStore.Instrumented(dataStore.Traced(dataStore.OsFileSystem{}))
+
+// storeFor returns the store serving r, logging and tracing in the context of the request
+func storeFor(r *http.Request) dataStore.DataStore {
+	return defaultStore.WithContext(r.Context())
+}
 
 func getPathFromQuery(r *http.Request) string {
 	path := mux.Vars(r)["path"]
@@ -40,10 +54,12 @@ func getMedataFromQuery(r *http.Request) map[string]string {
 	userMetadata := make(map[string]string)
 	metadataFieldList := strings.Split(metadataFields, ",")
 	for _, field := range metadataFieldList {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
 		// Access the value of each metadata field from request headers
 		metadataValue := r.Header.Get(strings.TrimSpace(field))
 		userMetadata[field] = metadataValue
-		fmt.Printf("Metadata field '%s': %s\n", field, metadataValue) // Process metadata values
 	}
 
 	if len(userMetadata) != 0 {
@@ -53,110 +69,347 @@ func getMedataFromQuery(r *http.Request) map[string]string {
 	return nil
 }
 
+// storeErrorStatus maps a DataStore error to the HTTP status reported to the client,
+// defaultStatus is used for errors without a more specific status
+func storeErrorStatus(err error, defaultStatus int) int {
+	var quotaErr *dataStore.QuotaError
+	switch {
+	case errors.As(err, &quotaErr):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, dataStore.ErrDirectoryNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dataStore.ErrDirectoryNotEmpty), errors.Is(err, dataStore.ErrFileExists),
+		errors.Is(err, dataStore.ErrDirectoryExists):
+		return http.StatusConflict
+	case errors.Is(err, dataStore.ErrDeleteRoot), errors.Is(err, dataStore.ErrInvalidPath),
+		errors.Is(err, dataStore.ErrReservedName), errors.Is(err, dataStore.ErrPathEscape):
+		return http.StatusBadRequest
+	}
+	return defaultStatus
+}
+
+// authorize checks the access policies for the principal of the request and replies with a
+// 403 naming the denied action. recursive operations need the action on the whole subtree.
+func authorize(w http.ResponseWriter, r *http.Request, action auth.Action, targetPath string, recursive bool) bool {
+	principal := auth.PrincipalFromContext(r.Context())
+	var decision auth.Decision
+	if recursive {
+		decision = auth.AuthorizeTree(principal, action, targetPath)
+	} else {
+		decision = auth.Authorize(principal, action, targetPath)
+	}
+	if !decision.Allowed {
+		config.LogFromContext(r.Context()).Info("Access denied", "principal", principal.Name, "action", action,
+			"path", decision.Path, "policy", decision.Policy, "reason", decision.Reason)
+		http.Error(w, fmt.Sprintf("Forbidden: %v access to %v denied", action, decision.Path), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func CreateDirectory(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
 
 	dirPath := getPathFromQuery(r)
-	err := store.CreateDirectory(dirPath, getMedataFromQuery(r))
+	if !authorize(w, r, auth.ActionWrite, dirPath, false) {
+		return
+	}
+	metadata := getMedataFromQuery(r)
+	auditRecordOf(r).Metadata = metadata
+	err := store.CreateDirectory(dirPath, metadata)
 	if err != nil {
-		// writeErrorResponse(w, errorCodes.ToAPIErr(ErrDirectoryAlreadyExists), r.URL)
-	} else {
-		w.WriteHeader(http.StatusCreated)
+		http.Error(w, err.Error(), storeErrorStatus(err, http.StatusInternalServerError))
+		return
 	}
+	w.WriteHeader(http.StatusCreated)
 }
 
 func DeleteDirectory(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
 
 	dirPath := getPathFromQuery(r)
-	store.DeleteDirectory(dirPath)
-	// Write success response.
-	w.WriteHeader(http.StatusOK)
+	options := dataStore.DeleteDirectoryOptions{
+		Recursive: r.URL.Query().Get("recursive") == "true",
+		DryRun:    r.URL.Query().Get("dry-run") == "true",
+	}
+	if !authorize(w, r, auth.ActionDelete, dirPath, options.Recursive) {
+		return
+	}
+
+	report, err := store.DeleteDirectory(dirPath, options)
+	record := auditRecordOf(r)
+	record.Bytes = report.Size
+	record.Details = map[string]string{
+		"recursive": fmt.Sprint(options.Recursive),
+		"dry_run":   fmt.Sprint(options.DryRun),
+		"files":     fmt.Sprint(report.FilesCount),
+	}
+	status := http.StatusOK
+	if err != nil {
+		status = storeErrorStatus(err, http.StatusInternalServerError)
+		if !errors.Is(err, dataStore.ErrPartialDelete) {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	// The report lists what was (or would be) removed and the paths that failed
+	jsonResponse, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
 }
 
 func CreateFile(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
 
 	filePath := getPathFromQuery(r)
 	if filePath == "" {
 		http.Error(w, "Missing file path", http.StatusBadRequest)
 		return
 	}
+	if !authorize(w, r, auth.ActionWrite, filePath, false) {
+		return
+	}
 
-	fileInfo, err := store.StartFileUpload(filePath, getMedataFromQuery(r))
+	record := auditRecordOf(r)
+	record.Metadata = getMedataFromQuery(r)
+	fileInfo, err := store.StartFileUpload(filePath, record.Metadata)
 	if err != nil {
-		http.Error(w, "Error when creating a new upload", http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("Error when creating a new upload: %v", err), storeErrorStatus(err, http.StatusNotFound))
+		return
+	}
+
+	// Files are uploaded as multipart forms, or as the raw request body (i.e: a PUT through a
+	// presigned URL)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		fileInfo, err = writeRawBody(store, filePath, r.Body)
+		record.Bytes, record.Checksum = fileInfo.Size, fileInfo.MD5sum
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			status := storeErrorStatus(err, http.StatusInternalServerError)
+			if errors.As(err, &maxBytesErr) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			uploadFailed(w, r, store, filePath, err, status, fmt.Sprintf("Error writing file: %v", err))
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", 0))
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
 	// Parse the multipart form data
 	reader, err := r.MultipartReader()
 	if err != nil {
-		fmt.Printf("Error parsing req: %q\n", err)
-		http.Error(w, "Error parsing multipart form", http.StatusBadRequest)
+		uploadFailed(w, r, store, filePath, err, http.StatusBadRequest, "Error parsing multipart form")
 		return
 	}
 
-	// Iterate over parts in the multipart form
+	// Iterate over parts in the multipart form. The checksum is only recorded once the whole
+	// form is stored, files without one are interrupted uploads.
+	hash := md5.New()
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			http.Error(w, "Error reading part of the multipart form", http.StatusBadRequest)
+			uploadFailed(w, r, store, filePath, err, http.StatusBadRequest, "Error reading part of the multipart form")
 			return
 		}
 
 		// Read the file content directly
 		filePartData, err := io.ReadAll(part)
 		if err != nil && err != io.EOF {
-			http.Error(w, "Error reading file content", http.StatusBadRequest)
+			uploadFailed(w, r, store, filePath, err, http.StatusBadRequest, "Error reading file content")
 			return
 		}
 
 		fileInfo, err = store.WriteFilePart(filePath, filePartData, 0)
 		if err != nil {
-			http.Error(w, "Error opening file", http.StatusInternalServerError)
+			uploadFailed(w, r, store, filePath, err, storeErrorStatus(err, http.StatusInternalServerError), fmt.Sprintf("Error writing file: %v", err))
 			return
 		}
-
-		FileBytes, err := store.ReadFile(filePath)
-		md5Hash := md5.Sum(FileBytes)
-		md5Checksum := hex.EncodeToString(md5Hash[:])
-		fileInfo.MD5sum = md5Checksum
-		store.UpdateFileInfo(filePath, fileInfo)
+		hash.Write(filePartData)
+		record.Bytes = fileInfo.Size
+	}
+	// The form may end before the body, which is only verified (i.e: against its SigV4 payload
+	// hash) once read to its end
+	_, err = io.Copy(io.Discard, r.Body)
+	if err != nil {
+		uploadFailed(w, r, store, filePath, err, http.StatusBadRequest, "Error reading the multipart form")
+		return
+	}
+	fileInfo.MD5sum = hex.EncodeToString(hash.Sum(nil))
+	err = store.UpdateFileInfo(filePath, fileInfo)
+	if err != nil {
+		uploadFailed(w, r, store, filePath, err, storeErrorStatus(err, http.StatusInternalServerError), fmt.Sprintf("Error writing file: %v", err))
+		return
 	}
+	record.Checksum = fileInfo.MD5sum
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", 0))
 	w.WriteHeader(http.StatusOK)
 }
 
-func GetFile(w http.ResponseWriter, r *http.Request) {
+// writeRawBody stores body as the content of the file being uploaded, returning its info
+// with what was written so far
+func writeRawBody(store dataStore.DataStore, filePath string, body io.Reader) (dataStore.FileInfo, error) {
+	var fileInfo dataStore.FileInfo
+	hash := md5.New()
+	buffer := make([]byte, 1<<20)
+	for {
+		n, err := io.ReadFull(body, buffer)
+		if n > 0 {
+			hash.Write(buffer[:n])
+			written, writeErr := store.WriteFilePart(filePath, buffer[:n], 0)
+			if writeErr != nil {
+				return fileInfo, writeErr
+			}
+			fileInfo = written
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fileInfo, err
+		}
+	}
+
+	fileInfo, err := store.ReadFileInfo(filePath)
+	if err != nil {
+		return fileInfo, err
+	}
+	fileInfo.MD5sum = hex.EncodeToString(hash.Sum(nil))
+	return fileInfo, store.UpdateFileInfo(filePath, fileInfo)
+}
+
+type presignRequest struct {
+	// GET to download the file, PUT to upload it
+	Method string `json:"method"`
+	// Validity of the URL as a duration (i.e: "1h"), 15 minutes if empty
+	ExpiresIn   string `json:"expires_in"`
+	MaxSize     int64  `json:"max_size"`
+	ContentType string `json:"content_type"`
+}
 
+type presignResponse struct {
+	URL     string    `json:"url"`
+	Method  string    `json:"method"`
+	Expires time.Time `json:"expires"`
+}
+
+// PresignFile issues a URL to download or upload the file without credentials, on behalf of
+// the principal of the request
+func PresignFile(w http.ResponseWriter, r *http.Request) {
 	filePath := getPathFromQuery(r)
-	fileBytes, err := store.ReadFile(filePath)
+	var request presignRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		http.Error(w, "Error reading file ", http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("Invalid presign request: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	// Calculate MD5 checksum
-	hash := md5.Sum(fileBytes)
-	hashString := hex.EncodeToString(hash[:])
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-MD5", hashString)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(fileBytes)))
+	var action auth.Action
+	switch request.Method {
+	case http.MethodGet:
+		action = auth.ActionRead
+	case http.MethodPut:
+		action = auth.ActionWrite
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported presigned method: %q", request.Method), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, action, filePath, false) {
+		return
+	}
+
+	expiry := auth.DefaultPresignExpiry
+	if request.ExpiresIn != "" {
+		expiry, err = time.ParseDuration(request.ExpiresIn)
+		if err != nil || expiry <= 0 || expiry > auth.MaxPresignExpiry() {
+			http.Error(w, fmt.Sprintf("Invalid expires_in: %q (max %v)", request.ExpiresIn, auth.MaxPresignExpiry()), http.StatusBadRequest)
+			return
+		}
+	}
+	if request.MaxSize < 0 {
+		http.Error(w, "Invalid max_size", http.StatusBadRequest)
+		return
+	}
+
+	principal := auth.PrincipalFromContext(r.Context())
+	grant := auth.PresignedGrant{
+		Method:      request.Method,
+		Path:        filePath,
+		Expires:     time.Now().Add(expiry).Truncate(time.Second),
+		Principal:   principal,
+		MaxSize:     request.MaxSize,
+		ContentType: request.ContentType,
+	}
+
+	segments := strings.Split(strings.Trim(filePath, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.QueryEscape(segment)
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	presignedURL := fmt.Sprintf("%v://%v/%v?%v", scheme, r.Host, strings.Join(segments, "/"), grant.Query().Encode())
+	config.LogFromContext(r.Context()).Info("Presigned URL issued", "principal", principal.Name,
+		"method", request.Method, "path", filePath, "expires", grant.Expires)
 
-	//Copy the file content to the response writer
-	_, err = w.Write(fileBytes)
+	jsonResponse, err := json.Marshal(presignResponse{URL: presignedURL, Method: request.Method, Expires: grant.Expires})
 	if err != nil {
-		http.Error(w, "Error copying file content", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonResponse)
+}
+
+func GetFile(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
+
+	filePath := getPathFromQuery(r)
+	if !authorize(w, r, auth.ActionRead, filePath, false) {
+		return
+	}
+	fileInfo, err := store.ReadFileInfo(filePath)
+	if err != nil {
+		http.Error(w, "Error reading file ", http.StatusNotFound)
+		return
+	}
+	reader, err := store.OpenFile(filePath)
+	if err != nil {
+		http.Error(w, "Error reading file ", http.StatusNotFound)
+		return
+	}
+	defer reader.Close()
+
+	// ServeContent handles Range requests, reading only the requested part of the file
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if fileInfo.MD5sum != "" && r.Header.Get("Range") == "" {
+		w.Header().Set("Content-MD5", fileInfo.MD5sum)
+	}
+	http.ServeContent(w, r, "", fileInfo.LastModified, reader)
 }
 
 func HeadFile(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
 
 	filePath := getPathFromQuery(r)
+	if !authorize(w, r, auth.ActionRead, filePath, false) {
+		return
+	}
 	fileInfo, err := store.ReadFileInfo(filePath)
 	if err != nil {
 		http.Error(w, "Error reading file ", http.StatusNotFound)
@@ -171,8 +424,16 @@ func HeadFile(w http.ResponseWriter, r *http.Request) {
 }
 
 func DeleteFile(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
 
 	filePath := getPathFromQuery(r)
+	if !authorize(w, r, auth.ActionDelete, filePath, false) {
+		return
+	}
+	if fileInfo, err := store.ReadFileInfo(filePath); err == nil {
+		record := auditRecordOf(r)
+		record.Bytes, record.Checksum = fileInfo.Size, fileInfo.MD5sum
+	}
 	err := store.DeleteFile(filePath)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error deleting object: %v", filePath), http.StatusNotFound)
@@ -184,10 +445,14 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 }
 
 func HeadDirectory(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
 	dirPath := getPathFromQuery(r)
+	if !authorize(w, r, auth.ActionRead, dirPath, false) {
+		return
+	}
 	dirInfo, err := store.GetDirectoryInfo(dirPath)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), storeErrorStatus(err, http.StatusInternalServerError))
 		return
 	}
 
@@ -195,6 +460,10 @@ func HeadDirectory(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Directory-Path", dirInfo.Path)
 	w.Header().Set("Directory-Size", fmt.Sprintf("%v",dirInfo.Size))
 	w.Header().Set("Directory-Files-Count", fmt.Sprintf("%v",dirInfo.FilesCount))
+	if dirInfo.Quota != nil {
+		w.Header().Set("Directory-Quota-Bytes", fmt.Sprintf("%v", dirInfo.Quota.MaxBytes))
+		w.Header().Set("Directory-Quota-Files", fmt.Sprintf("%v", dirInfo.Quota.MaxFiles))
+	}
 	for metadataField, metadataFieldValue:= range dirInfo.Metadata {
 		w.Header().Set(metadataField, metadataFieldValue)
 	}
@@ -202,10 +471,14 @@ func HeadDirectory(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetDirectory(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
 	dirPath := getPathFromQuery(r)
+	if !authorize(w, r, auth.ActionRead, dirPath, false) {
+		return
+	}
 	dirInfo, err := store.GetDirectoryInfo(dirPath)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), storeErrorStatus(err, http.StatusInternalServerError))
 		return
 	}
 
@@ -224,11 +497,156 @@ func GetDirectory(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func DownloadDirectory(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
+	dirPath := getPathFromQuery(r)
+	format := r.URL.Query().Get("format")
+	if !archive.IsSupportedFormat(format) {
+		http.Error(w, fmt.Sprintf("Unsupported archive format: %v", format), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, auth.ActionList, dirPath, true) || !authorize(w, r, auth.ActionRead, dirPath, true) {
+		return
+	}
+
+	_, err := store.GetDirectoryInfo(dirPath)
+	if err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err, http.StatusNotFound))
+		return
+	}
+
+	archiveName := path.Base(path.Clean("/" + dirPath))
+	if archiveName == "/" {
+		archiveName = "root"
+	}
+	w.Header().Set("Content-Type", archive.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archiveName+"."+format))
+	w.WriteHeader(http.StatusOK)
+
+	// The archive is streamed, once started errors can only be reported by cutting the response
+	err = archive.WriteDirectory(w, format, store, dirPath, r.URL.Query().Get("metadata") == "true")
+	if err != nil {
+		config.LogFromContext(r.Context()).Error("Error archiving directory", "path", dirPath, "error", err)
+		abortResponse(w)
+	}
+}
+
+// archiveFormat returns the format of the uploaded archive, from the format query parameter
+// or else from the request content type
+func archiveFormat(r *http.Request) string {
+	format := r.URL.Query().Get("format")
+	if format != "" {
+		return format
+	}
+	switch r.Header.Get("Content-Type") {
+	case "application/zip":
+		return archive.FormatZip
+	case "application/gzip", "application/x-gzip":
+		return archive.FormatTarGz
+	case "application/x-tar":
+		return archive.FormatTar
+	}
+	return ""
+}
+
+func ExtractArchive(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
+	dirPath := getPathFromQuery(r)
+	format := archiveFormat(r)
+	if !archive.IsSupportedFormat(format) {
+		http.Error(w, fmt.Sprintf("Unsupported archive format: %q", format), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, auth.ActionWrite, dirPath, true) {
+		return
+	}
+
+	archiveConfig := config.Current().Archive
+	limits := archive.ExtractLimits{
+		MaxArchiveBytes: archiveConfig.MaxArchiveBytes,
+		MaxEntries:      archiveConfig.MaxEntries,
+		MaxEntryBytes:   archiveConfig.MaxEntryBytes,
+		MaxTotalBytes:   archiveConfig.MaxTotalBytes,
+	}.WithDefaults()
+
+	// Extract into an existing directory or create it
+	_, err := store.GetDirectoryInfo(dirPath)
+	if err != nil {
+		err = store.CreateDirectory(dirPath, getMedataFromQuery(r))
+		if err != nil {
+			http.Error(w, err.Error(), storeErrorStatus(err, http.StatusInternalServerError))
+			return
+		}
+	}
+
+	body := http.MaxBytesReader(w, r.Body, limits.MaxArchiveBytes)
+	report, err := archive.Extract(body, format, store, dirPath, limits)
+	record := auditRecordOf(r)
+	record.Bytes = report.Bytes
+	record.Details = map[string]string{
+		"format":  format,
+		"created": fmt.Sprint(report.Created),
+		"skipped": fmt.Sprint(report.Skipped),
+		"failed":  fmt.Sprint(report.Failed),
+	}
+	status := http.StatusOK
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case err == nil:
+	case errors.Is(err, archive.ErrTooManyEntries), errors.Is(err, archive.ErrArchiveTooLarge), errors.As(err, &maxBytesErr):
+		status = http.StatusRequestEntityTooLarge
+	default:
+		status = http.StatusBadRequest
+	}
+	if err != nil {
+		config.LogFromContext(r.Context()).Warn("Archive extraction stopped", "path", dirPath, "error", err)
+	}
+	if errors.Is(err, auth.ErrPayloadMismatch) {
+		// Nothing extracted from a tampered archive is kept
+		discardExtracted(r, store, report)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
+
+// discardExtracted removes the files and directories created by an extraction, the
+// directories only once empty
+func discardExtracted(r *http.Request, store dataStore.DataStore, report archive.ExtractReport) {
+	for i := len(report.Entries) - 1; i >= 0; i-- {
+		entry := report.Entries[i]
+		if entry.Status != archive.EntryCreated {
+			continue
+		}
+		var err error
+		if entry.Type == "directory" {
+			_, err = store.DeleteDirectory(entry.Path, dataStore.DeleteDirectoryOptions{})
+		} else {
+			err = store.DeleteFile(entry.Path)
+		}
+		if err != nil {
+			config.LogFromContext(r.Context()).Warn("Error removing extracted entry", "path", entry.Path, "error", err)
+		}
+	}
+}
+
 func ListDirectory(w http.ResponseWriter, r *http.Request) {
+	store := storeFor(r)
 	dirPath := getPathFromQuery(r)
+	if !authorize(w, r, auth.ActionList, dirPath, false) {
+		return
+	}
 	entries, err := store.ListDirectory(dirPath)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), storeErrorStatus(err, http.StatusNotFound))
 		return
 	}
 
@@ -252,42 +670,88 @@ func convertToMap(arr []string) map[string]bool {
 	return resultMap
 }
 
+// logRequestInfo logs the request at debug level, with the configured headers only if any.
+// Credentials in the headers and the query are redacted.
 func logRequestInfo(operation string, r *http.Request) {
+	logger := config.LogFromContext(r.Context())
+	if !logger.Enabled(r.Context(), slog.LevelDebug) {
+		return
+	}
 
 	//TODO: see how can we generate and handle this map to avoid iterating over all the list
-	selectedHeadersForLogging := convertToMap(config.AppConfig.Logging.SpecificHeaders)
-	logMessage := fmt.Sprintf("========= Operation: %s\n", operation)
-	logMessage += fmt.Sprintf("Path: %s\n", r.URL.Path)
-	logMessage += fmt.Sprintf("ContentLengh: %v\n", r.ContentLength)
-
-	// Log request query parameters
-	logMessage += "Query parameters:\n"
-	queryParams := r.URL.Query()
-	for key, values := range queryParams {
-		for _, value := range values {
-			logMessage += fmt.Sprintf("- %s: %s\n", key, value)
+	selectedHeadersForLogging := convertToMap(config.Current().Logging.SpecificHeaders)
+	headers := make(map[string][]string)
+	for key, value := range auth.RedactedHeaders(r.Header) {
+		if len(selectedHeadersForLogging) > 0 && !selectedHeadersForLogging[key] {
+			continue
 		}
+		headers[key] = value
 	}
 
-	// Log request headers
-	logMessage += "Received Headers:\n"
-	for key, value := range r.Header {
-		if len(selectedHeadersForLogging) > 0 {
-			_, ok := selectedHeadersForLogging[key]
-			if ok {
-				logMessage += fmt.Sprintf("%s: %s\n", key, value)
-			}
-		} else {
-			logMessage += fmt.Sprintf("- %s: %s\n", key, value)
-		}
+	logger.Debug("Request",
+		"operation", operation,
+		"principal", auth.PrincipalFromContext(r.Context()).Name,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"content_length", r.ContentLength,
+		"query", map[string][]string(auth.RedactedQuery(r.URL.Query())),
+		"headers", headers)
+}
+
+// requestIDHeader carries the ID of the request, echoed in the response and set in every
+// record logged for it
+const requestIDHeader = "X-Request-Id"
+
+// requestID returns the ID of the request given by the client (i.e: a proxy), or a new one
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id != "" && len(id) <= 128 && !strings.ContainsFunc(id, func(c rune) bool { return c <= ' ' || c > '~' }) {
+		return id
 	}
+	return uuid.New().String()
+}
+
+// operationClasses sets the rate limits applying to each API, unknown ones count as writes
+var operationClasses = map[string]ratelimit.Class{
+	"ListDirectory":     ratelimit.ClassList,
+	"GetDirectory":      ratelimit.ClassRead,
+	"HeadDirectory":     ratelimit.ClassRead,
+	"DownloadDirectory": ratelimit.ClassRead,
+	"GetFile":           ratelimit.ClassRead,
+	"HeadFile":          ratelimit.ClassRead,
+}
 
-	config.Logger.Println(logMessage)
+// uploadOperations count against the concurrent uploads limit
+var uploadOperations = map[string]bool{
+	"CreateFile":     true,
+	"ExtractArchive": true,
 }
 
 func Wrapper(api string, f http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	class, ok := operationClasses[api]
+	if !ok {
+		class = ratelimit.ClassWrite
+	}
+	if uploadOperations[api] {
+		f = tracked(api, f)
+	}
+	limited := ratelimit.Limit(class, uploadOperations[api], f)
+	if auditedOperations[api] {
+		limited = audited(api, limited)
+	}
+	logged := accessLogged(api, instrumented(api, limited))
+	handler := traced(api, func(w http.ResponseWriter, r *http.Request) {
 		logRequestInfo(api, r)
-		f.ServeHTTP(w, r)
+		logged.ServeHTTP(w, r)
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(config.ContextWithLog(r.Context(), config.LogFromContext(r.Context()).With("request_id", id)))
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+		if recorder.aborted {
+			panic(http.ErrAbortHandler)
+		}
 	}
 }
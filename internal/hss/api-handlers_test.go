@@ -0,0 +1,244 @@
+package hss
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/gorilla/mux"
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/auth"
+	"github.com/rkachach/hss/internal/dataStore"
+)
+
+// serve runs a request for the API api through the authentication middleware and handler,
+// the store path taken from the URL path as the router does
+func serve(api string, handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	routed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = mux.SetURLVars(r, map[string]string{"path": strings.TrimPrefix(r.URL.Path, "/")})
+		Wrapper(api, handler)(w, r)
+	})
+	recorder := httptest.NewRecorder()
+	auth.Middleware(routed).ServeHTTP(recorder, r)
+	return recorder
+}
+
+// storeEntries lists the names in the directory of the store root holding name
+func storeEntries(t *testing.T, name string) []string {
+	entries, err := os.ReadDir(filepath.Join(config.AppConfig.StoreConfig.Root, filepath.Dir(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), filepath.Base(name)) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestTamperedSigV4Upload(t *testing.T) {
+	config.AppConfig.Auth = config.AuthConfig{
+		Enabled:         true,
+		CredentialsFile: filepath.Join(t.TempDir(), "credentials.json"),
+		SigV4:           config.SigV4Config{Enabled: true},
+	}
+	defer func() { config.AppConfig.Auth = config.AuthConfig{}; auth.Init() }()
+	os.WriteFile(config.AppConfig.Auth.CredentialsFile,
+		[]byte(`{"api_keys": [], "access_keys": [{"access_key_id": "AKIDTEST", "secret_access_key": "secret", "principal": "s3-client"}]}`), 0600)
+	err := auth.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := v4.NewSigner(credentials.NewStaticCredentials("AKIDTEST", "secret", ""), func(signer *v4.Signer) {
+		signer.DisableURIPathEscaping = true
+	})
+	// signed signs a request with signedBody, then sends body instead
+	signed := func(method string, target string, contentType string, signedBody []byte, body []byte) *http.Request {
+		request := httptest.NewRequest(method, "http://hss.local"+target, nil)
+		request.Header.Set("Content-Type", contentType)
+		_, err := signer.Sign(request, bytes.NewReader(signedBody), "s3", "us-east-1", time.Now())
+		if err != nil {
+			t.Fatal("Error signing request ", err)
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		return request
+	}
+
+	response := serve("CreateFile", CreateFile, signed(http.MethodPut, "/signed?type=file", "application/octet-stream", []byte("hello"), []byte("hello")))
+	if response.Code != http.StatusOK {
+		t.Fatal("Signed upload rejected ", response.Code, response.Body)
+	}
+
+	response = serve("CreateFile", CreateFile, signed(http.MethodPut, "/tampered?type=file", "application/octet-stream", []byte("hello"), []byte("world")))
+	if response.Code != http.StatusBadRequest {
+		t.Error("Tampered upload accepted ", response.Code, response.Body)
+	}
+	if entries := storeEntries(t, "tampered"); len(entries) != 0 {
+		t.Error("Tampered upload left on disk ", entries)
+	}
+
+	form := func(content string) []byte {
+		var buffer bytes.Buffer
+		writer := multipart.NewWriter(&buffer)
+		writer.SetBoundary("hss-test-boundary")
+		part, _ := writer.CreateFormFile("file", "file")
+		part.Write([]byte(content))
+		writer.Close()
+		return buffer.Bytes()
+	}
+	contentType := "multipart/form-data; boundary=hss-test-boundary"
+	response = serve("CreateFile", CreateFile, signed(http.MethodPost, "/tampered-form?type=file", contentType, form("hello"), form("world")))
+	if response.Code != http.StatusBadRequest {
+		t.Error("Tampered form accepted ", response.Code, response.Body)
+	}
+	if entries := storeEntries(t, "tampered-form"); len(entries) != 0 {
+		t.Error("Tampered form left on disk ", entries)
+	}
+}
+
+func TestCreateExistingFile(t *testing.T) {
+	upload := func(content string) int {
+		request := httptest.NewRequest(http.MethodPut, "/existing?type=file", strings.NewReader(content))
+		return serve("CreateFile", CreateFile, request).Code
+	}
+	if status := upload("hello"); status != http.StatusOK {
+		t.Fatal("Upload rejected ", status)
+	}
+	if status := upload("world"); status != http.StatusConflict {
+		t.Error("Existing file overwritten ", status)
+	}
+	data, err := os.ReadFile(filepath.Join(config.AppConfig.StoreConfig.Root, "existing"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("File changed by the second upload: %q %v", data, err)
+	}
+}
+
+func TestFailedUploadRemoved(t *testing.T) {
+	// The body is written in chunks of 1MiB, the second one exceeds the quota
+	config.AppConfig.StoreConfig.Quotas = []config.QuotaConfig{{Path: "/quota", MaxBytes: 3 << 19}}
+	defer func() { config.AppConfig.StoreConfig.Quotas = nil }()
+	serve("CreateDirectory", CreateDirectory, httptest.NewRequest(http.MethodPost, "/quota?type=directory", nil))
+	upload := func(content string) int {
+		request := httptest.NewRequest(http.MethodPut, "/quota/file?type=file", strings.NewReader(content))
+		return serve("CreateFile", CreateFile, request).Code
+	}
+
+	if status := upload(strings.Repeat("x", 2<<20)); status != http.StatusInsufficientStorage {
+		t.Fatal("Upload over quota not rejected ", status)
+	}
+	if entries := storeEntries(t, "quota/file"); len(entries) != 0 {
+		t.Error("Failed upload left on disk ", entries)
+	}
+	if status := upload("ok"); status != http.StatusOK {
+		t.Error("Retried upload rejected ", status)
+	}
+}
+
+func TestInterruptedMultipartUpload(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	part, _ := writer.CreateFormFile("file", "file")
+	part.Write([]byte("first part"))
+	writer.CreateFormFile("file", "file")
+	// The body ends in the middle of the second part
+	request := httptest.NewRequest(http.MethodPost, "/interrupted?type=file", bytes.NewReader(buffer.Bytes()))
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	if response := serve("CreateFile", CreateFile, request); response.Code != http.StatusBadRequest {
+		t.Fatal("Interrupted form accepted ", response.Code, response.Body)
+	}
+	// The partial file is removed, the upload can be retried
+	if entries := storeEntries(t, "interrupted"); len(entries) != 0 {
+		t.Error("Interrupted upload left on disk ", entries)
+	}
+
+	buffer.Reset()
+	writer = multipart.NewWriter(&buffer)
+	for _, content := range []string{"first part", "second part"} {
+		part, _ = writer.CreateFormFile("file", "file")
+		part.Write([]byte(content))
+	}
+	writer.Close()
+	request = httptest.NewRequest(http.MethodPost, "/complete?type=file", &buffer)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	if response := serve("CreateFile", CreateFile, request); response.Code != http.StatusOK {
+		t.Fatal("Form rejected ", response.Code, response.Body)
+	}
+	fileInfo, err := dataStore.OsFileSystem{}.ReadFileInfo("complete")
+	if err != nil || fileInfo.MD5sum != fmt.Sprintf("%x", md5.Sum([]byte("first partsecond part"))) {
+		t.Errorf("Wrong checksum of the form: %+v %v", fileInfo, err)
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	create := func(dirPath string) int {
+		return serve("CreateDirectory", CreateDirectory, httptest.NewRequest(http.MethodPost, dirPath+"?type=directory", nil)).Code
+	}
+	if status := create("/newdir"); status != http.StatusCreated {
+		t.Error("Directory not created ", status)
+	}
+	if status := create("/newdir"); status != http.StatusConflict {
+		t.Error("Existing directory created again ", status)
+	}
+}
+
+func TestCreateDirectoryInvalidPath(t *testing.T) {
+	for _, dirPath := range []string{"/__info__.json", "/newdir/__x__", "/a/%2E%2E/%2E%2E/escaped"} {
+		request := httptest.NewRequest(http.MethodPost, dirPath+"?type=directory", nil)
+		if response := serve("CreateDirectory", CreateDirectory, request); response.Code != http.StatusBadRequest {
+			t.Errorf("Directory %v not rejected: %v %v", dirPath, response.Code, response.Body)
+		}
+	}
+	// The root has its own info, not a directory by that name
+	if stat, err := os.Stat(filepath.Join(config.AppConfig.StoreConfig.Root, "__info__.json")); err == nil && stat.IsDir() {
+		t.Error("Directory with a reserved name created")
+	}
+}
+
+func TestAbortedResponse(t *testing.T) {
+	failures := requestsTotal.Value("DownloadDirectory", "500")
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial archive"))
+		abortResponse(w)
+	}
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Error("Connection not aborted ", recovered)
+		}
+		if requestsTotal.Value("DownloadDirectory", "500") != failures+1 {
+			t.Error("Aborted response not recorded as a failure")
+		}
+	}()
+	serve("DownloadDirectory", handler, httptest.NewRequest(http.MethodGet, "/dir?type=directory&format=zip", nil))
+}
+
+func TestMain(m *testing.M) {
+	config.ReadConfig("../../config/config.json")
+	config.InitLogger()
+
+	// Run against a throwaway root so tests neither depend on nor pollute the configured store
+	root, err := os.MkdirTemp("", "hss-handlers-test-")
+	if err != nil {
+		panic(err)
+	}
+	config.AppConfig.StoreConfig.Root = root
+	dataStore.OsFileSystem{}.Init(root)
+	auth.Init()
+
+	exitCode := m.Run()
+	os.RemoveAll(root)
+
+	os.Exit(exitCode)
+}
@@ -0,0 +1,64 @@
+package hss
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/audit"
+	"github.com/rkachach/hss/internal/auth"
+)
+
+// auditedOperations are recorded in the audit log
+var auditedOperations = map[string]bool{
+	"CreateDirectory": true,
+	"DeleteDirectory": true,
+	"ExtractArchive":  true,
+	"CreateFile":      true,
+	"DeleteFile":      true,
+}
+
+type auditContextKey struct{}
+
+// auditRecordOf returns the audit record of r for handlers to fill in what they did (bytes,
+// checksum...). Requests not audited get a record that is discarded.
+func auditRecordOf(r *http.Request) *audit.Record {
+	record, ok := r.Context().Value(auditContextKey{}).(*audit.Record)
+	if !ok {
+		return &audit.Record{}
+	}
+	return record
+}
+
+// audited records the result of the operation api in the audit log
+func audited(api string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !audit.Enabled() {
+			f.ServeHTTP(w, r)
+			return
+		}
+
+		principal := auth.PrincipalFromContext(r.Context())
+		record := &audit.Record{
+			Time:       time.Now(),
+			Principal:  principal.Name,
+			AuthMethod: principal.Method,
+			RemoteAddr: r.RemoteAddr,
+			Operation:  api,
+			Path:       getPathFromQuery(r),
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		f.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, record)))
+
+		record.Status = recorder.statusCode()
+		record.Result = audit.ResultSuccess
+		if record.Status >= http.StatusBadRequest {
+			record.Result = audit.ResultFailure
+		}
+		err := audit.Append(*record)
+		if err != nil {
+			config.LogFromContext(r.Context()).Error("Error recording audit record", "operation", api, "path", record.Path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package hss
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/rkachach/hss/internal/metrics"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec("hss_requests_total",
+		"Requests served, by operation and status code.", "operation", "code")
+	requestDuration = metrics.NewHistogramVec("hss_request_duration_seconds",
+		"Time to serve requests, by operation.", metrics.DefaultBuckets, "operation")
+	receivedBytes = metrics.NewCounterVec("hss_received_bytes_total",
+		"Bytes read from request bodies, by operation.", "operation")
+	sentBytes = metrics.NewCounterVec("hss_sent_bytes_total",
+		"Bytes written to response bodies, by operation.", "operation")
+	activeUploads = metrics.NewGaugeVec("hss_active_uploads",
+		"Uploads in progress.")
+	_ = metrics.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+)
+
+// statusRecorder keeps the status and the number of bytes written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	// Set by abortResponse, the response was cut after it started
+	aborted bool
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(data)
+	recorder.written += int64(n)
+	return n, err
+}
+
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// statusCode returns the status sent, 200 if the handler wrote nothing. Aborted responses are
+// reported as 500, whatever was sent before they failed.
+func (recorder *statusRecorder) statusCode() int {
+	if recorder.aborted {
+		return http.StatusInternalServerError
+	}
+	if recorder.status == 0 {
+		return http.StatusOK
+	}
+	return recorder.status
+}
+
+// abortResponse marks the response of w as failed after it started, so the middlewares record
+// the failure. Wrapper then cuts the connection, the client mustn't take what was sent as the
+// whole response.
+func abortResponse(w http.ResponseWriter) {
+	for {
+		if recorder, ok := w.(*statusRecorder); ok {
+			recorder.aborted = true
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	reader.read += int64(n)
+	return n, err
+}
+
+// instrumented exposes the requests to the operation api as metrics
+func instrumented(api string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if uploadOperations[api] {
+			activeUploads.Add(1)
+			defer activeUploads.Add(-1)
+		}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		f.ServeHTTP(recorder, r)
+
+		requestsTotal.Inc(api, fmt.Sprint(recorder.statusCode()))
+		requestDuration.Observe(time.Since(start).Seconds(), api)
+		receivedBytes.Add(float64(body.read), api)
+		sentBytes.Add(float64(recorder.written), api)
+	}
+}
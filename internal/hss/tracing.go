@@ -0,0 +1,41 @@
+package hss
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/auth"
+	"github.com/rkachach/hss/internal/tracing"
+)
+
+// traced serves the requests to the operation api in a span, child of the trace context
+// propagated by the client. The records logged for the request carry the trace ID.
+func traced(api string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tracing.Enabled() {
+			f.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, span := tracing.StartServer(r, api,
+			"http.method", r.Method,
+			"http.target", r.URL.Path,
+			"hss.principal", auth.PrincipalFromContext(r.Context()).Name,
+			"hss.request_id", w.Header().Get(requestIDHeader))
+		defer span.End()
+		traceID := span.Context().TraceID.String()
+		ctx = config.ContextWithLog(ctx, config.LogFromContext(ctx).With("trace_id", traceID))
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		f.ServeHTTP(recorder, r.WithContext(ctx))
+
+		status := recorder.statusCode()
+		span.SetAttributes("http.status_code", status,
+			"http.request_content_length", r.ContentLength,
+			"http.response_content_length", recorder.written)
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(tracing.StatusError, fmt.Sprint(status, " ", http.StatusText(status)))
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package hss
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/auth"
+	"github.com/rkachach/hss/internal/dataStore"
+	"github.com/rkachach/hss/internal/ratelimit"
+	"github.com/rkachach/hss/internal/uploads"
+)
+
+type uploadContextKey struct{}
+
+// tracked registers the uploads of the operation api while in progress, for admins to list
+// and abort them from the console
+func tracked(api string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := uploads.Start(api, getPathFromQuery(r), auth.PrincipalFromContext(r.Context()).Name, ratelimit.ClientIP(r))
+		defer session.Finish()
+		r.Body = session.Body(r.Body)
+		f.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uploadContextKey{}, session)))
+	}
+}
+
+// uploadFailed removes the partial file of an upload that failed, so it can be retried, and
+// tells the client why: aborted from the console, body not matching the payload hash it was
+// signed with (only known once the whole body is read) or else message with status.
+func uploadFailed(w http.ResponseWriter, r *http.Request, store dataStore.DataStore, filePath string, err error, status int, message string) {
+	logger := config.LogFromContext(r.Context())
+	deleteErr := store.DeleteFile(filePath)
+	if deleteErr != nil {
+		logger.Warn("Error removing failed upload", "path", filePath, "error", deleteErr)
+	}
+
+	session, ok := r.Context().Value(uploadContextKey{}).(*uploads.Session)
+	switch {
+	case ok && session.Aborted():
+		logger.Info("Upload aborted", "upload_id", session.ID, "path", filePath)
+		http.Error(w, "Upload aborted by an administrator", http.StatusConflict)
+	case errors.Is(err, auth.ErrPayloadMismatch):
+		logger.Warn("Upload rejected", "path", filePath, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		logger.Debug("Upload failed", "path", filePath, "error", err)
+		http.Error(w, message, status)
+	}
+}
@@ -0,0 +1,180 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// Maintenance jobs run in the background, started from the console. A job of a type can't
+// run twice at once, finished jobs are kept for maxFinished more jobs to be inspected.
+
+// Func runs a job with its JSON parameters and returns its result, stopping early if ctx is
+// canceled
+type Func func(ctx context.Context, params json.RawMessage) (any, error)
+
+type State string
+
+const (
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateCanceled  State = "canceled"
+)
+
+var (
+	ErrUnknownType    = errors.New("unknown job type")
+	ErrAlreadyRunning = errors.New("a job of this type is already running")
+)
+
+const maxFinished = 50
+
+// Job is the state of a job
+type Job struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	State    State           `json:"state"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	Started  time.Time       `json:"started"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	Result   any             `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var (
+	mutex   sync.Mutex
+	types   = make(map[string]Func)
+	running = make(map[string]*Job)
+	jobs    []*Job
+)
+
+// Register makes jobs of jobType available, run by f
+func Register(jobType string, f Func) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	types[jobType] = f
+}
+
+// Start starts a job of jobType with params
+func Start(jobType string, params json.RawMessage) (Job, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	f, ok := types[jobType]
+	if !ok {
+		return Job{}, fmt.Errorf("%w %q", ErrUnknownType, jobType)
+	}
+	if running[jobType] != nil {
+		return Job{}, fmt.Errorf("%w: %v", ErrAlreadyRunning, running[jobType].ID)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:      uuid.New().String(),
+		Type:    jobType,
+		State:   StateRunning,
+		Params:  params,
+		Started: time.Now().UTC(),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	running[jobType] = job
+	jobs = append(jobs, job)
+	config.Log.Info("Job started", "job_id", job.ID, "type", jobType)
+
+	go func() {
+		result, err := f(ctx, params)
+		finish(job, result, err, ctx.Err() != nil)
+	}()
+	return *job, nil
+}
+
+func finish(job *Job, result any, err error, canceled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	finished := time.Now().UTC()
+	job.Finished = &finished
+	job.Result = result
+	switch {
+	case canceled:
+		job.State = StateCanceled
+	case err != nil:
+		job.State = StateFailed
+	default:
+		job.State = StateSucceeded
+	}
+	if err != nil {
+		job.Error = err.Error()
+	}
+	job.cancel()
+	close(job.done)
+	delete(running, job.Type)
+	config.Log.Info("Job finished", "job_id", job.ID, "type", job.Type, "state", job.State, "error", job.Error)
+
+	// Forget the oldest finished jobs
+	finishedCount := len(jobs) - len(running)
+	for i := 0; i < len(jobs) && finishedCount > maxFinished; {
+		if jobs[i].State == StateRunning {
+			i++
+			continue
+		}
+		jobs = append(jobs[:i], jobs[i+1:]...)
+		finishedCount--
+	}
+}
+
+// List returns the jobs, latest first
+func List() []Job {
+	mutex.Lock()
+	defer mutex.Unlock()
+	list := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, *job)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+	return list
+}
+
+// Get returns the job id
+func Get(id string) (Job, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, job := range jobs {
+		if job.ID == id {
+			return *job, true
+		}
+	}
+	return Job{}, false
+}
+
+// Cancel asks the running job id to stop. It returns false if no such job is running.
+func Cancel(id string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, job := range running {
+		if job.ID == id {
+			job.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// Wait waits for the job id to finish and returns it
+func Wait(id string) (Job, bool) {
+	job, ok := Get(id)
+	if !ok {
+		return job, false
+	}
+	<-job.done
+	return Get(id)
+}
@@ -0,0 +1,78 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+func TestJobs(t *testing.T) {
+	release := make(chan struct{})
+	Register("wait", func(ctx context.Context, params json.RawMessage) (any, error) {
+		select {
+		case <-release:
+			return string(params), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+	Register("fail", func(ctx context.Context, params json.RawMessage) (any, error) {
+		return nil, errors.New("broken")
+	})
+
+	if _, err := Start("unknown", nil); !errors.Is(err, ErrUnknownType) {
+		t.Error("Unknown job type started ", err)
+	}
+	job, err := Start("wait", json.RawMessage(`{"a":1}`))
+	if err != nil || job.State != StateRunning {
+		t.Fatal("Job not started ", job, err)
+	}
+	if _, err := Start("wait", nil); !errors.Is(err, ErrAlreadyRunning) {
+		t.Error("Job type started twice ", err)
+	}
+	close(release)
+	job, _ = Wait(job.ID)
+	if job.State != StateSucceeded || job.Result != `{"a":1}` || job.Finished == nil {
+		t.Error("Unexpected job result ", job)
+	}
+
+	failed, _ := Start("fail", nil)
+	failed, _ = Wait(failed.ID)
+	if failed.State != StateFailed || failed.Error != "broken" {
+		t.Error("Job failure not reported ", failed)
+	}
+
+	release = make(chan struct{})
+	canceled, _ := Start("wait", nil)
+	if !Cancel(canceled.ID) || Cancel("unknown") {
+		t.Error("Unexpected cancel result")
+	}
+	canceled, _ = Wait(canceled.ID)
+	if canceled.State != StateCanceled {
+		t.Error("Job not canceled ", canceled)
+	}
+
+	list := List()
+	if len(list) != 3 || list[0].ID != canceled.ID {
+		t.Error("Unexpected job list ", list)
+	}
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "hss-jobs-test-")
+	if err != nil {
+		panic(err)
+	}
+	config.AppConfig.Logging.LogFile = filepath.Join(dir, "test.log")
+	config.InitLogger()
+
+	exitCode := m.Run()
+	os.RemoveAll(dir)
+
+	os.Exit(exitCode)
+}
@@ -0,0 +1,269 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics are kept in memory and exposed in the Prometheus text format. Each metric is a
+// vector of series identified by the values of its labels.
+
+// DefaultBuckets are the upper bounds of latency histograms, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      []metric
+)
+
+func register(m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry = append(registry, m)
+}
+
+// Handler serves every registered metric
+func Handler(w http.ResponseWriter, r *http.Request) {
+	registryMutex.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// desc holds what all metric types share
+type desc struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+}
+
+func (d *desc) header(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, metricType)
+}
+
+// key identifies the series of labelValues
+func (d *desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %v: %d label values for %d labels", d.name, len(labelValues), len(d.labels)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// labelPairs formats the labels of the series key, with extra appended
+func (d *desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+labelValueEscaper.Replace(value)+`"`)
+		}
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// CounterVec is a set of monotonically increasing values
+type CounterVec struct {
+	desc
+	values map[string]float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{desc: desc{name: name, help: help, labels: labels}, values: map[string]float64{}}
+	register(counter)
+	return counter
+}
+
+func (counter *CounterVec) Add(value float64, labelValues ...string) {
+	key := counter.key(labelValues)
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.values[key] += value
+}
+
+func (counter *CounterVec) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Value returns the current value of a series
+func (counter *CounterVec) Value(labelValues ...string) float64 {
+	key := counter.key(labelValues)
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.values[key]
+}
+
+func (counter *CounterVec) write(w io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.header(w, "counter")
+	for _, key := range sortedKeys(counter.values) {
+		fmt.Fprintf(w, "%s%s %s\n", counter.name, counter.labelPairs(key), formatValue(counter.values[key]))
+	}
+}
+
+// GaugeVec is a set of values going up and down
+type GaugeVec struct {
+	desc
+	values map[string]float64
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	gauge := &GaugeVec{desc: desc{name: name, help: help, labels: labels}, values: map[string]float64{}}
+	register(gauge)
+	return gauge
+}
+
+func (gauge *GaugeVec) Add(value float64, labelValues ...string) {
+	key := gauge.key(labelValues)
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	gauge.values[key] += value
+}
+
+func (gauge *GaugeVec) Set(value float64, labelValues ...string) {
+	key := gauge.key(labelValues)
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	gauge.values[key] = value
+}
+
+func (gauge *GaugeVec) Value(labelValues ...string) float64 {
+	key := gauge.key(labelValues)
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	return gauge.values[key]
+}
+
+func (gauge *GaugeVec) write(w io.Writer) {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	gauge.header(w, "gauge")
+	for _, key := range sortedKeys(gauge.values) {
+		fmt.Fprintf(w, "%s%s %s\n", gauge.name, gauge.labelPairs(key), formatValue(gauge.values[key]))
+	}
+}
+
+// GaugeFunc is a gauge whose value is computed when exposed
+type GaugeFunc struct {
+	desc
+	value func() float64
+}
+
+func NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	gauge := &GaugeFunc{desc: desc{name: name, help: help}, value: value}
+	register(gauge)
+	return gauge
+}
+
+func (gauge *GaugeFunc) write(w io.Writer) {
+	gauge.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", gauge.name, formatValue(gauge.value()))
+}
+
+type histogramValue struct {
+	// Observations per bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a set of distributions of observed values
+type HistogramVec struct {
+	desc
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+// NewHistogramVec creates a histogram with buckets upper bounds, sorted
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	histogram := &HistogramVec{
+		desc:    desc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  map[string]*histogramValue{},
+	}
+	register(histogram)
+	return histogram
+}
+
+func (histogram *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := histogram.key(labelValues)
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	series, ok := histogram.values[key]
+	if !ok {
+		series = &histogramValue{counts: make([]uint64, len(histogram.buckets))}
+		histogram.values[key] = series
+	}
+	// Values above the last bucket are only in +Inf, that is count
+	bucket := sort.SearchFloat64s(histogram.buckets, value)
+	if bucket < len(histogram.buckets) {
+		series.counts[bucket]++
+	}
+	series.count++
+	series.sum += value
+}
+
+// Count returns the number of observations of a series
+func (histogram *HistogramVec) Count(labelValues ...string) uint64 {
+	key := histogram.key(labelValues)
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	if series, ok := histogram.values[key]; ok {
+		return series.count
+	}
+	return 0
+}
+
+func (histogram *HistogramVec) write(w io.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	histogram.header(w, "histogram")
+	for _, key := range sortedKeys(histogram.values) {
+		series := histogram.values[key]
+		var cumulative uint64
+		for i, upperBound := range histogram.buckets {
+			cumulative += series.counts[i]
+			le := `le="` + formatValue(upperBound) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, histogram.labelPairs(key, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, histogram.labelPairs(key, `le="+Inf"`), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, histogram.labelPairs(key), formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, histogram.labelPairs(key), series.count)
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	requests := NewCounterVec("test_requests_total", "Requests.", "operation", "code")
+	requests.Inc("GetFile", "200")
+	requests.Add(2, "GetFile", "200")
+	requests.Inc("Put\"File\n", "500")
+	uploads := NewGaugeVec("test_uploads", "Uploads.")
+	uploads.Add(2)
+	uploads.Add(-1)
+	latency := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "operation")
+	for _, value := range []float64{0.05, 0.1, 0.5, 3} {
+		latency.Observe(value, "GetFile")
+	}
+	NewGaugeFunc("test_answer", "Answer.", func() float64 { return 42 })
+
+	recorder := httptest.NewRecorder()
+	Handler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# HELP test_requests_total Requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{operation="GetFile",code="200"} 3`,
+		`test_requests_total{operation="Put\"File\n",code="500"} 1`,
+		"# TYPE test_uploads gauge",
+		"test_uploads 1",
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{operation="GetFile",le="0.1"} 2`,
+		`test_latency_seconds_bucket{operation="GetFile",le="1"} 3`,
+		`test_latency_seconds_bucket{operation="GetFile",le="+Inf"} 4`,
+		`test_latency_seconds_sum{operation="GetFile"} 3.65`,
+		`test_latency_seconds_count{operation="GetFile"} 4`,
+		"test_answer 42",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing %q in:\n%v", line, body)
+		}
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Error("Wrong content type ", recorder.Header().Get("Content-Type"))
+	}
+	if requests.Value("GetFile", "200") != 3 || latency.Count("GetFile") != 4 || uploads.Value() != 1 {
+		t.Error("Wrong values")
+	}
+}
@@ -0,0 +1,372 @@
+package ratelimit
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/auth"
+)
+
+// Requests are limited with token buckets kept per client (the authenticated principal and
+// the client IP) and operation class. Request rates are enforced on admission, rejecting
+// requests over the limit with 429 and a Retry-After, while bandwidth is paced as the bodies
+// are transferred. Clients already owing more than maxBandwidthWait of transfer are rejected
+// on admission too.
+
+// Class groups the operations sharing the same limits
+type Class string
+
+const (
+	ClassList  Class = "list"
+	ClassRead  Class = "read"
+	ClassWrite Class = "write"
+)
+
+const (
+	// Longest wait for bandwidth accepted on admission
+	maxBandwidthWait = time.Second
+	// Largest transfer paced at once
+	maxTransferChunk = 32 * 1024
+	// How often buckets back to full are dropped
+	pruneInterval = time.Minute
+)
+
+// now is replaced by tests
+var now = time.Now
+
+type bucket struct {
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the bucket was last used
+func (b *bucket) refill(t time.Time) {
+	if t.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+t.Sub(b.last).Seconds()*b.rate)
+		b.last = t
+	}
+}
+
+type limiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	uploads map[string]int
+	pruned  time.Time
+}
+
+var limits = newLimiter()
+
+func newLimiter() *limiter {
+	return &limiter{buckets: map[string]*bucket{}, uploads: map[string]int{}}
+}
+
+// take refills the bucket of key and takes n tokens from it. Returns how long until the
+// tokens are available: nothing is taken when they aren't unless debt is set, in which case
+// the caller is expected to wait that long before using them.
+func (l *limiter) take(key string, rate float64, burst float64, n float64, debt bool) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	t := now()
+	l.prune(t)
+	b := l.bucket(key, rate, burst, t)
+	wait := b.wait(n)
+	if wait == 0 || debt {
+		b.tokens -= n
+	}
+	return wait
+}
+
+// tokenRequest asks for n tokens of the bucket key, granted if available within maxWait
+type tokenRequest struct {
+	key     string
+	rate    float64
+	burst   float64
+	n       float64
+	maxWait time.Duration
+	reason  string
+}
+
+// takeAll takes the tokens of every request, or none when one of them can't be granted. It
+// returns the request denied, or nil, and how long until its tokens are available.
+func (l *limiter) takeAll(requests []tokenRequest) (*tokenRequest, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	t := now()
+	l.prune(t)
+	buckets := make([]*bucket, len(requests))
+	for i := range requests {
+		buckets[i] = l.bucket(requests[i].key, requests[i].rate, requests[i].burst, t)
+		if wait := buckets[i].wait(requests[i].n); wait > requests[i].maxWait {
+			return &requests[i], wait
+		}
+	}
+	for i, b := range buckets {
+		b.tokens -= requests[i].n
+	}
+	return nil, 0
+}
+
+// bucket returns the bucket of key refilled up to t, created full if new. Caller must hold
+// the mutex.
+func (l *limiter) bucket(key string, rate float64, burst float64, t time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: t}
+		l.buckets[key] = b
+	}
+	b.rate, b.burst = rate, burst
+	b.refill(t)
+	return b
+}
+
+// wait returns how long until the bucket holds n tokens
+func (b *bucket) wait(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// prune drops the buckets back to full, they are the same as new ones
+func (l *limiter) prune(t time.Time) {
+	if t.Sub(l.pruned) < pruneInterval {
+		return
+	}
+	l.pruned = t
+	for key, b := range l.buckets {
+		b.refill(t)
+		if b.tokens >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// acquireUpload counts an upload for every key, unless one of them already has max running
+func (l *limiter) acquireUpload(keys []string, max int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, key := range keys {
+		if l.uploads[key] >= max {
+			return false
+		}
+	}
+	for _, key := range keys {
+		l.uploads[key]++
+	}
+	return true
+}
+
+func (l *limiter) releaseUpload(keys []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, key := range keys {
+		l.uploads[key]--
+		if l.uploads[key] <= 0 {
+			delete(l.uploads, key)
+		}
+	}
+}
+
+// scope is a client the limits apply to, with the limit of the request class
+type scope struct {
+	key   string
+	limit config.RateLimit
+}
+
+// ClientIP returns the IP of the client of r. Behind a trusted proxy it's the last address of
+// X-Forwarded-For, the one appended by the proxy: those before come from the client.
+func ClientIP(r *http.Request) string {
+	if config.Current().RateLimits.TrustForwardedFor {
+		forwarded := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+		hops := strings.Split(forwarded, ",")
+		if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+			return ip.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// scopes returns the clients r is accounted to. Anonymous requests are only limited by IP,
+// as they would otherwise all share the same principal.
+func scopes(r *http.Request, class Class) []scope {
+	cfg := config.Current().RateLimits
+	var result []scope
+	principal := auth.PrincipalFromContext(r.Context())
+	if principal != auth.Anonymous {
+		result = append(result, scope{key: "principal:" + principal.Name, limit: cfg.PerPrincipal[string(class)]})
+	}
+	result = append(result, scope{key: "ip:" + ClientIP(r), limit: cfg.PerIP[string(class)]})
+	return result
+}
+
+func burstOf(limit config.RateLimit) float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return math.Ceil(limit.RequestsPerSecond)
+}
+
+// admit checks the request rate and bandwidth limits of every scope, returning how long to
+// wait before retrying when one is exceeded. A request rejected by one scope isn't counted
+// against the others.
+func admit(clients []scope, class Class) (time.Duration, string) {
+	var requests []tokenRequest
+	for _, client := range clients {
+		if client.limit.RequestsPerSecond > 0 {
+			requests = append(requests, tokenRequest{key: client.key + ":" + string(class), rate: client.limit.RequestsPerSecond,
+				burst: burstOf(client.limit), n: 1, reason: "request rate exceeded"})
+		}
+	}
+	for _, client := range clients {
+		if client.limit.BytesPerSecond > 0 {
+			rate := float64(client.limit.BytesPerSecond)
+			requests = append(requests, tokenRequest{key: client.key + ":" + string(class) + ":bytes", rate: rate, burst: rate,
+				maxWait: maxBandwidthWait, reason: "bandwidth exceeded"})
+		}
+	}
+	denied, wait := limits.takeAll(requests)
+	if denied != nil {
+		return wait, fmt.Sprintf("%v %v", class, denied.reason)
+	}
+	return 0, ""
+}
+
+// tooManyRequests replies with a 429 telling the client when to retry
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, reason string) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too Many Requests: "+reason, http.StatusTooManyRequests)
+}
+
+// Limit enforces the rate limits of class on f. Uploads also count against the concurrent
+// uploads limit.
+func Limit(class Class, upload bool, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.Current().RateLimits
+		if !cfg.Enabled {
+			f.ServeHTTP(w, r)
+			return
+		}
+
+		clients := scopes(r, class)
+		wait, reason := admit(clients, class)
+		if wait > 0 {
+			config.LogFromContext(r.Context()).Info("Rate limited", "method", r.Method, "path", r.URL.Path,
+				"client", clients[len(clients)-1].key, "reason", reason)
+			tooManyRequests(w, wait, reason)
+			return
+		}
+
+		if upload && cfg.MaxConcurrentUploads > 0 {
+			keys := make([]string, len(clients))
+			for i, client := range clients {
+				keys[i] = client.key
+			}
+			if !limits.acquireUpload(keys, cfg.MaxConcurrentUploads) {
+				config.LogFromContext(r.Context()).Info("Rate limited", "method", r.Method, "path", r.URL.Path,
+					"client", keys[len(keys)-1], "reason", "too many concurrent uploads")
+				tooManyRequests(w, time.Second, "too many concurrent uploads")
+				return
+			}
+			defer limits.releaseUpload(keys)
+		}
+
+		var paced []scope
+		for _, client := range clients {
+			if client.limit.BytesPerSecond > 0 {
+				paced = append(paced, client)
+			}
+		}
+		if len(paced) > 0 {
+			pacer := &pacer{request: r, clients: paced, class: class}
+			r.Body = &pacedReader{ReadCloser: r.Body, pacer: pacer}
+			w = &pacedWriter{ResponseWriter: w, pacer: pacer}
+		}
+		f.ServeHTTP(w, r)
+	}
+}
+
+// pacer holds transfers to the bandwidth limits of its clients
+type pacer struct {
+	request *http.Request
+	clients []scope
+	class   Class
+}
+
+// wait takes n bytes from the bandwidth of every client and waits until they are available
+func (p *pacer) wait(n int) error {
+	var wait time.Duration
+	for _, client := range p.clients {
+		rate := float64(client.limit.BytesPerSecond)
+		wait = max(wait, limits.take(client.key+":"+string(p.class)+":bytes", rate, rate, float64(n), true))
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-p.request.Context().Done():
+		return p.request.Context().Err()
+	}
+}
+
+type pacedReader struct {
+	io.ReadCloser
+	pacer *pacer
+}
+
+func (reader *pacedReader) Read(p []byte) (int, error) {
+	if len(p) > maxTransferChunk {
+		p = p[:maxTransferChunk]
+	}
+	n, err := reader.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := reader.pacer.wait(n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type pacedWriter struct {
+	http.ResponseWriter
+	pacer *pacer
+}
+
+func (writer *pacedWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+func (writer *pacedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+maxTransferChunk)]
+		err := writer.pacer.wait(len(chunk))
+		if err != nil {
+			return written, err
+		}
+		n, err := writer.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
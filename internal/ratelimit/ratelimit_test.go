@@ -0,0 +1,245 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+	"github.com/rkachach/hss/internal/auth"
+)
+
+// clock is a fake time source for the limiter
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func setup(t *testing.T, cfg config.RateLimitConfig) *clock {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	now = c.now
+	limits = newLimiter()
+	config.AppConfig.RateLimits = cfg
+	t.Cleanup(func() {
+		now = time.Now
+		limits = newLimiter()
+		config.AppConfig.RateLimits = config.RateLimitConfig{}
+	})
+	return c
+}
+
+func request(principal *auth.Principal, remoteAddr string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/dir?type=directory&operation=list", nil)
+	r.RemoteAddr = remoteAddr
+	if principal != nil {
+		r = r.WithContext(auth.WithPrincipal(r.Context(), principal))
+	}
+	return r
+}
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestRequestRate(t *testing.T) {
+	c := setup(t, config.RateLimitConfig{
+		Enabled:      true,
+		PerPrincipal: map[string]config.RateLimit{"list": {RequestsPerSecond: 2, Burst: 3}},
+	})
+	handler := Limit(ClassList, false, ok)
+	alice := &auth.Principal{Name: "alice"}
+
+	serve := func(principal *auth.Principal, remoteAddr string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler(recorder, request(principal, remoteAddr))
+		return recorder
+	}
+	for i := 0; i < 3; i++ {
+		if code := serve(alice, "10.0.0.1:1000").Code; code != http.StatusOK {
+			t.Fatalf("Request %d within the burst rejected with %d", i, code)
+		}
+	}
+	// The same principal from another IP shares its limit
+	recorder := serve(alice, "10.0.0.2:1000")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "1" {
+		t.Errorf("Request over the limit not rejected: %d %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	if code := serve(&auth.Principal{Name: "bob"}, "10.0.0.1:1000").Code; code != http.StatusOK {
+		t.Error("Other principal limited ", code)
+	}
+	if code := serve(nil, "10.0.0.1:1000").Code; code != http.StatusOK {
+		t.Error("Anonymous request limited by a principal limit ", code)
+	}
+	// Other classes have no limit
+	recorder = httptest.NewRecorder()
+	Limit(ClassRead, false, ok)(recorder, request(alice, "10.0.0.1:1000"))
+	if recorder.Code != http.StatusOK {
+		t.Error("Unlimited class limited ", recorder.Code)
+	}
+
+	c.advance(500 * time.Millisecond)
+	if code := serve(alice, "10.0.0.1:1000").Code; code != http.StatusOK {
+		t.Error("Token not refilled ", code)
+	}
+	if code := serve(alice, "10.0.0.1:1000").Code; code != http.StatusTooManyRequests {
+		t.Error("Refill above the rate ", code)
+	}
+}
+
+func TestIPLimit(t *testing.T) {
+	setup(t, config.RateLimitConfig{
+		Enabled: true,
+		PerIP:   map[string]config.RateLimit{"list": {RequestsPerSecond: 0.5}},
+	})
+	handler := Limit(ClassList, false, ok)
+	for _, remoteAddr := range []string{"10.0.0.1:1000", "10.0.0.2:1000"} {
+		recorder := httptest.NewRecorder()
+		handler(recorder, request(nil, remoteAddr))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("First request from %v rejected", remoteAddr)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, request(nil, "10.0.0.1:2000"))
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "2" {
+		t.Errorf("Request over the IP limit not rejected: %d %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+
+	// Behind a trusted proxy the client IP is the one appended by the proxy, not those sent by
+	// the client
+	config.AppConfig.RateLimits.TrustForwardedFor = true
+	r := request(nil, "10.0.0.1:2000")
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 192.168.1.1")
+	if ip := ClientIP(r); ip != "192.168.1.1" {
+		t.Errorf("Wrong client IP %v", ip)
+	}
+	r.Header.Set("X-Forwarded-For", "192.168.1.1, forged")
+	if ip := ClientIP(r); ip != "10.0.0.1" {
+		t.Errorf("Invalid forwarded address used %v", ip)
+	}
+}
+
+func TestRejectedRequestNotCounted(t *testing.T) {
+	setup(t, config.RateLimitConfig{
+		Enabled:      true,
+		PerPrincipal: map[string]config.RateLimit{"list": {RequestsPerSecond: 1, Burst: 2}},
+		PerIP:        map[string]config.RateLimit{"list": {RequestsPerSecond: 1, Burst: 1}},
+	})
+	handler := Limit(ClassList, false, ok)
+	alice := &auth.Principal{Name: "alice"}
+	serve := func(remoteAddr string) int {
+		recorder := httptest.NewRecorder()
+		handler(recorder, request(alice, remoteAddr))
+		return recorder.Code
+	}
+	if serve("10.0.0.1:1000") != http.StatusOK || serve("10.0.0.1:1000") != http.StatusTooManyRequests {
+		t.Fatal("IP limit not enforced")
+	}
+	// The request rejected by the IP limit didn't spend the principal token left
+	if code := serve("10.0.0.2:1000"); code != http.StatusOK {
+		t.Error("Principal token spent by a rejected request ", code)
+	}
+}
+
+func TestConcurrentUploads(t *testing.T) {
+	setup(t, config.RateLimitConfig{Enabled: true, MaxConcurrentUploads: 1})
+	started, release := make(chan bool), make(chan bool)
+	handler := Limit(ClassWrite, true, func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	})
+	alice := &auth.Principal{Name: "alice"}
+
+	done := make(chan bool)
+	go func() {
+		handler(httptest.NewRecorder(), request(alice, "10.0.0.1:1000"))
+		done <- true
+	}()
+	<-started
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, request(alice, "10.0.0.2:1000"))
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("Second upload not rejected: %d", recorder.Code)
+	}
+	close(release)
+	<-done
+
+	go handler(httptest.NewRecorder(), request(alice, "10.0.0.2:1000"))
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Error("Upload rejected once the first one ended")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	c := setup(t, config.RateLimitConfig{
+		Enabled: true,
+		PerIP:   map[string]config.RateLimit{"read": {BytesPerSecond: 1000}},
+	})
+	var waited time.Duration
+	handler := Limit(ClassRead, false, func(w http.ResponseWriter, r *http.Request) {
+		// Account the wait of every chunk without sleeping
+		pacer := w.(*pacedWriter).pacer
+		for _, client := range pacer.clients {
+			waited = limits.take(client.key+":read:bytes", 1000, 1000, 3000, true)
+		}
+	})
+	recorder := httptest.NewRecorder()
+	handler(recorder, request(nil, "10.0.0.1:1000"))
+	if recorder.Code != http.StatusOK || waited != 2*time.Second {
+		t.Fatalf("Wrong transfer wait %v", waited)
+	}
+
+	// The client owes 2s of transfer, more than accepted on admission
+	recorder = httptest.NewRecorder()
+	handler(recorder, request(nil, "10.0.0.1:1000"))
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "2" {
+		t.Errorf("Request over the bandwidth not rejected: %d %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	c.advance(1500 * time.Millisecond)
+	recorder = httptest.NewRecorder()
+	Limit(ClassRead, false, ok)(recorder, request(nil, "10.0.0.1:1000"))
+	if recorder.Code != http.StatusOK {
+		t.Error("Request within the bandwidth wait rejected ", recorder.Code)
+	}
+
+	// Transfers are paced in chunks
+	now = time.Now
+	limits = newLimiter()
+	config.AppConfig.RateLimits.PerIP["read"] = config.RateLimit{BytesPerSecond: 100 * 1024}
+	data := bytes.Repeat([]byte("x"), 150*1024)
+	start := time.Now()
+	Limit(ClassRead, false, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	})(recorder, request(nil, "10.0.0.1:1000"))
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Transfer not paced, took %v", elapsed)
+	}
+
+	r := request(nil, "10.0.0.1:1000")
+	r.Body = io.NopCloser(bytes.NewReader(data[:10]))
+	Limit(ClassRead, false, func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); len(body) != 10 {
+			t.Error("Wrong paced body")
+		}
+	})(httptest.NewRecorder(), r)
+}
+
+func TestMain(m *testing.M) {
+	testDir, err := os.MkdirTemp("", "hss-ratelimit-test-")
+	if err != nil {
+		panic(err)
+	}
+	config.AppConfig.Logging.LogFile = filepath.Join(testDir, "test.log")
+	config.InitLogger()
+
+	exitCode := m.Run()
+	os.RemoveAll(testDir)
+
+	os.Exit(exitCode)
+}
@@ -0,0 +1,467 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rkachach/hss/cmd/config"
+)
+
+// Spans follow the OpenTelemetry model: a trace is a tree of spans sharing a trace ID, the
+// trace context is propagated in W3C traceparent headers so spans of upstream services are
+// the parents of ours. Ended spans are exported in OTLP/JSON, a trace export request per
+// line as the OpenTelemetry Collector file exporter writes them, so they can be read by its
+// otlpjsonfile receiver.
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext identifies a span across services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid tells whether the IDs are set, all zero IDs are invalid
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent returns the traceparent header value of sc
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value (version-traceid-parentid-flags)
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	fields := strings.Split(strings.TrimSpace(value), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" ||
+		len(fields[1]) != 32 || len(fields[2]) != 16 || len(fields[3]) != 2 {
+		return sc, false
+	}
+	// Future versions may append fields, version 00 has exactly four
+	if fields[0] == "00" && len(fields) != 4 {
+		return sc, false
+	}
+	var version, flags [1]byte
+	_, err := hex.Decode(version[:], []byte(fields[0]))
+	if err != nil {
+		return sc, false
+	}
+	_, err = hex.Decode(sc.TraceID[:], []byte(fields[1]))
+	if err != nil || strings.ToLower(fields[1]) != fields[1] {
+		return sc, false
+	}
+	_, err = hex.Decode(sc.SpanID[:], []byte(fields[2]))
+	if err != nil || strings.ToLower(fields[2]) != fields[2] {
+		return sc, false
+	}
+	_, err = hex.Decode(flags[:], []byte(fields[3]))
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// SpanKind is the role of a span in its trace, numbered as in OTLP
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+)
+
+// StatusCode is the outcome of the operation of a span, numbered as in OTLP
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Resource and scope the spans are exported with
+const (
+	serviceName = "hss"
+	scopeName   = "github.com/rkachach/hss/internal/tracing"
+)
+
+// Span is an operation of a trace. Methods of nil spans, returned while tracing is disabled,
+// do nothing.
+type Span struct {
+	mutex      sync.Mutex
+	context    SpanContext
+	parent     SpanID
+	name       string
+	kind       SpanKind
+	start      time.Time
+	attributes map[string]any
+	status     StatusCode
+	message    string
+	ended      bool
+}
+
+// TracesData is the OTLP/JSON document of exported spans
+type TracesData struct {
+	ResourceSpans []ResourceSpans `json:"resourceSpans"`
+}
+
+// ResourceSpans are the spans of a service
+type ResourceSpans struct {
+	Resource   Resource     `json:"resource"`
+	ScopeSpans []ScopeSpans `json:"scopeSpans"`
+}
+
+type Resource struct {
+	Attributes []KeyValue `json:"attributes"`
+}
+
+// ScopeSpans are the spans of the instrumentation scope named Scope
+type ScopeSpans struct {
+	Scope Scope      `json:"scope"`
+	Spans []SpanData `json:"spans"`
+}
+
+type Scope struct {
+	Name string `json:"name"`
+}
+
+// SpanData is the exported form of an ended span, IDs are hex encoded and times are in
+// nanoseconds since the epoch
+type SpanData struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              SpanKind   `json:"kind"`
+	StartTimeUnixNano uint64     `json:"startTimeUnixNano,string"`
+	EndTimeUnixNano   uint64     `json:"endTimeUnixNano,string"`
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	Status            Status     `json:"status"`
+}
+
+type Status struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// AnyValue holds one of the typed values of an attribute
+type AnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *int64   `json:"intValue,omitempty,string"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// newAnyValue converts value to its OTLP type, values of other types than strings, booleans
+// and numbers are exported as strings
+func newAnyValue(value any) AnyValue {
+	switch value := value.(type) {
+	case string:
+		return AnyValue{StringValue: &value}
+	case bool:
+		return AnyValue{BoolValue: &value}
+	case int:
+		converted := int64(value)
+		return AnyValue{IntValue: &converted}
+	case int64:
+		return AnyValue{IntValue: &value}
+	case float64:
+		return AnyValue{DoubleValue: &value}
+	default:
+		converted := fmt.Sprint(value)
+		return AnyValue{StringValue: &converted}
+	}
+}
+
+// Value returns the value held, nil if none
+func (value AnyValue) Value() any {
+	switch {
+	case value.StringValue != nil:
+		return *value.StringValue
+	case value.BoolValue != nil:
+		return *value.BoolValue
+	case value.IntValue != nil:
+		return *value.IntValue
+	case value.DoubleValue != nil:
+		return *value.DoubleValue
+	}
+	return nil
+}
+
+// Attribute returns the value of the attribute key of span, nil if not set
+func (span SpanData) Attribute(key string) any {
+	for _, attribute := range span.Attributes {
+		if attribute.Key == key {
+			return attribute.Value.Value()
+		}
+	}
+	return nil
+}
+
+// ReadSpans reads the spans exported to reader
+func ReadSpans(reader io.Reader) ([]SpanData, error) {
+	var spans []SpanData
+	decoder := json.NewDecoder(reader)
+	for decoder.More() {
+		var data TracesData
+		err := decoder.Decode(&data)
+		if err != nil {
+			return nil, err
+		}
+		for _, resource := range data.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+	}
+	return spans, nil
+}
+
+// Context returns the span context of span, invalid for nil spans
+func (span *Span) Context() SpanContext {
+	if span == nil {
+		return SpanContext{}
+	}
+	return span.context
+}
+
+// SetAttributes adds attributes to span, as key and value pairs
+func (span *Span) SetAttributes(attributes ...any) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.attributes[fmt.Sprint(attributes[i])] = attributes[i+1]
+	}
+}
+
+// SetStatus sets the status of the operation, StatusOK or StatusError with a message
+func (span *Span) SetStatus(status StatusCode, message string) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.status, span.message = status, message
+}
+
+// End ends span and exports it if sampled, later calls do nothing
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	end := time.Now()
+	span.mutex.Lock()
+	if span.ended {
+		span.mutex.Unlock()
+		return
+	}
+	span.ended = true
+	data := SpanData{
+		TraceID:           span.context.TraceID.String(),
+		SpanID:            span.context.SpanID.String(),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: uint64(span.start.UnixNano()),
+		EndTimeUnixNano:   uint64(end.UnixNano()),
+		Status:            Status{Code: span.status, Message: span.message},
+	}
+	if span.parent != (SpanID{}) {
+		data.ParentSpanID = span.parent.String()
+	}
+	keys := make([]string, 0, len(span.attributes))
+	for key := range span.attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		data.Attributes = append(data.Attributes, KeyValue{Key: key, Value: newAnyValue(span.attributes[key])})
+	}
+	span.mutex.Unlock()
+
+	if span.context.Sampled {
+		export(data)
+	}
+}
+
+// EndWithError ends span, with an error status if err isn't nil
+func (span *Span) EndWithError(err error) {
+	if err != nil {
+		span.SetStatus(StatusError, err.Error())
+	}
+	span.End()
+}
+
+type spanContextKey struct{}
+
+// SpanFromContext returns the span carried by ctx, nil if none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// Start starts a span, child of the span carried by ctx if any, and returns a copy of ctx
+// carrying it. Nothing is done while tracing is disabled.
+func Start(ctx context.Context, name string, attributes ...any) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	return start(ctx, name, KindInternal, SpanContext{}, attributes)
+}
+
+// StartServer starts the span of a request served, child of the trace context propagated
+// in the traceparent header of the request if any
+func StartServer(r *http.Request, name string, attributes ...any) (context.Context, *Span) {
+	if !Enabled() {
+		return r.Context(), nil
+	}
+	remote, _ := ParseTraceparent(r.Header.Get("traceparent"))
+	return start(r.Context(), name, KindServer, remote, attributes)
+}
+
+func start(ctx context.Context, name string, kind SpanKind, remote SpanContext, attributes []any) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	span := &Span{
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]any),
+		status:     StatusUnset,
+	}
+	parent := remote
+	if !parent.IsValid() {
+		parent = SpanFromContext(ctx).Context()
+	}
+	if parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = sampled(span.context.TraceID)
+	}
+	rand.Read(span.context.SpanID[:])
+	span.SetAttributes(attributes...)
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// tracer holds the sampling ratio and exporter of the configured tracing
+type tracer struct {
+	mutex       sync.Mutex
+	writer      io.Writer
+	sampleRatio float64
+}
+
+var activeTracer *tracer
+
+// Init sets up the configured tracing
+func Init() error {
+	cfg := config.AppConfig.Tracing
+	if !cfg.Enabled {
+		return nil
+	}
+	var writer io.Writer
+	switch cfg.Exporter {
+	case "", "stdout":
+		writer = os.Stdout
+	case "file":
+		var err error
+		writer, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("opening trace file %v: %w", cfg.File, err)
+		}
+	default:
+		return fmt.Errorf("invalid trace exporter %q", cfg.Exporter)
+	}
+	sampleRatio := 1.0
+	if cfg.SampleRatio != nil {
+		sampleRatio = *cfg.SampleRatio
+	}
+	if sampleRatio < 0 || sampleRatio > 1 {
+		return fmt.Errorf("invalid trace sample ratio %v", sampleRatio)
+	}
+	SetExporter(writer, sampleRatio)
+	return nil
+}
+
+// SetExporter enables tracing, exporting the spans of sampleRatio of the new traces to
+// writer. A nil writer disables tracing.
+func SetExporter(writer io.Writer, sampleRatio float64) {
+	if writer == nil {
+		activeTracer = nil
+		return
+	}
+	activeTracer = &tracer{writer: writer, sampleRatio: sampleRatio}
+}
+
+// Enabled tells whether requests are being traced
+func Enabled() bool {
+	return activeTracer != nil
+}
+
+// sampled decides whether to export a new trace from its random ID, as the OpenTelemetry
+// TraceIDRatioBased sampler does
+func sampled(traceID TraceID) bool {
+	ratio := activeTracer.sampleRatio
+	if ratio >= 1 {
+		return true
+	}
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < uint64(ratio*math.MaxInt64)
+}
+
+func export(data SpanData) {
+	exporter := activeTracer
+	if exporter == nil {
+		return
+	}
+	document := TracesData{ResourceSpans: []ResourceSpans{{
+		Resource: Resource{Attributes: []KeyValue{{Key: "service.name", Value: newAnyValue(serviceName)}}},
+		ScopeSpans: []ScopeSpans{{
+			Scope: Scope{Name: scopeName},
+			Spans: []SpanData{data},
+		}},
+	}}}
+	line, err := json.Marshal(document)
+	if err != nil {
+		config.Log.Error("Error exporting span", "name", data.Name, "error", err)
+		return
+	}
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	_, err = exporter.writer.Write(append(line, '\n'))
+	if err != nil {
+		config.Log.Error("Error exporting span", "name", data.Name, "error", err)
+	}
+}
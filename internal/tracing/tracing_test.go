@@ -0,0 +1,159 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(value)
+	if !ok || !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("Wrong span context %+v", sc)
+	}
+	if sc.Traceparent() != value {
+		t.Error("Wrong traceparent ", sc.Traceparent())
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(invalid)
+		if ok {
+			t.Errorf("Invalid traceparent %q accepted", invalid)
+		}
+	}
+	// Later versions may add fields
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	if !ok {
+		t.Error("Future version rejected")
+	}
+}
+
+func readSpans(t *testing.T, buffer *bytes.Buffer) []SpanData {
+	spans, err := ReadSpans(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spans
+}
+
+func TestSpans(t *testing.T) {
+	ctx, span := Start(context.Background(), "disabled")
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Fatal("Span started while tracing is disabled")
+	}
+	span.SetAttributes("ignored", 1)
+	span.EndWithError(errors.New("ignored"))
+
+	var buffer bytes.Buffer
+	SetExporter(&buffer, 1)
+	defer SetExporter(nil, 0)
+
+	request := httptest.NewRequest("GET", "/file", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := StartServer(request, "GetFile", "http.method", "GET")
+	_, child := Start(ctx, "DataStore.OpenFile", "path", "/file")
+	child.EndWithError(errors.New("not found"))
+	server.End()
+	server.End()
+
+	spans := readSpans(t, &buffer)
+	if len(spans) != 2 {
+		t.Fatal("Wrong spans exported ", spans)
+	}
+	if spans[0].Name != "DataStore.OpenFile" || spans[0].ParentSpanID != spans[1].SpanID || spans[0].Kind != KindInternal ||
+		spans[0].Status.Code != StatusError || spans[0].Status.Message != "not found" || spans[0].Attribute("path") != "/file" {
+		t.Error("Wrong child span ", spans[0])
+	}
+	if spans[1].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[1].ParentSpanID != "00f067aa0ba902b7" ||
+		spans[1].Kind != KindServer || spans[1].Status.Code != StatusUnset || spans[1].Attribute("http.method") != "GET" {
+		t.Error("Wrong server span ", spans[1])
+	}
+	if spans[0].TraceID != spans[1].TraceID || spans[1].EndTimeUnixNano < spans[1].StartTimeUnixNano {
+		t.Error("Wrong trace")
+	}
+
+	// Traces not sampled upstream aren't exported, nor are their children
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx, server = StartServer(request, "GetFile")
+	_, child = Start(ctx, "DataStore.OpenFile")
+	child.End()
+	server.End()
+	if buffer.Len() != 0 {
+		t.Error("Unsampled spans exported ", buffer.String())
+	}
+	if !strings.HasSuffix(server.Context().Traceparent(), "-00") {
+		t.Error("Wrong sampled flag ", server.Context().Traceparent())
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	var buffer bytes.Buffer
+	SetExporter(&buffer, 1)
+	defer SetExporter(nil, 0)
+
+	_, span := Start(context.Background(), "root", "count", 3, "ratio", 0.5, "ok", true)
+	span.End()
+
+	var document map[string]any
+	err := json.Unmarshal(buffer.Bytes(), &document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resource := document["resourceSpans"].([]any)[0].(map[string]any)
+	scope := resource["scopeSpans"].([]any)[0].(map[string]any)
+	exported := scope["spans"].([]any)[0].(map[string]any)
+	if scope["scope"].(map[string]any)["name"] != scopeName || exported["name"] != "root" || exported["kind"] != float64(KindInternal) {
+		t.Fatal("Wrong OTLP document ", buffer.String())
+	}
+	if _, ok := exported["startTimeUnixNano"].(string); !ok || len(exported["traceId"].(string)) != 32 || len(exported["spanId"].(string)) != 16 {
+		t.Error("Wrong OTLP span ", exported)
+	}
+	attributes := exported["attributes"].([]any)
+	if len(attributes) != 3 || attributes[0].(map[string]any)["key"] != "count" ||
+		attributes[0].(map[string]any)["value"].(map[string]any)["intValue"] != "3" {
+		t.Error("Wrong OTLP attributes ", attributes)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	var buffer bytes.Buffer
+	SetExporter(&buffer, 0.25)
+	defer SetExporter(nil, 0)
+
+	for i := 0; i < 4000; i++ {
+		_, span := Start(context.Background(), "root")
+		span.End()
+	}
+	sampled := len(readSpans(t, &buffer))
+	if sampled < 800 || sampled > 1200 {
+		t.Error("Wrong number of traces sampled ", sampled)
+	}
+}
+
+func TestSampleRatioZero(t *testing.T) {
+	var buffer bytes.Buffer
+	SetExporter(&buffer, 0)
+	defer SetExporter(nil, 0)
+
+	for i := 0; i < 100; i++ {
+		_, span := Start(context.Background(), "root")
+		span.End()
+	}
+	if buffer.Len() != 0 {
+		t.Error("Traces sampled with a zero ratio ", buffer.String())
+	}
+}
@@ -0,0 +1,125 @@
+package uploads
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrAborted is returned by the body of an upload aborted by an admin
+var ErrAborted = errors.New("upload aborted")
+
+// Session is an upload in progress on the server port
+type Session struct {
+	ID         string    `json:"id"`
+	Operation  string    `json:"operation"`
+	Path       string    `json:"path"`
+	Principal  string    `json:"principal"`
+	RemoteAddr string    `json:"remote_addr"`
+	Started    time.Time `json:"started"`
+	// Bytes of the request body read so far
+	BytesReceived int64 `json:"bytes_received"`
+
+	received atomic.Int64
+	aborted  atomic.Bool
+}
+
+// Aborted tells whether the upload was aborted
+func (session *Session) Aborted() bool {
+	return session.aborted.Load()
+}
+
+// Body wraps the request body of the upload, to count the bytes received and fail reads
+// once the upload is aborted
+func (session *Session) Body(body io.ReadCloser) io.ReadCloser {
+	return &sessionBody{ReadCloser: body, session: session}
+}
+
+type sessionBody struct {
+	io.ReadCloser
+	session *Session
+}
+
+func (body *sessionBody) Read(p []byte) (int, error) {
+	if body.session.Aborted() {
+		return 0, ErrAborted
+	}
+	n, err := body.ReadCloser.Read(p)
+	body.session.received.Add(int64(n))
+	return n, err
+}
+
+var (
+	mutex    sync.Mutex
+	sessions = make(map[string]*Session)
+)
+
+// Start registers an upload, Finish must be called once it's over
+func Start(operation string, path string, principal string, remoteAddr string) *Session {
+	session := &Session{
+		ID:         uuid.New().String(),
+		Operation:  operation,
+		Path:       path,
+		Principal:  principal,
+		RemoteAddr: remoteAddr,
+		Started:    time.Now().UTC(),
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	sessions[session.ID] = session
+	return session
+}
+
+// Finish unregisters the upload
+func (session *Session) Finish() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	delete(sessions, session.ID)
+}
+
+// List returns a snapshot of the uploads in progress, oldest first
+func List() []Session {
+	mutex.Lock()
+	defer mutex.Unlock()
+	list := make([]Session, 0, len(sessions))
+	for _, session := range sessions {
+		list = append(list, Session{
+			ID:            session.ID,
+			Operation:     session.Operation,
+			Path:          session.Path,
+			Principal:     session.Principal,
+			RemoteAddr:    session.RemoteAddr,
+			Started:       session.Started,
+			BytesReceived: session.received.Load(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// Abort aborts the upload id: the next reads of its body fail with ErrAborted. It returns
+// false if no such upload is in progress.
+func Abort(id string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	session, ok := sessions[id]
+	if ok {
+		session.aborted.Store(true)
+	}
+	return ok
+}
+
+// AbortAll aborts every upload in progress, as on shutdown, and returns how many were
+func AbortAll() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, session := range sessions {
+		session.aborted.Store(true)
+	}
+	return len(sessions)
+}
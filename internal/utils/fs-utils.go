@@ -66,34 +66,6 @@ func ListDirectoryWithDetails(dirPath string) ([]EntryInfo, error) {
 	return entries, nil
 }
 
-func GetDirectoryInfo(dirPath string) (map[string]interface{}, error) {
-    info := make(map[string]interface{})
-
-    // Get information about the directory
-    dirInfo, err := os.Stat(dirPath)
-    if err != nil {
-        return nil, err
-    }
-
-    // Fill in directory name and path
-    info["Name"] = filepath.Base(dirPath)
-    info["Path"] = dirPath
-    info["Size"] = dirInfo.Size()
-    info["CreatedTime"] = dirInfo.ModTime()
-
-    // Count files in the directory
-    filesCount := 0
-    filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-        if !info.IsDir() {
-            filesCount++
-        }
-        return nil
-    })
-    info["FilesCount"] = filesCount
-
-    return info, nil
-}
-
 func ListDirectories(dirPath string) ([]string, error) {
 	var directories []string
 
@@ -205,7 +177,6 @@ func CopyFile(src, dst string) error {
 }
 
 func SplitPath(input string) (string, string) {
-	fmt.Printf("splitting %v \n", input)
 	index := strings.Index(input, "/")
 	if index == -1 {
 		// Handle the case where there's no "/"